@@ -5,10 +5,17 @@ package golmdb
 */
 import "C"
 import (
+	"context"
 	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
 	"runtime"
+	"runtime/debug"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/rs/zerolog"
 	"wellquite.org/actors"
@@ -17,48 +24,101 @@ import (
 
 type readWriteTxnMsg struct {
 	actors.MsgSyncBase
-	txnFun func(*ReadWriteTxn) error // input
-	err    error                     // output
+	id      uint64                    // input
+	callers callers                   // input
+	txnFun  func(*ReadWriteTxn) error // input
+	err     error                     // output
 }
 
-func readOnlyLMDBClient(environment *environment) *LMDBClient {
+type compactMsg struct {
+	actors.MsgSyncBase
+	err error // output
+}
+
+type mapSizePolicyMsg struct {
+	actors.MsgSyncBase
+	policy MapSizePolicy // input
+	err    error         // output
+}
+
+var errTerminated = errors.New("golmdb server is terminated")
+
+// PanicError is returned from Update if the txn fun panics. The panic
+// is recovered within the actor, and the fun's txn aborted; other
+// Updates in the same batch are unaffected.
+type PanicError struct {
+	// The value passed to panic.
+	Value any
+	// The stack of the txn fun's go-routine at the point of the panic.
+	Stack []byte
+}
+
+func (self *PanicError) Error() string {
+	return fmt.Sprintf("Update txn fun panicked: %v\n%s", self.Value, self.Stack)
+}
+
+// If the value passed to panic was an error, Unwrap returns it.
+func (self *PanicError) Unwrap() error {
+	err, _ := self.Value.(error)
+	return err
+}
+
+func readOnlyLMDBClient(environment *environment, options *Options) *LMDBClient {
 	environment.readOnly = true
 	resizeRequired := uint32(0)
 	return &LMDBClient{
 		environment:    environment,
+		resizingLock:   new(sync.RWMutex),
 		resizeRequired: &resizeRequired,
+		metrics:        options.Metrics,
+		tracer:         options.Tracer,
+		slowTxns:       newSlowTxns(options.Log, options),
+		degraded:       new(degradedState),
 	}
 }
 
-func spawnLMDBActor(manager actors.ManagerClient, log *zerolog.Logger, environment *environment, batchSize uint) (*LMDBClient, error) {
+func spawnLMDBActor(environment *environment, options *Options) (*LMDBClient, error) {
 	server := &server{
-		batchSize:    int(batchSize),
-		environment:  environment,
-		resizingLock: new(sync.RWMutex),
+		batchSize:           int(options.BatchSize),
+		environment:         environment,
+		resizingLock:        new(sync.RWMutex),
+		readerCheckInterval: options.ReaderCheckInterval,
+		metrics:             options.Metrics,
+		tracer:              options.Tracer,
+		slowViewThreshold:   options.SlowViewThreshold,
+		slowUpdateThreshold: options.SlowUpdateThreshold,
+		degraded:            &degradedState{onDegraded: options.OnDegraded},
 	}
 
 	var err error
 	var clientBase *actors.ClientBase
-	if manager == nil {
-		clientBase, err = actors.Spawn(*log, server, "golmdb")
+	if options.Manager == nil {
+		clientBase, err = actors.Spawn(options.Log, server, "golmdb")
 	} else {
-		clientBase, err = manager.Spawn(server, "golmdb")
+		clientBase, err = options.Manager.Spawn(server, "golmdb")
 	}
 	if err != nil {
 		return nil, err
 	}
 
-	return &LMDBClient{
+	client := &LMDBClient{
 		ClientBase:     clientBase,
 		environment:    environment,
 		resizingLock:   server.resizingLock,
 		resizeRequired: &server.resizeRequired,
+		metrics:        options.Metrics,
+		tracer:         options.Tracer,
+		// Spawn waits for Init, so the server's Log is now set.
+		slowTxns: newSlowTxns(server.Log, options),
+		degraded: server.degraded,
 		readWriteTxnMsgPool: &sync.Pool{
 			New: func() interface{} {
 				return &readWriteTxnMsg{}
 			},
 		},
-	}, nil
+	}
+	client.sweeper = newExpirySweeper(client, server.Log, options)
+	return client, nil
 }
 
 // --- Client side API ---
@@ -68,15 +128,62 @@ func spawnLMDBActor(manager actors.ManagerClient, log *zerolog.Logger, environme
 // and close/terminate the database. A single client is safe for any
 // number of go-routines to use concurrently.
 type LMDBClient struct {
+	// Updates submitted but not yet returned, and the last ids given to
+	// Views and Updates. First for alignment on 32-bit platforms.
+	updateQueueDepth int64
+	lastViewID       uint64
+	lastUpdateID     uint64
 	*actors.ClientBase
 	environment         *environment
 	resizingLock        *sync.RWMutex
 	resizeRequired      *uint32
 	readWriteTxnMsgPool *sync.Pool
+	metrics             Metrics
+	tracer              Tracer
+	slowTxns            slowTxns
+	inFlight            inFlight
+	degraded            *degradedState
+	sweeper             *expirySweeper
 }
 
 var _ actors.Client = (*LMDBClient)(nil)
 
+// As View, except that if fun returns nil, the read txn is committed
+// rather than aborted, so that the DBRefs it opened stay valid for
+// later txns. This is for ReadOnly clients, which cannot open DBRefs
+// with an Update. The fun is not restarted on MapFull.
+func (self *LMDBClient) viewAndKeepDBRefs(fun func(rotxn *ReadOnlyTxn) error) error {
+	if err := self.inFlight.enter(); err != nil {
+		return err
+	}
+	defer self.inFlight.exit()
+	if err := self.environment.readerSlots.acquire(context.Background()); err != nil {
+		return err
+	}
+	defer self.environment.readerSlots.release()
+	self.resizingLock.RLock()
+	defer self.resizingLock.RUnlock()
+
+	txn, err := self.beginReadTxn()
+	if err != nil {
+		return err
+	}
+	readOnlyTxn := ReadOnlyTxn{
+		txn:            txn,
+		resizeRequired: self.resizeRequired,
+		names:          self.environment.dbNames,
+		expiry:         self.environment.expiry,
+		versions:       self.environment.versions,
+		compression:    self.environment.compression,
+		sequences:      self.environment.sequences,
+	}
+	if err = fun(&readOnlyTxn); err != nil {
+		C.mdb_txn_abort(txn)
+		return err
+	}
+	return asError(C.mdb_txn_commit(txn))
+}
+
 // Run a View: a read-only transaction. The fun will be run in the
 // current go-routine. Multiple concurrent calls to View can proceed
 // concurrently. If there are write transactions going on
@@ -89,28 +196,83 @@ var _ actors.Client = (*LMDBClient)(nil)
 // returned from this method.
 //
 // Nested transactions are not supported.
+//
+// Every View needs a slot in LMDB's reader table, of which there are
+// Options.NumReaders. If they are all in use, View waits until one is
+// free. Use ViewContext to bound that wait.
 func (self *LMDBClient) View(fun func(rotxn *ReadOnlyTxn) error) (err error) {
-	if !self.environment.readOnly {
-		self.resizingLock.RLock()
-		defer self.resizingLock.RUnlock()
+	return self.ViewContext(context.Background(), fun)
+}
+
+// ViewContext is the same as View, except that if the View has to wait
+// for a slot in LMDB's reader table, it gives up once the ctx is done,
+// returning the ctx's error without running the fun. The ctx is not
+// consulted once the fun is running.
+//
+// Slots are only managed within this client: readers in other
+// processes sharing the same database can still cause ReadersFull
+// errors.
+func (self *LMDBClient) ViewContext(ctx context.Context, fun func(rotxn *ReadOnlyTxn) error) (err error) {
+	if err := self.inFlight.enter(); err != nil {
+		return err
 	}
+	defer self.inFlight.exit()
+
+	id := atomic.AddUint64(&self.lastViewID, 1)
+	stack := captureCallers(self.slowTxns.stacks)
+	start := time.Now()
+	var txnID uint64
+	defer func() {
+		duration := time.Since(start)
+		self.metrics.View(duration, err)
+		self.tracer.ViewEnd(id, txnID, duration, err)
+	}()
 
-	txn, err := self.environment.txnBegin(true, nil)
+	if err := self.environment.readerSlots.acquire(ctx); err != nil {
+		return err
+	}
+	defer self.environment.readerSlots.release()
+
+	self.resizingLock.RLock()
+	defer self.resizingLock.RUnlock()
+	held := time.Now()
+	defer func() { self.slowTxns.logIfSlowView(id, time.Since(held), stack) }()
+
+	txn, err := self.beginReadTxn()
 	if err != nil {
 		return err
 	}
 	readOnlyTxn := ReadOnlyTxn{
 		txn:            txn,
 		resizeRequired: self.resizeRequired,
+		names:          self.environment.dbNames,
+		expiry:         self.environment.expiry,
+		versions:       self.environment.versions,
+		compression:    self.environment.compression,
+		sequences:      self.environment.sequences,
 	}
 	// use a defer as it'll run even on a panic
-	defer C.mdb_txn_abort(txn)
+	defer func() {
+		if readOnlyTxn.txn != nil {
+			C.mdb_txn_abort(readOnlyTxn.txn)
+		}
+	}()
+	txnID = uint64(C.mdb_txn_id(txn))
+	self.tracer.ViewStart(id, txnID)
 	for {
 		err := fun(&readOnlyTxn)
-		if err == MapFull {
-			// unlock and wait to relock so that the server can resize.
+		if errors.Is(err, MapFull) {
+			// abort, then unlock and wait to relock so that the server
+			// can resize (or reopen) the environment, then restart with
+			// a fresh txn.
+			C.mdb_txn_abort(readOnlyTxn.txn)
+			readOnlyTxn.txn = nil
 			self.resizingLock.RUnlock()
 			self.resizingLock.RLock()
+			if readOnlyTxn.txn, err = self.beginReadTxn(); err != nil {
+				return err
+			}
+			txnID = uint64(C.mdb_txn_id(readOnlyTxn.txn))
 			continue
 		}
 		return err
@@ -134,32 +296,63 @@ func (self *LMDBClient) View(fun func(rotxn *ReadOnlyTxn) error) (err error) {
 // If the fun is run and returns a non-nil error then it will not be
 // re-run.
 //
+// If the fun panics, the panic is recovered, the fun's txn is
+// aborted, and Update returns a *PanicError. The fun will not be
+// re-run. Other Updates continue as normal.
+//
+// If the client is in degraded read-only mode (see DegradedError),
+// Update fails straight away with a *DegradedError.
+//
 // Only a single Update transaction can run at a time; golmdb will
 // manage this for you. An Update transaction can proceed concurrently
 // with one or more View transactions.
 //
 // Nested transactions are not supported.
-func (self *LMDBClient) Update(fun func(rwtxn *ReadWriteTxn) error) error {
+func (self *LMDBClient) Update(fun func(rwtxn *ReadWriteTxn) error) (err error) {
 	if self.environment.readOnly {
 		return errors.New("Cannot update: LMDB has been opened in ReadOnly mode")
 	}
+	if err := self.inFlight.enter(); err != nil {
+		return err
+	}
+	defer self.inFlight.exit()
+
+	id := atomic.AddUint64(&self.lastUpdateID, 1)
+	self.tracer.UpdateEnqueue(id)
+	start := time.Now()
+	self.metrics.UpdateQueueDepth(int(atomic.AddInt64(&self.updateQueueDepth, 1)))
+	defer func() {
+		duration := time.Since(start)
+		self.metrics.UpdateQueueDepth(int(atomic.AddInt64(&self.updateQueueDepth, -1)))
+		self.metrics.Update(duration, err)
+		self.tracer.UpdateEnd(id, duration, err)
+	}()
+
+	if err := self.degraded.check(); err != nil {
+		return err
+	}
 
 	msg := self.readWriteTxnMsgPool.Get().(*readWriteTxnMsg)
+	msg.id = id
+	msg.callers = captureCallers(self.slowTxns.stacks)
 	msg.txnFun = fun
 
 	if self.SendSync(msg, true) {
-		err := msg.err
+		err = msg.err
 		self.readWriteTxnMsgPool.Put(msg)
 		return err
 	} else {
 		self.readWriteTxnMsgPool.Put(msg)
-		return errors.New("golmdb server is terminated")
+		return errTerminated
 	}
 }
 
 // Terminates the actor for Update transactions (if it's running), and
 // then shuts down the LMDB database.
 //
+// Close is usually a better choice: it waits for concurrently running
+// transactions to finish.
+//
 // You must make sure that all concurrently running transactions have
 // finished before you call this method: this method will not wait for
 // concurrent View transactions to finish (or prevent new ones from
@@ -174,6 +367,11 @@ func (self *LMDBClient) Update(fun func(rwtxn *ReadWriteTxn) error) error {
 // return once the actor has fully terminated and the LMDB database
 // has been closed.
 func (self *LMDBClient) TerminateSync() {
+	self.inFlight.closeOnce.Do(self.terminate)
+}
+
+func (self *LMDBClient) terminate() {
+	self.sweeper.stop()
 	if !self.environment.readOnly {
 		self.ClientBase.TerminateSync()
 	}
@@ -194,7 +392,16 @@ func (self *LMDBClient) TerminateSync() {
 // explicit call to Sync is then needed to flush everything through
 // onto disk.
 func (self *LMDBClient) Sync(force bool) error {
-	return self.environment.sync(force)
+	if err := self.inFlight.enter(); err != nil {
+		return err
+	}
+	defer self.inFlight.exit()
+	self.resizingLock.RLock()
+	defer self.resizingLock.RUnlock()
+	start := time.Now()
+	err := self.environment.sync(force)
+	self.metrics.Sync(time.Since(start))
+	return err
 }
 
 // Copy the entire database to a new path, optionally compacting it.
@@ -211,7 +418,101 @@ func (self *LMDBClient) Sync(force bool) error {
 // transaction doing the copy sees a consistent snapshot of the entire
 // database.
 func (self *LMDBClient) Copy(path string, compact bool) error {
-	return self.environment.copy(path, compact)
+	if err := self.inFlight.enter(); err != nil {
+		return err
+	}
+	defer self.inFlight.exit()
+	// as in ViewContext, the reader slot must be acquired before the
+	// resizingLock: a View waiting for the resizingLock holds a slot.
+	if err := self.environment.readerSlots.acquire(context.Background()); err != nil {
+		return err
+	}
+	defer self.environment.readerSlots.release()
+	self.resizingLock.RLock()
+	defer self.resizingLock.RUnlock()
+	for {
+		// the copy is done within a read txn, so may find another
+		// process has resized the map.
+		err := self.environment.copy(path, compact)
+		if !errors.Is(err, MapResized) {
+			return err
+		}
+		if err = self.adoptMapSize(); err != nil {
+			return err
+		}
+	}
+}
+
+// ReaderSlotStats reports how many of LMDB's reader slots are in use
+// by this client, how many Views are queued waiting for one, and how
+// long Views have spent waiting.
+func (self *LMDBClient) ReaderSlotStats() ReaderSlotStats {
+	return self.environment.readerSlots.stats()
+}
+
+// Replace the MapSizePolicy in use. The database is opened with
+// DefaultMapSizePolicy(). If the new policy's InitialSize is larger
+// than the current map size, the map is grown to it immediately.
+//
+// Note that MaxSize only prevents the map from growing: if the map is
+// already larger than the new MaxSize, it is not shrunk.
+func (self *LMDBClient) SetMapSizePolicy(policy MapSizePolicy) error {
+	if self.environment.readOnly {
+		return errors.New("Cannot set MapSizePolicy: LMDB has been opened in ReadOnly mode")
+	}
+	if err := policy.validate(); err != nil {
+		return err
+	}
+
+	msg := &mapSizePolicyMsg{policy: policy}
+	if self.SendSync(msg, true) {
+		return msg.err
+	} else {
+		return errTerminated
+	}
+}
+
+// Compact the database in place, shrinking its data file.
+//
+// LMDB never shrinks its data file: pages freed by deletes are reused
+// by later writes, but are never given back to the filesystem. Compact
+// makes a compacted copy of the database (exactly as Copy(path, true)
+// does) alongside the data file, and then swaps that copy in place of
+// the data file. The environment is then reopened with a map size
+// suited to the compacted data, and carries on serving.
+//
+// Update transactions are paused for the whole of the compaction
+// (any already queued are run first, so the compacted copy includes
+// them). View transactions continue to run whilst the copy is being
+// made, and are only blocked during the swap itself. As with
+// resizing, any View that is running when the swap starts is aborted
+// and automatically restarted once the swap is complete.
+//
+// DBRefs obtained from Update transactions remain valid across the
+// swap. However, if a database has been Dropped and its DBRef not
+// since reused, the DBRefs can no longer be recreated faithfully and
+// Compact will return an error without doing anything.
+//
+// The database must not be open by any other process while Compact
+// runs. If Compact returns an error then either nothing has changed,
+// or the environment could not be reopened; in the latter case the
+// actor terminates and the client must not be used further, other
+// than to call TerminateSync.
+func (self *LMDBClient) Compact() error {
+	if self.environment.readOnly {
+		return errors.New("Cannot compact: LMDB has been opened in ReadOnly mode")
+	}
+	if err := self.inFlight.enter(); err != nil {
+		return err
+	}
+	defer self.inFlight.exit()
+
+	msg := &compactMsg{}
+	if self.SendSync(msg, true) {
+		return msg.err
+	} else {
+		return errTerminated
+	}
 }
 
 // --- Server side ---
@@ -225,6 +526,28 @@ type server struct {
 	resizeRequired uint32
 	environment    *environment
 	readWriteTxn   ReadWriteTxn
+	// DBRefs opened (and not dropped) by committed txns, sorted.
+	dbRefs []dbRefOp
+	// DBRef ops from child txns which are awaiting the commit of their
+	// parent txn.
+	batchDBRefOps []dbRefOp
+	// Merges which have not yet been applied; see mergeBuffer.
+	merges mergeBuffer
+
+	selfClient          *actors.ClientBase
+	readerCheckInterval time.Duration
+	readerCheckTimer    *time.Timer
+	metrics             Metrics
+	tracer              Tracer
+	slowViewThreshold   time.Duration
+	slowUpdateThreshold time.Duration
+	watchdog            *watchdog
+	degraded            *degradedState
+	// The id of the batch currently being run (0 if none), and the ids
+	// of the Updates within it.
+	batchID     uint64
+	lastBatchID uint64
+	updateIDs   []uint64
 }
 
 var _ actors.Server = (*server)(nil)
@@ -234,6 +557,18 @@ func (self *server) Init(log zerolog.Logger, mailboxReader *mailbox.MailboxReade
 	runtime.LockOSThread()
 	readWriteTxn := &self.readWriteTxn
 	readWriteTxn.resizeRequired = &self.resizeRequired
+	readWriteTxn.names = self.environment.dbNames
+	readWriteTxn.indexes = self.environment.indexes
+	readWriteTxn.expiry = self.environment.expiry
+	readWriteTxn.versions = self.environment.versions
+	readWriteTxn.compression = self.environment.compression
+	readWriteTxn.sequences = self.environment.sequences
+	self.merges.txn = readWriteTxn
+	self.merges.registry = self.environment.merges
+	readWriteTxn.merges = &self.merges
+	self.selfClient = selfClient
+	self.scheduleReaderCheck()
+	self.watchdog = newWatchdog(log, self.slowUpdateThreshold)
 	return self.ServerBase.Init(log, mailboxReader, selfClient)
 }
 
@@ -242,20 +577,98 @@ func (self *server) HandleMsg(msg any) error {
 	case *readWriteTxnMsg:
 		self.batch = append(self.batch, msgT)
 		if len(self.batch) == self.batchSize || self.MailboxReader.IsEmpty() {
-			batch := self.batch
-			self.batch = self.batch[:0]
-			if self.Log.Trace().Enabled() {
-				self.Log.Trace().Int("batch size", len(batch)).Msg("running batch")
-			}
-			return self.runBatch(batch)
+			return self.runPendingBatch()
 		}
 		return nil
 
+	case *compactMsg:
+		// Anything already batched up must be run first, so that the
+		// compacted copy includes it.
+		fatalErr := self.runPendingBatch()
+		if fatalErr == nil {
+			msgT.err, fatalErr = self.compact()
+		}
+		if fatalErr != nil {
+			msgT.err = fatalErr
+		}
+		msgT.MarkProcessed()
+		return fatalErr
+
+	case *mapSizePolicyMsg:
+		fatalErr := self.runPendingBatch()
+		if fatalErr == nil {
+			self.environment.mapSizePolicy = msgT.policy
+			// the new policy supersedes any resize that failed.
+			self.degraded.forgetMapSize()
+			if initialSize := msgT.policy.initialSize(); initialSize > self.environment.mapSize {
+				fatalErr = self.resize(initialSize, true)
+			}
+		}
+		msgT.err = fatalErr
+		msgT.MarkProcessed()
+		return nonFatal(fatalErr)
+
+	case *resumeMsg:
+		fatalErr := self.runPendingBatch()
+		if fatalErr == nil {
+			fatalErr = self.resume()
+		}
+		msgT.err = fatalErr
+		msgT.MarkProcessed()
+		return nonFatal(fatalErr)
+
+	case *adoptMapSizeMsg:
+		fatalErr := self.runPendingBatch()
+		if fatalErr == nil {
+			fatalErr = self.adoptMapSize()
+		}
+		msgT.err = fatalErr
+		msgT.MarkProcessed()
+		return fatalErr
+
+	case *readerCheckMsg:
+		if fatalErr := self.runPendingBatch(); fatalErr != nil {
+			return fatalErr
+		}
+		return self.checkReaders()
+
 	default:
 		return self.ServerBase.HandleMsg(msg)
 	}
 }
 
+func (self *server) runPendingBatch() error {
+	batch := self.batch
+	self.batch = self.batch[:0]
+	if len(batch) != 0 && self.Log.Trace().Enabled() {
+		self.Log.Trace().Int("batch size", len(batch)).Msg("running batch")
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	if err := self.degraded.check(); err != nil {
+		// these were sent before we became degraded.
+		markBatchProcessed(batch, err)
+		return nil
+	}
+
+	self.lastBatchID++
+	self.batchID = self.lastBatchID
+	self.updateIDs = self.updateIDs[:0]
+	for _, msg := range batch {
+		self.updateIDs = append(self.updateIDs, msg.id)
+	}
+	self.tracer.BatchStart(self.batchID, self.updateIDs)
+
+	start := time.Now()
+	err := nonFatal(self.runBatch(batch))
+	duration := time.Since(start)
+	self.metrics.BatchRun(len(batch), duration)
+	self.tracer.BatchEnd(self.batchID, duration, err)
+	self.batchID = 0
+	return err
+}
+
 func (self *server) runBatch(batch []*readWriteTxnMsg) error {
 	switch batchLen := len(batch); batchLen {
 	case 0:
@@ -270,12 +683,17 @@ func (self *server) runBatch(batch []*readWriteTxnMsg) error {
 				return fatalErr
 			}
 
-			if txnErr == MapFull {
+			if errors.Is(txnErr, MapFull) {
 				// MapFull can come either from a Put, or from a Commit. We
 				// need to increase the size, and then re-run the txn.
+				self.metrics.Retry(MapFull)
 				fatalErr = self.increaseSize()
 				if fatalErr == nil {
 					continue
+				} else if errors.Is(fatalErr, ErrMapSizeLimit) {
+					// not fatal: the txn simply doesn't fit.
+					markBatchProcessed(batch, fatalErr)
+					return nil
 				} else {
 					markBatchProcessed(batch, fatalErr)
 					return fatalErr
@@ -283,17 +701,22 @@ func (self *server) runBatch(batch []*readWriteTxnMsg) error {
 			}
 
 			markBatchProcessed(batch, txnErr)
+			if txnErr == nil {
+				return self.growIfNearlyFull()
+			}
 			return nil
 		}
 
 	default:
 		for batchLen > 0 {
-			outerTxn, outerErr := self.environment.txnBegin(false, nil)
+			outerTxn, outerErr := self.beginWriteTxn()
 			if outerErr != nil {
 				// if we can't even create the txn, that's fatal to the whole system
 				markBatchProcessed(batch, outerErr)
 				return outerErr
 			}
+			self.batchDBRefOps = self.batchDBRefOps[:0]
+			self.merges.reset()
 
 			for idx, msg := range batch {
 				if msg == nil {
@@ -306,8 +729,12 @@ func (self *server) runBatch(batch []*readWriteTxnMsg) error {
 					return innerFatalErr
 				}
 
-				if innerTxnErr == MapFull || innerTxnErr == TxnFull {
-					outerErr = innerTxnErr
+				if errors.Is(innerTxnErr, MapFull) {
+					outerErr = MapFull
+					break
+
+				} else if errors.Is(innerTxnErr, TxnFull) {
+					outerErr = TxnFull
 					break
 
 				} else if innerTxnErr != nil {
@@ -319,27 +746,66 @@ func (self *server) runBatch(batch []*readWriteTxnMsg) error {
 			}
 
 			if outerErr == nil {
+				// the merges of the whole batch are applied together.
+				readWriteTxn := &self.readWriteTxn
+				readWriteTxn.dbRefOps = readWriteTxn.dbRefOps[:0]
+				outerErr = self.flushMerges(outerTxn)
+				self.batchDBRefOps = append(self.batchDBRefOps, readWriteTxn.dbRefOps...)
+				if errors.Is(outerErr, MapFull) {
+					outerErr = MapFull
+				} else if errors.Is(outerErr, TxnFull) {
+					outerErr = TxnFull
+				} else if outerErr != nil {
+					// Run the txns 1-by-1, so that the error is returned
+					// to the txn whose merge caused it.
+					outerErr = errMergeFailed
+				}
+			}
+
+			if outerErr == nil {
+				txnID := uint64(C.mdb_txn_id(outerTxn))
+				start := time.Now()
 				outerErr = asError(C.mdb_txn_commit(outerTxn))
+				if isNoSpace(outerErr) {
+					outerErr = self.degrade(outerErr, 0)
+				}
+				duration := time.Since(start)
+				self.metrics.Commit(duration)
+				self.tracer.Commit(self.batchID, txnID, duration, outerErr)
+				if outerErr == nil {
+					self.applyDBRefOps(self.batchDBRefOps)
+				}
 			} else {
 				C.mdb_txn_abort(outerTxn)
 			}
+			self.merges.reset()
 
 			if outerErr == MapFull {
 				// MapFull can come either from a Put, or from a Commit. We
 				// need to increase the size, and then re-run the entire batch.
+				self.metrics.Retry(MapFull)
 				outerErr = self.increaseSize()
 				if outerErr == nil {
 					continue
-				} else {
+				} else if !errors.Is(outerErr, ErrMapSizeLimit) {
 					markBatchProcessed(batch, outerErr)
 					return outerErr
 				}
+				// The map can't grow any further, but individually some
+				// of the txns may still fit.
+			}
 
-			} else if outerErr == TxnFull {
+			if outerErr == TxnFull || outerErr == errMergeFailed || errors.Is(outerErr, ErrMapSizeLimit) {
 				// they've all been aborted; we switch to attempting them
 				// 1-by-1 in the hope that individually, they will not
 				// overfill transactions.
-				for idx := 0; idx < batchLen; idx++ {
+				if outerErr == TxnFull {
+					self.metrics.Retry(TxnFull)
+				}
+				for idx, msg := range batch {
+					if msg == nil {
+						continue
+					}
 					fatalErr := self.runBatch(batch[idx : idx+1])
 					if fatalErr != nil {
 						markBatchProcessed(batch[idx+1:], fatalErr)
@@ -350,6 +816,9 @@ func (self *server) runBatch(batch []*readWriteTxnMsg) error {
 			}
 
 			markBatchProcessed(batch, outerErr)
+			if outerErr == nil {
+				return self.growIfNearlyFull()
+			}
 			return nil
 		}
 		return nil
@@ -357,7 +826,14 @@ func (self *server) runBatch(batch []*readWriteTxnMsg) error {
 }
 
 func (self *server) runAndCommitWriteTxnMsg(batch []*readWriteTxnMsg, parentTxn *C.MDB_txn, msg *readWriteTxnMsg) (txnErr, fatalErr error) {
-	txn, err := self.environment.txnBegin(false, parentTxn)
+	runStart := time.Now()
+	var txn *C.MDB_txn
+	var err error
+	if parentTxn == nil {
+		txn, err = self.beginWriteTxn()
+	} else {
+		txn, err = self.environment.txnBegin(false, parentTxn)
+	}
 	if err != nil {
 		// if we can't even create the txn, that's fatal to the whole system
 		return nil, err
@@ -365,17 +841,203 @@ func (self *server) runAndCommitWriteTxnMsg(batch []*readWriteTxnMsg, parentTxn
 
 	readWriteTxn := &self.readWriteTxn
 	readWriteTxn.txn = txn
-	err = msg.txnFun(readWriteTxn)
+	readWriteTxn.dbRefOps = readWriteTxn.dbRefOps[:0]
+	mergesSnapshot := self.merges.snapshot()
+	funStart := time.Now()
+	self.watchdog.start(msg.id, funStart)
+	err = runTxnFun(msg.txnFun, readWriteTxn)
+	self.watchdog.finish()
+	self.logIfSlowUpdate(msg, time.Since(funStart))
 	readWriteTxn.txn = nil
+	if err == nil && parentTxn == nil {
+		// without a parent, this txn is the whole batch.
+		err = self.flushMerges(txn)
+	}
 
 	if err == nil {
+		txnID := uint64(C.mdb_txn_id(txn))
+		start := time.Now()
 		err = asError(C.mdb_txn_commit(txn))
+		if parentTxn == nil && isNoSpace(err) {
+			err = self.degrade(err, 0)
+		}
+		if parentTxn == nil {
+			duration := time.Since(start)
+			self.metrics.Commit(duration)
+			self.tracer.Commit(self.batchID, txnID, duration, err)
+		}
+		if err == nil {
+			if parentTxn == nil {
+				self.applyDBRefOps(readWriteTxn.dbRefOps)
+			} else {
+				self.batchDBRefOps = append(self.batchDBRefOps, readWriteTxn.dbRefOps...)
+			}
+		}
 	} else {
 		C.mdb_txn_abort(txn)
 	}
+	if err != nil {
+		self.merges.restore(mergesSnapshot)
+	}
+	self.tracer.TxnRun(self.batchID, msg.id, time.Since(runStart), err)
 	return err, nil
 }
 
+// Applies all the pending merges within txn. A MergeOperator which
+// panics is treated just like a txn fun which panics.
+func (self *server) flushMerges(txn *C.MDB_txn) error {
+	readWriteTxn := &self.readWriteTxn
+	readWriteTxn.txn = txn
+	defer func() { readWriteTxn.txn = nil }()
+	return runTxnFun(func(*ReadWriteTxn) error { return self.merges.flushAll() }, readWriteTxn)
+}
+
+// Runs the txn fun, converting any panic into a *PanicError.
+func runTxnFun(txnFun func(*ReadWriteTxn) error, readWriteTxn *ReadWriteTxn) (err error) {
+	defer func() {
+		if value := recover(); value != nil {
+			err = &PanicError{Value: value, Stack: debug.Stack()}
+		}
+	}()
+	return txnFun(readWriteTxn)
+}
+
+// Once a txn which opened or dropped DBRefs has been committed to the
+// environment, record the DBRefs which are now in use.
+func (self *server) applyDBRefOps(ops []dbRefOp) {
+	for _, op := range ops {
+		self.environment.sequences.apply(op)
+		idx := sort.Search(len(self.dbRefs), func(i int) bool { return self.dbRefs[i].dbRef >= op.dbRef })
+		found := idx < len(self.dbRefs) && self.dbRefs[idx].dbRef == op.dbRef
+		if op.dropped {
+			self.environment.indexes.dropped(op.dbRef)
+			self.environment.expiry.dropped(op.dbRef)
+			self.environment.merges.dropped(op.dbRef)
+			self.environment.versions.dropped(op.dbRef)
+			self.environment.compression.dropped(op.dbRef)
+		}
+		if op.dropped && found {
+			self.dbRefs = append(self.dbRefs[:idx], self.dbRefs[idx+1:]...)
+		} else if !op.dropped && !found {
+			self.dbRefs = append(self.dbRefs, dbRefOp{})
+			copy(self.dbRefs[idx+1:], self.dbRefs[idx:])
+			self.dbRefs[idx] = op
+		}
+	}
+}
+
+// LMDB hands out DBRefs by using the lowest free slot, starting after
+// its two core databases. So provided there are no gaps, opening the
+// same names again, in the same order, recreates the same DBRefs.
+const coreDBs = 2
+
+func (self *server) checkDBRefsReopenable() error {
+	for idx, dbRef := range self.dbRefs {
+		if dbRef.dbRef != DBRef(coreDBs+idx) {
+			return fmt.Errorf("Cannot reopen DBRefs: DBRef %d has been dropped and not reused", coreDBs+idx)
+		}
+	}
+	return nil
+}
+
+func (self *server) reopenDBRefs() error {
+	if len(self.dbRefs) == 0 {
+		return nil
+	}
+	txn, err := self.environment.txnBegin(false, nil)
+	if err != nil {
+		return err
+	}
+	readOnlyTxn := ReadOnlyTxn{
+		txn:            txn,
+		resizeRequired: new(uint32),
+		names:          self.environment.dbNames,
+	}
+	for _, dbRef := range self.dbRefs {
+		reopened, err := readOnlyTxn.DBRef(dbRef.name, dbRef.flags)
+		if err == nil && reopened != dbRef.dbRef {
+			err = fmt.Errorf("Reopening database %q gave DBRef %d rather than %d", dbRef.name, reopened, dbRef.dbRef)
+		}
+		if err != nil {
+			C.mdb_txn_abort(txn)
+			return err
+		}
+	}
+	return asError(C.mdb_txn_commit(txn))
+}
+
+// The actor is quiesced for the whole compaction simply by virtue of
+// this running within the actor. Views are only stopped (via the
+// resizingLock) for the swap.
+func (self *server) compact() (compactErr, fatalErr error) {
+	if err := self.checkDBRefsReopenable(); err != nil {
+		return err, nil
+	}
+
+	environment := self.environment
+	dataPath := environment.dataFilePath()
+	before, err := os.Stat(dataPath)
+	if err != nil {
+		return err, nil
+	}
+
+	copyPath, cleanup, err := environment.compactedCopy()
+	if err != nil {
+		return err, nil
+	}
+	defer cleanup()
+	after, err := os.Stat(copyPath)
+	if err != nil {
+		return err, nil
+	}
+
+	// leave room to grow, so the next Update doesn't immediately have
+	// to resize.
+	mapSize := environment.mapSizePolicy.rightSize(uint64(after.Size()))
+
+	start := time.Now()
+	atomic.StoreUint32(&self.resizeRequired, 1)
+	self.resizingLock.Lock()
+	defer self.resizingLock.Unlock()
+	defer atomic.StoreUint32(&self.resizeRequired, 0)
+	self.logIfSlowViews(time.Since(start))
+
+	start = time.Now()
+	swapErr, openErr := environment.reopen(mapSize, func() error {
+		if err := os.Rename(copyPath, dataPath); err != nil {
+			return err
+		}
+		return syncDir(filepath.Dir(dataPath))
+	})
+	if openErr == nil {
+		openErr = self.reopenDBRefs()
+	}
+	if openErr != nil {
+		self.Log.Error().Err(openErr).Msg("reopening after compaction")
+		return nil, openErr
+	}
+	if swapErr != nil {
+		self.Log.Error().Err(swapErr).Msg("swapping in compacted copy")
+		return swapErr, nil
+	}
+
+	self.Log.Info().Int64("size before", before.Size()).Int64("size after", after.Size()).Uint64("map size", environment.mapSize).Dur("swap duration", time.Since(start)).Msg("compacted")
+	return nil, nil
+}
+
+// Closes and reopens the environment, on the same data file, and
+// reopens the DBRefs. Must be called with the resizingLock locked.
+func (self *server) reopenEnvironment(mapSize uint64) error {
+	if err := self.checkDBRefsReopenable(); err != nil {
+		return err
+	}
+	_, err := self.environment.reopen(mapSize, func() error { return nil })
+	if err == nil {
+		err = self.reopenDBRefs()
+	}
+	return err
+}
+
 func markBatchProcessed(batch []*readWriteTxnMsg, err error) {
 	for _, msg := range batch {
 		if msg != nil {
@@ -386,7 +1048,11 @@ func markBatchProcessed(batch []*readWriteTxnMsg, err error) {
 }
 
 func (self *server) Terminated(err error, caughtPanic interface{}) {
-	if self.readWriteTxn.txn != nil { // this can happen if a txn fun panics
+	if self.readerCheckTimer != nil {
+		self.readerCheckTimer.Stop()
+	}
+	self.watchdog.finish()
+	if self.readWriteTxn.txn != nil { // this can happen if the actor panics mid-txn
 		C.mdb_txn_abort(self.readWriteTxn.txn)
 		self.readWriteTxn.txn = nil
 	}
@@ -394,24 +1060,68 @@ func (self *server) Terminated(err error, caughtPanic interface{}) {
 }
 
 func (self *server) increaseSize() error {
+	currentMapSize := self.environment.mapSize
+	mapSize, err := self.environment.mapSizePolicy.next(currentMapSize)
+	if err != nil {
+		self.Log.Warn().Uint64("current size", currentMapSize).Uint64("max size", self.environment.mapSizePolicy.MaxSize).Msg("cannot increase map size")
+		return err
+	}
+	return self.resize(mapSize, true)
+}
+
+// Called after a successful commit. If the map is nearly full, grow
+// it now, so that later Updates are unlikely to hit MapFull.
+func (self *server) growIfNearlyFull() error {
+	used, err := self.environment.usedSize()
+	if err != nil {
+		return err
+	}
+	if !self.environment.mapSizePolicy.shouldGrow(used, self.environment.mapSize) {
+		return nil
+	}
+	if self.Log.Debug().Enabled() {
+		self.Log.Debug().Uint64("used size", used).Uint64("current size", self.environment.mapSize).Msg("map nearly full")
+	}
+	mapSize, err := self.environment.mapSizePolicy.next(self.environment.mapSize)
+	if err != nil {
+		return nil // not fatal; any Update that doesn't fit will get the error.
+	}
+	return self.resize(mapSize, false)
+}
+
+// required is false for a proactive resize (see growIfNearlyFull):
+// if that fails, the map still has room, so we carry on at its
+// current size, and only degrade once an Update actually doesn't fit.
+func (self *server) resize(mapSize uint64, required bool) error {
+	start := time.Now()
 	atomic.StoreUint32(&self.resizeRequired, 1)
 	self.resizingLock.Lock()
 	defer self.resizingLock.Unlock()
 	defer atomic.StoreUint32(&self.resizeRequired, 0)
+	self.logIfSlowViews(time.Since(start))
 
 	currentMapSize := self.environment.mapSize
-	mapSize := uint64(float64(currentMapSize) * 1.5)
-	if remainder := mapSize % self.environment.pageSize; remainder != 0 {
-		mapSize = (mapSize + self.environment.pageSize) - remainder
-	}
-
-	if err := self.environment.setMapSize(mapSize); err != nil {
+	if err := self.environment.remap(mapSize); err != nil {
 		self.Log.Error().Uint64("current size", currentMapSize).Uint64("new size", mapSize).Err(err).Msg("increasing map size")
-		return err
+		// LMDB may have unmapped the old map, and won't map it again:
+		// reopen at the current size, as for compaction. If we can do
+		// that, Views can carry on, and we only need stop Updates.
+		if fatalErr := self.reopenEnvironment(currentMapSize); fatalErr != nil {
+			self.Log.Error().Uint64("size", currentMapSize).Err(fatalErr).Msg("reopening after failing to increase map size")
+			return fatalErr
+		}
+		if !required {
+			self.Log.Warn().Uint64("size", currentMapSize).Msg("proactive map resize failed; staying at current size")
+			return nil
+		}
+		return self.degrade(err, mapSize)
 	}
 	if self.Log.Debug().Enabled() {
 		self.Log.Debug().Uint64("current size", currentMapSize).Uint64("new size", mapSize).Msg("increasing map size")
 	}
 	self.environment.mapSize = mapSize
+	duration := time.Since(start)
+	self.metrics.Resize(currentMapSize, mapSize, duration)
+	self.tracer.Resize(self.batchID, currentMapSize, mapSize, duration)
 	return nil
 }
@@ -0,0 +1,440 @@
+package golmdb
+
+/*
+#include <lmdb.h>
+*/
+import "C"
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"unsafe"
+)
+
+// The name LMDB gives to the data file within an environment
+// directory (i.e. when NoSubDir is not in use).
+const dataFileName = "data.mdb"
+
+// The layout of the meta pages is not part of LMDB's public API, but
+// it has been stable since the data format was versioned. These
+// mirror MDB_page and MDB_meta in mdb.c. See
+// http://www.lmdb.tech/doc/group__internal.html
+const (
+	metaMagic    = 0xBEEFC0DE
+	metaVersion  = 1
+	metaPageFlag = 0x08
+	minPageSize  = 256
+	maxPageSize  = 0x10000
+	numMetaPages = 2
+)
+
+var (
+	wordSize = int(unsafe.Sizeof(C.size_t(0)))
+	// offsets within a meta page
+	pageFlagsOffset   = wordSize + 2
+	metaOffset        = wordSize + 8
+	magicOffset       = metaOffset
+	versionOffset     = metaOffset + 4
+	mapSizeOffset     = metaOffset + 8 + wordSize
+	dbsOffset         = metaOffset + 8 + 2*wordSize
+	dbSize            = 8 + 5*wordSize
+	pageSizeOffset    = dbsOffset // mm_psize is the md_pad of the free DB
+	mainEntriesOffset = dbsOffset + dbSize + 8 + 3*wordSize
+	lastPageOffset    = dbsOffset + 2*dbSize
+	txnIDOffset       = lastPageOffset + wordSize
+	metaHeaderSize    = txnIDOffset + wordSize
+)
+
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// BackupInfo describes an LMDB data file, as checked by VerifyBackup
+// and Restore.
+type BackupInfo struct {
+	PageSize       uint64
+	MapSize        uint64
+	LastTxnID      uint64
+	LastPageNumber uint64
+	// The number of key-value pairs in each named database. This is
+	// only populated if a full integrity walk was requested.
+	Databases map[string]uint64
+}
+
+type metaPage struct {
+	pageSize    uint64
+	mapSize     uint64
+	mainEntries uint64
+	lastPage    uint64
+	txnID       uint64
+}
+
+// VerifyBackup checks that the LMDB data file at src is intact. src
+// can either be a path to a data file, or a directory containing a
+// data.mdb file, which is what Copy produces unless the database
+// was opened with NoSubDir.
+//
+// Both meta pages are checked for the LMDB magic number, data format
+// version, and a sensible page size. The file must be large enough to
+// contain every page referenced by the most recent meta page, and
+// LMDB itself must agree with the page size and last transaction id
+// found in the meta pages when it opens the file.
+//
+// If walk is true then, in addition, every key-value pair of the
+// unnamed database and of every named database is read, and the
+// number of pairs found is checked against the counts LMDB records
+// for each database. This touches every page in use, so for large
+// files it will take a while.
+//
+// The file is opened read-only and without a lock file, so it must
+// not be in use by any other process.
+func VerifyBackup(src string, walk bool) (*BackupInfo, error) {
+	path, err := dataFilePath(src)
+	if err != nil {
+		return nil, err
+	}
+	return verifyDataFile(path, walk)
+}
+
+// Restore installs a backup, as produced by Copy, at dstPath, so that
+// dstPath can then be opened with NewLMDB (or NewManagedLMDB) using
+// the same flags.
+//
+// src is as for VerifyBackup. If flags contains NoSubDir then dstPath
+// is the path of the data file to create. Otherwise, dstPath is a
+// directory (which will be created if necessary) and the data file
+// within it is data.mdb. No other flags are consulted.
+//
+// The backup is first copied into a temporary file alongside the
+// destination, and synced. That copy is then verified, exactly as
+// VerifyBackup would (including the full integrity walk if walk is
+// true). Only if the verification succeeds is the copy renamed over
+// the destination data file, so at all times the destination either
+// holds its previous contents or the complete, verified backup.
+//
+// The destination must not be open, either by this process or any
+// other, when Restore is called. LMDB re-initialises its lock file
+// when the first process opens the environment, so an existing lock
+// file at the destination is left alone.
+func Restore(src, dstPath string, flags EnvironmentFlag, walk bool) (*BackupInfo, error) {
+	srcPath, err := dataFilePath(src)
+	if err != nil {
+		return nil, err
+	}
+
+	dstDir, dstFile := dstPath, filepath.Join(dstPath, dataFileName)
+	if flags&NoSubDir != 0 {
+		dstDir, dstFile = filepath.Dir(dstPath), dstPath
+	} else if err := os.MkdirAll(dstDir, 0777); err != nil {
+		return nil, err
+	}
+
+	tmpPath, err := copyFileSynced(srcPath, dstDir)
+	if err != nil {
+		return nil, err
+	}
+	installed := false
+	defer func() {
+		if !installed {
+			os.Remove(tmpPath)
+		}
+	}()
+
+	info, err := verifyDataFile(tmpPath, walk)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(tmpPath, dstFile); err != nil {
+		return nil, err
+	}
+	installed = true
+	return info, syncDir(dstDir)
+}
+
+func dataFilePath(path string) (string, error) {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if fileInfo.IsDir() {
+		return filepath.Join(path, dataFileName), nil
+	}
+	return path, nil
+}
+
+func verifyDataFile(path string, walk bool) (*BackupInfo, error) {
+	meta, err := readMetaPages(path)
+	if err != nil {
+		return nil, err
+	}
+
+	environment, err := newEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	// every named database is a key in the unnamed database, so this
+	// is enough to be able to open all of them.
+	if err := environment.setMaxNumberOfDBs(uint(meta.mainEntries)); err != nil {
+		environment.close()
+		return nil, err
+	}
+	if err := environment.open(path, ReadOnly|NoSubDir|NoLock|NoTLS, 0); err != nil {
+		environment.close()
+		return nil, fmt.Errorf("%s: LMDB cannot open file: %w", path, err)
+	}
+	defer environment.close()
+
+	envInfo, err := environment.info()
+	if err != nil {
+		return nil, err
+	}
+	if envInfo.lastTxnID != meta.txnID {
+		return nil, fmt.Errorf("%s: meta page records last txn id %d but LMDB reports %d: %w", path, meta.txnID, envInfo.lastTxnID, Corrupted)
+	}
+	pageSize, err := environment.filePageSize()
+	if err != nil {
+		return nil, err
+	}
+	if pageSize != meta.pageSize {
+		return nil, fmt.Errorf("%s: meta page records page size %d but LMDB reports %d: %w", path, meta.pageSize, pageSize, Corrupted)
+	}
+
+	info := &BackupInfo{
+		PageSize:       meta.pageSize,
+		MapSize:        envInfo.mapSize,
+		LastTxnID:      meta.txnID,
+		LastPageNumber: meta.lastPage,
+	}
+	if walk {
+		info.Databases, err = environment.walk()
+		if err != nil {
+			return nil, fmt.Errorf("%s: integrity walk failed: %w", path, err)
+		}
+	}
+	return info, nil
+}
+
+// Reads and checks both meta pages, returning the more recent one
+// (i.e. the one LMDB would use).
+func readMetaPages(path string) (*metaPage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// The page size is in the first meta page, and the second meta
+	// page starts at that page size.
+	header := make([]byte, metaHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("%s: cannot read meta page 0: %w", path, err)
+	}
+	pageSize := uint64(nativeEndian.Uint32(header[pageSizeOffset:]))
+	if pageSize < minPageSize || pageSize > maxPageSize || pageSize&(pageSize-1) != 0 {
+		return nil, fmt.Errorf("%s: meta page 0 has invalid page size %d: %w", path, pageSize, Invalid)
+	}
+
+	var current *metaPage
+	for pageNum := uint64(0); pageNum < numMetaPages; pageNum++ {
+		if _, err := file.ReadAt(header, int64(pageNum*pageSize)); err != nil {
+			return nil, fmt.Errorf("%s: cannot read meta page %d: %w", path, pageNum, err)
+		}
+		meta, err := parseMetaPage(header, pageNum)
+		if err != nil {
+			return nil, fmt.Errorf("%s: meta page %d: %w", path, pageNum, err)
+		}
+		if meta.pageSize != pageSize {
+			return nil, fmt.Errorf("%s: meta pages disagree on page size (%d vs %d): %w", path, pageSize, meta.pageSize, Corrupted)
+		}
+		if current == nil || meta.txnID > current.txnID {
+			current = meta
+		}
+	}
+
+	if required := (current.lastPage + 1) * pageSize; uint64(fileInfo.Size()) < required {
+		return nil, fmt.Errorf("%s: file is %d bytes but its last page ends at %d bytes; it is truncated: %w", path, fileInfo.Size(), required, Corrupted)
+	}
+	return current, nil
+}
+
+func parseMetaPage(header []byte, pageNum uint64) (*metaPage, error) {
+	if pgno := readWord(header[0:]); pgno != pageNum {
+		return nil, fmt.Errorf("page number is %d: %w", pgno, Invalid)
+	}
+	if flags := nativeEndian.Uint16(header[pageFlagsOffset:]); flags&metaPageFlag == 0 {
+		return nil, fmt.Errorf("page is not a meta page (flags 0x%x): %w", flags, Invalid)
+	}
+	if magic := nativeEndian.Uint32(header[magicOffset:]); magic != metaMagic {
+		return nil, fmt.Errorf("bad magic number 0x%x: %w", magic, Invalid)
+	}
+	if version := nativeEndian.Uint32(header[versionOffset:]); version != metaVersion {
+		return nil, fmt.Errorf("data format version %d: %w", version, VersionMismatch)
+	}
+	return &metaPage{
+		pageSize:    uint64(nativeEndian.Uint32(header[pageSizeOffset:])),
+		mapSize:     readWord(header[mapSizeOffset:]),
+		mainEntries: readWord(header[mainEntriesOffset:]),
+		lastPage:    readWord(header[lastPageOffset:]),
+		txnID:       readWord(header[txnIDOffset:]),
+	}, nil
+}
+
+func readWord(b []byte) uint64 {
+	if wordSize == 8 {
+		return nativeEndian.Uint64(b)
+	}
+	return uint64(nativeEndian.Uint32(b))
+}
+
+// Reads every key-value pair in the unnamed database and every named
+// database, checking the number found matches LMDB's own count.
+func (self *environment) walk() (map[string]uint64, error) {
+	txn, err := self.txnBegin(true, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer C.mdb_txn_abort(txn)
+
+	resizeRequired := uint32(0)
+	readOnlyTxn := &ReadOnlyTxn{
+		txn:            txn,
+		resizeRequired: &resizeRequired,
+		names:          self.dbNames,
+	}
+
+	var mainDB C.MDB_dbi
+	if err := asError(C.mdb_dbi_open(txn, nil, 0, &mainDB)); err != nil {
+		return nil, err
+	}
+	var names []string
+	_, err = readOnlyTxn.walkDB(DBRef(mainDB), func(key []byte) {
+		// names are C strings, so keys containing NUL are not names.
+		if len(key) > 0 && bytes.IndexByte(key, 0) == -1 {
+			names = append(names, string(key))
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unnamed database: %w", err)
+	}
+
+	databases := make(map[string]uint64, len(names))
+	for _, name := range names {
+		dbRef, err := readOnlyTxn.DBRef(name, 0)
+		if errors.Is(err, Incompatible) {
+			continue // a plain key in the unnamed database
+		} else if err != nil {
+			return nil, fmt.Errorf("database %q: %w", name, err)
+		}
+		count, err := readOnlyTxn.walkDB(dbRef, nil)
+		if err != nil {
+			return nil, fmt.Errorf("database %q: %w", name, err)
+		}
+		databases[name] = count
+	}
+	return databases, nil
+}
+
+func (self *ReadOnlyTxn) walkDB(db DBRef, fun func(key []byte)) (uint64, error) {
+	var cStat C.MDB_stat
+	if err := asError(C.mdb_stat(self.txn, C.MDB_dbi(db), &cStat)); err != nil {
+		return 0, err
+	}
+
+	cursor, err := self.newCursor(db)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close()
+
+	count := uint64(0)
+	key, _, err := cursor.First()
+	for ; err == nil; key, _, err = cursor.Next() {
+		count++
+		if fun != nil {
+			fun(key)
+		}
+	}
+	if !errors.Is(err, NotFound) {
+		return count, err
+	}
+	if expected := uint64(cStat.ms_entries); count != expected {
+		return count, fmt.Errorf("found %d entries but expected %d: %w", count, expected, Corrupted)
+	}
+	return count, nil
+}
+
+// Copies src into a new temporary file within dir, and syncs it to
+// disk. Returns the path of the temporary file.
+func copyFileSynced(src, dir string) (string, error) {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer srcFile.Close()
+
+	srcInfo, err := srcFile.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	tmpFile, err := os.CreateTemp(dir, ".golmdb-restore-*")
+	if err != nil {
+		return "", err
+	}
+	tmpPath := tmpFile.Name()
+
+	_, err = io.Copy(tmpFile, srcFile)
+	if err == nil {
+		err = tmpFile.Chmod(srcInfo.Mode().Perm())
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	return tmpPath, nil
+}
+
+// Syncs the directory itself, so that a rename within it is durable.
+func syncDir(dir string) error {
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = dirFile.Sync()
+	if closeErr := dirFile.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func syncFile(path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
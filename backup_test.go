@@ -0,0 +1,139 @@
+package golmdb_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matryer/is"
+
+	"wellquite.org/golmdb"
+)
+
+func TestRestore(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	defer client.TerminateSync()
+
+	dbRef, err := createDBRef(client, t.Name(), 0)
+	is.NoErr(err)
+
+	key := make([]byte, 8)
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) (err error) {
+		for idx := 0; idx < 64; idx++ {
+			binary.BigEndian.PutUint64(key, uint64(idx))
+			if err = txn.Put(dbRef, key, key, 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	is.NoErr(err)
+
+	backupDir, err := os.MkdirTemp("", "golmdb")
+	is.NoErr(err)
+	defer os.RemoveAll(backupDir)
+	is.NoErr(client.Copy(backupDir, true))
+
+	info, err := golmdb.VerifyBackup(backupDir, true)
+	is.NoErr(err)
+	is.True(info.PageSize > 0)
+	is.True(info.LastTxnID > 0)
+	is.Equal(info.Databases[t.Name()], uint64(64))
+
+	// restore into a fresh directory layout
+	restoreRoot, err := os.MkdirTemp("", "golmdb")
+	is.NoErr(err)
+	defer os.RemoveAll(restoreRoot)
+	restoreDir := filepath.Join(restoreRoot, "restored")
+	_, err = golmdb.Restore(backupDir, restoreDir, 0, true)
+	is.NoErr(err)
+
+	// and into a NoSubDir layout
+	restoreFile := filepath.Join(restoreRoot, "restored.mdb")
+	_, err = golmdb.Restore(backupDir, restoreFile, golmdb.NoSubDir, false)
+	is.NoErr(err)
+
+	for _, restored := range []struct {
+		path  string
+		flags golmdb.EnvironmentFlag
+	}{{restoreDir, 0}, {restoreFile, golmdb.NoSubDir}} {
+		client2, err := golmdb.NewLMDB(log, restored.path, 0666, 16, 4, golmdb.ReadOnly|restored.flags, 16)
+		is.NoErr(err)
+		err = client2.View(func(txn *golmdb.ReadOnlyTxn) error {
+			dbRef, err := txn.DBRef(t.Name(), 0)
+			if err != nil {
+				return err
+			}
+			for idx := 0; idx < 64; idx++ {
+				binary.BigEndian.PutUint64(key, uint64(idx))
+				val, err := txn.Get(dbRef, key)
+				if err != nil {
+					return err
+				} else if !bytes.Equal(key, val) {
+					return fmt.Errorf("For key %d, key and value are not equal but should be", idx)
+				}
+			}
+			return nil
+		})
+		client2.TerminateSync()
+		is.NoErr(err)
+	}
+}
+
+func TestRestoreRejectsDamagedBackup(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	defer client.TerminateSync()
+
+	_, err = createDBRef(client, t.Name(), 0)
+	is.NoErr(err)
+
+	backupDir, err := os.MkdirTemp("", "golmdb")
+	is.NoErr(err)
+	defer os.RemoveAll(backupDir)
+	is.NoErr(client.Copy(backupDir, false))
+
+	backupFile := filepath.Join(backupDir, "data.mdb")
+	data, err := os.ReadFile(backupFile)
+	is.NoErr(err)
+
+	restoreRoot, err := os.MkdirTemp("", "golmdb")
+	is.NoErr(err)
+	defer os.RemoveAll(restoreRoot)
+	restoreFile := filepath.Join(restoreRoot, "restored.mdb")
+
+	// truncated
+	is.NoErr(os.WriteFile(backupFile, data[:len(data)/2], 0666))
+	_, err = golmdb.Restore(backupDir, restoreFile, golmdb.NoSubDir, false)
+	is.True(err != nil)
+
+	// scribble over the header of the first meta page
+	damaged := append([]byte(nil), data...)
+	for idx := range damaged[:32] {
+		damaged[idx] = 0xff
+	}
+	is.NoErr(os.WriteFile(backupFile, damaged, 0666))
+	_, err = golmdb.VerifyBackup(backupDir, false)
+	is.True(err != nil)
+	_, err = golmdb.Restore(backupDir, restoreFile, golmdb.NoSubDir, false)
+	is.True(err != nil)
+
+	// nothing should have been installed, and no temporary files left behind
+	entries, err := os.ReadDir(restoreRoot)
+	is.NoErr(err)
+	is.Equal(len(entries), 0)
+}
@@ -0,0 +1,93 @@
+package golmdb
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrClosed is returned by View, Update and friends once Close has
+// been called.
+var ErrClosed = errors.New("golmdb client is closed")
+
+// Tracks the Views, Updates, and Copies that are in flight, so that
+// Close can wait for them. Once closing, no more can start.
+type inFlight struct {
+	lock    sync.RWMutex
+	closing bool
+	wg      sync.WaitGroup
+	// Guards closing the environment (and terminating the actor), so
+	// that it is only done once.
+	closeOnce sync.Once
+}
+
+func (self *inFlight) enter() error {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	if self.closing {
+		return ErrClosed
+	}
+	// Add can't race with Wait: Wait is only called once closing is
+	// set, which needs the write lock.
+	self.wg.Add(1)
+	return nil
+}
+
+func (self *inFlight) exit() {
+	self.wg.Done()
+}
+
+// Stop anything new from starting, and wait for whatever is in flight
+// to finish, or the ctx to be done.
+func (self *inFlight) drain(ctx context.Context) error {
+	self.lock.Lock()
+	self.closing = true
+	self.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		self.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close shuts down the client gracefully:
+//
+//  1. New Views, Updates, Copies, Syncs and Compacts are refused with
+//     ErrClosed.
+//  2. Close waits for those already in flight to finish. This includes
+//     Updates queued up with the actor, which will all be run.
+//  3. If the database was opened with NoSync, NoMetaSync or MapAsync,
+//     it is Synced, so that nothing committed is lost.
+//  4. The actor is terminated and the database closed.
+//
+// If the ctx is done before everything in flight has finished, Close
+// returns the ctx's error, and the database is left open (closing it
+// under a running View would not be safe). New work is still refused;
+// you may call Close again to carry on waiting.
+//
+// Unlike TerminateSync, Close is safe to call whilst other go-routines
+// are still using the client. Calling Close or TerminateSync once
+// Close has succeeded does nothing.
+func (self *LMDBClient) Close(ctx context.Context) error {
+	self.sweeper.stop()
+	if err := self.inFlight.drain(ctx); err != nil {
+		return err
+	}
+
+	var err error
+	self.inFlight.closeOnce.Do(func() {
+		if !self.environment.readOnly && self.environment.flags&(NoSync|NoMetaSync|MapAsync) != 0 {
+			// even if this fails, there's nothing better to do than close.
+			err = self.environment.sync(true)
+		}
+		self.terminate()
+	})
+	return err
+}
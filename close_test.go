@@ -0,0 +1,104 @@
+package golmdb_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"wellquite.org/golmdb"
+)
+
+func TestClose(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	dir, err := os.MkdirTemp("", "golmdb")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	client, err := golmdb.Open(dir, golmdb.Options{Log: log, NumDBs: 4, Flags: golmdb.NoSync})
+	is.NoErr(err)
+	defer client.TerminateSync() // safe even after Close
+
+	dbRef, err := createDBRef(client, t.Name(), 0)
+	is.NoErr(err)
+
+	// a View that won't finish until we say so.
+	viewStarted := make(chan struct{})
+	releaseView := make(chan struct{})
+	viewErr := make(chan error, 1)
+	go func() {
+		viewErr <- client.View(func(txn *golmdb.ReadOnlyTxn) error {
+			close(viewStarted)
+			<-releaseView
+			return nil
+		})
+	}()
+	<-viewStarted
+
+	// lots of Updates racing with Close.
+	var wg sync.WaitGroup
+	committed := make([]bool, 64)
+	for idx := range committed {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			key := make([]byte, 8)
+			binary.BigEndian.PutUint64(key, uint64(idx))
+			err := client.Update(func(txn *golmdb.ReadWriteTxn) error {
+				return txn.Put(dbRef, key, key, 0)
+			})
+			if err == nil {
+				committed[idx] = true
+			} else {
+				is.True(errors.Is(err, golmdb.ErrClosed))
+			}
+		}(idx)
+	}
+
+	// the View is still running, so Close cannot finish.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	is.True(errors.Is(client.Close(ctx), context.DeadlineExceeded))
+
+	// but no new work is accepted.
+	is.Equal(client.View(func(txn *golmdb.ReadOnlyTxn) error { return nil }), golmdb.ErrClosed)
+	is.Equal(client.Update(func(txn *golmdb.ReadWriteTxn) error { return nil }), golmdb.ErrClosed)
+
+	close(releaseView)
+	is.NoErr(<-viewErr)
+	is.NoErr(client.Close(context.Background()))
+	is.NoErr(client.Close(context.Background()))
+	wg.Wait()
+
+	// every Update that returned nil must have been committed (and
+	// synced, despite NoSync).
+	client, err = golmdb.Open(dir, golmdb.Options{Log: log, NumDBs: 4, Flags: golmdb.ReadOnly})
+	is.NoErr(err)
+	defer client.TerminateSync()
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		dbRef, err := txn.DBRef(t.Name(), 0)
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		for idx, wasCommitted := range committed {
+			binary.BigEndian.PutUint64(key, uint64(idx))
+			_, err := txn.Get(dbRef, key)
+			if wasCommitted {
+				is.NoErr(err)
+			} else {
+				is.True(errors.Is(err, golmdb.NotFound))
+			}
+		}
+		return nil
+	})
+	is.NoErr(err)
+}
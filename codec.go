@@ -0,0 +1,138 @@
+package golmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+// A Codec converts values of type T to and from bytes, so that they
+// can be used as the keys or values of a Table.
+//
+// For keys, bear in mind that LMDB orders keys by comparing their
+// bytes (unless the database was created with ReverseKey or
+// IntegerKey). So if the order of keys matters, pick a codec whose
+// encoding preserves it, for example Uint64Codec or the tuple
+// package.
+type Codec[T any] interface {
+	// Encode v, appending to buf (which may be nil), and return the
+	// result. Implementations may return a slice that aliases v itself
+	// when buf is empty, avoiding a copy.
+	Encode(buf []byte, v T) ([]byte, error)
+	// Decode data into a T. data is owned by LMDB, and is valid only
+	// until the end of the transaction (or the next update). An
+	// implementation that retains data in its result (as RawCodec
+	// does) makes the result valid for that long only too.
+	Decode(data []byte) (T, error)
+}
+
+// RawCodec passes []byte through unchanged, in both directions, with
+// no copying. Decoded values point directly into LMDB's memory map: do
+// not modify them, and do not use them after the end of the
+// transaction.
+type RawCodec struct{}
+
+var _ Codec[[]byte] = RawCodec{}
+
+func (RawCodec) Encode(buf []byte, v []byte) ([]byte, error) {
+	if len(buf) == 0 {
+		return v, nil
+	}
+	return append(buf, v...), nil
+}
+
+func (RawCodec) Decode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+// StringCodec encodes strings as their bytes. Decoding copies.
+type StringCodec struct{}
+
+var _ Codec[string] = StringCodec{}
+
+func (StringCodec) Encode(buf []byte, v string) ([]byte, error) {
+	return append(buf, v...), nil
+}
+
+func (StringCodec) Decode(data []byte) (string, error) {
+	return string(data), nil
+}
+
+// Uint64Codec encodes uint64s as 8 bytes, big-endian, so that the
+// byte order of keys matches their numeric order.
+type Uint64Codec struct{}
+
+var _ Codec[uint64] = Uint64Codec{}
+
+func (Uint64Codec) Encode(buf []byte, v uint64) ([]byte, error) {
+	return binary.BigEndian.AppendUint64(buf, v), nil
+}
+
+func (Uint64Codec) Decode(data []byte) (uint64, error) {
+	if len(data) != 8 {
+		return 0, fmt.Errorf("Uint64Codec: cannot decode %d bytes", len(data))
+	}
+	return binary.BigEndian.Uint64(data), nil
+}
+
+// BinaryCodec encodes fixed-size values (numbers, and arrays and
+// structs of them) with encoding/binary, big-endian. For unsigned
+// integers, the byte order matches the numeric order; for signed
+// integers and floats it does not (see the tuple package for an
+// encoding which does).
+type BinaryCodec[T any] struct{}
+
+func (BinaryCodec[T]) Encode(buf []byte, v T) ([]byte, error) {
+	buffer := bytes.NewBuffer(buf)
+	if err := binary.Write(buffer, binary.BigEndian, v); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (BinaryCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	err := binary.Read(bytes.NewReader(data), binary.BigEndian, &v)
+	return v, err
+}
+
+// JSONCodec encodes values with encoding/json.
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Encode(buf []byte, v T) ([]byte, error) {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) == 0 {
+		return encoded, nil
+	}
+	return append(buf, encoded...), nil
+}
+
+func (JSONCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+// GobCodec encodes values with encoding/gob. Each value is encoded
+// standalone, so this carries gob's type information with every value:
+// it is convenient, but not compact.
+type GobCodec[T any] struct{}
+
+func (GobCodec[T]) Encode(buf []byte, v T) ([]byte, error) {
+	buffer := bytes.NewBuffer(buf)
+	if err := gob.NewEncoder(buffer).Encode(v); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (GobCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v)
+	return v, err
+}
@@ -0,0 +1,177 @@
+package golmdb_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/matryer/is"
+
+	"wellquite.org/golmdb"
+)
+
+func TestCompact(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	defer client.TerminateSync()
+
+	dbRef1, err := createDBRef(client, t.Name()+"1", 0)
+	is.NoErr(err)
+	dbRef2, err := createDBRef(client, t.Name()+"2", golmdb.DupSort)
+	is.NoErr(err)
+
+	// fill up with 32MB, and then delete all but every 16th key.
+	key := make([]byte, 8)
+	val := make([]byte, 64*1024)
+	for idx := 0; idx < 512; idx++ {
+		binary.BigEndian.PutUint64(key, uint64(idx))
+		err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+			if err := txn.Put(dbRef1, key, val, 0); err != nil {
+				return err
+			}
+			return txn.Put(dbRef2, key[:1], key, 0)
+		})
+		is.NoErr(err)
+	}
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		for idx := 0; idx < 512; idx++ {
+			if idx%16 == 0 {
+				continue
+			}
+			binary.BigEndian.PutUint64(key, uint64(idx))
+			if err := txn.Delete(dbRef1, key, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	is.NoErr(err)
+
+	dataFile := filepath.Join(dir, "data.mdb")
+	before, err := os.Stat(dataFile)
+	is.NoErr(err)
+
+	// keep some Views running throughout the compaction.
+	stop := uint32(0)
+	viewsWG := new(sync.WaitGroup)
+	viewErrs := make(chan error, 4)
+	for idx := 0; idx < 4; idx++ {
+		viewsWG.Add(1)
+		go func() {
+			defer viewsWG.Done()
+			key := make([]byte, 8)
+			for atomic.LoadUint32(&stop) == 0 {
+				err := client.View(func(txn *golmdb.ReadOnlyTxn) error {
+					binary.BigEndian.PutUint64(key, 16)
+					_, err := txn.Get(dbRef1, key)
+					return err
+				})
+				if err != nil {
+					viewErrs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	err = client.Compact()
+	atomic.StoreUint32(&stop, 1)
+	viewsWG.Wait()
+	close(viewErrs)
+	is.NoErr(err)
+	for err := range viewErrs {
+		is.NoErr(err)
+	}
+
+	after, err := os.Stat(dataFile)
+	is.NoErr(err)
+	is.True(after.Size() < before.Size())
+
+	// the DBRefs from before the compaction should still work, for
+	// both Views and Updates.
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		for idx := 0; idx < 512; idx++ {
+			binary.BigEndian.PutUint64(key, uint64(idx))
+			val, err := txn.Get(dbRef1, key)
+			if idx%16 == 0 {
+				if err != nil {
+					return err
+				} else if len(val) != 64*1024 {
+					return fmt.Errorf("For key %d, got value of length %d", idx, len(val))
+				}
+			} else if !errors.Is(err, golmdb.NotFound) {
+				return fmt.Errorf("For key %d, expected NotFound, but got %v error", idx, err)
+			}
+		}
+		cursor, err := txn.NewCursor(dbRef2)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close()
+		if _, _, err = cursor.First(); err != nil {
+			return err
+		}
+		count, err := cursor.Count()
+		if err != nil {
+			return err
+		} else if count != 512 {
+			return fmt.Errorf("Expected 512 values in the DupSort database; got %d", count)
+		}
+		return nil
+	})
+	is.NoErr(err)
+
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		binary.BigEndian.PutUint64(key, 1)
+		return txn.Put(dbRef1, key, key, golmdb.NoOverwrite)
+	})
+	is.NoErr(err)
+}
+
+func TestCompactNoSubDir(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	dir, err := os.MkdirTemp("", "golmdb")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "data")
+	client, err := golmdb.NewLMDB(log, path, 0666, 16, 4, golmdb.NoSubDir, 16)
+	is.NoErr(err)
+	defer client.TerminateSync()
+
+	dbRef, err := createDBRef(client, t.Name(), 0)
+	is.NoErr(err)
+	key := []byte("hello")
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		return txn.Put(dbRef, key, key, 0)
+	})
+	is.NoErr(err)
+
+	is.NoErr(client.Compact())
+
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		_, err := txn.Get(dbRef, key)
+		return err
+	})
+	is.NoErr(err)
+
+	// the copy should not be left behind
+	entries, err := os.ReadDir(dir)
+	is.NoErr(err)
+	for _, entry := range entries {
+		is.True(entry.Name() == "data" || entry.Name() == "data-lock")
+	}
+}
@@ -0,0 +1,319 @@
+package golmdb
+
+/*
+#include <lmdb.h>
+*/
+import "C"
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// A Compressor compresses the values of a database (see
+// LMDBClient.EnableCompression). It must be safe for concurrent use:
+// values are compressed by the writer, and decompressed by every
+// View.
+type Compressor interface {
+	// Compress appends the compressed form of src to dst, and returns
+	// the result.
+	Compress(dst, src []byte) ([]byte, error)
+	// Decompress appends the decompressed form of src to dst, and
+	// returns the result. src is owned by the database, so must not
+	// be modified or retained.
+	Decompress(dst, src []byte) ([]byte, error)
+}
+
+// FlateCompressor is a Compressor using compress/flate.
+type FlateCompressor struct {
+	level   int
+	writers sync.Pool
+	readers sync.Pool
+}
+
+var _ Compressor = (*FlateCompressor)(nil)
+
+// NewFlateCompressor creates a FlateCompressor which compresses at the
+// given level, as for flate.NewWriter: for example
+// flate.DefaultCompression or flate.BestSpeed.
+func NewFlateCompressor(level int) (*FlateCompressor, error) {
+	if _, err := flate.NewWriter(io.Discard, level); err != nil {
+		return nil, fmt.Errorf("Cannot create FlateCompressor: %w", err)
+	}
+	return &FlateCompressor{level: level}, nil
+}
+
+func (self *FlateCompressor) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	writer, ok := self.writers.Get().(*flate.Writer)
+	if ok {
+		writer.Reset(buf)
+	} else {
+		var err error
+		if writer, err = flate.NewWriter(buf, self.level); err != nil {
+			return nil, err
+		}
+	}
+	defer self.writers.Put(writer)
+	if _, err := writer.Write(src); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (self *FlateCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	reader, ok := self.readers.Get().(io.ReadCloser)
+	if ok {
+		if err := reader.(flate.Resetter).Reset(bytes.NewReader(src), nil); err != nil {
+			return nil, err
+		}
+	} else {
+		reader = flate.NewReader(bytes.NewReader(src))
+	}
+	defer self.readers.Put(reader)
+	buf := bytes.NewBuffer(dst)
+	if _, err := io.Copy(buf, reader); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DefaultCompressionThreshold is used by EnableCompression if the
+// threshold is 0.
+const DefaultCompressionThreshold = 512
+
+// Each value of a database with compression enabled is stored with a
+// header byte, saying whether or not the rest is compressed.
+const (
+	valueUncompressed byte = 0
+	valueCompressed   byte = 1
+)
+
+// Once compression has been enabled for a database, a sequence (see
+// NextSequence) with this prefix and the database name is set to 1,
+// to record that its values all have headers.
+const compressionMarkerPrefix = "golmdb.compression."
+
+// EnableCompression compresses the values of the database with the
+// compressor. Each Put of a value of at least threshold bytes (or
+// DefaultCompressionThreshold, if threshold is 0) compresses it,
+// unless compression would not make it smaller. Get, cursors, indexes
+// and so on all see the decompressed values.
+//
+// Each value is stored with a header byte saying whether or not it
+// is compressed, so a database can contain both, and the threshold
+// can be changed freely. But the compressor must not be changed once
+// values have been compressed with it, and the database must be empty
+// when compression is first enabled for it (which is recorded in the
+// sequence "golmdb.compression.<name>"). Values which are stored
+// uncompressed are still returned by Get without a copy; decompressed
+// values are necessarily copies.
+//
+// The database must be a named database, and must not be DupSort.
+// Compression can be combined with versioning (see EnableVersioning).
+//
+// Like DeclareIndex, this is not persistent: each program must enable
+// compression every time it opens the database, before it reads or
+// writes the database, including programs which open the database
+// ReadOnly (for them, db may come from a View). See CompressionStats
+// for how well it is doing.
+func (self *LMDBClient) EnableCompression(db DBRef, compressor Compressor, threshold int) error {
+	if compressor == nil {
+		return errors.New("Cannot enable compression: compressor must not be nil")
+	}
+	if threshold < 0 {
+		return fmt.Errorf("Cannot enable compression: threshold must not be negative (%d)", threshold)
+	} else if threshold == 0 {
+		threshold = DefaultCompressionThreshold
+	}
+	var err error
+	if self.environment.readOnly {
+		err = self.View(func(txn *ReadOnlyTxn) error {
+			_, _, err := txn.checkCompressible(db)
+			return err
+		})
+	} else {
+		err = self.Update(func(txn *ReadWriteTxn) error {
+			name, marked, err := txn.checkCompressible(db)
+			if err == nil && !marked {
+				_, err = txn.NextSequence(compressionMarkerPrefix + name)
+			}
+			return err
+		})
+	}
+	if err != nil {
+		return err
+	}
+	self.environment.compression.enable(db, &dbCompression{compressor: compressor, threshold: threshold})
+	return nil
+}
+
+func (self *ReadOnlyTxn) checkCompressible(db DBRef) (name string, marked bool, err error) {
+	if name, err = self.reopen(db); err != nil {
+		return "", false, fmt.Errorf("Cannot enable compression: %w", err)
+	}
+	var flags C.uint
+	if err := asError(C.mdb_dbi_flags(self.txn, C.MDB_dbi(db), &flags)); err != nil {
+		return "", false, self.opError("EnableCompression", db, nil, err)
+	}
+	if strings.HasPrefix(name, "golmdb.") {
+		return "", false, fmt.Errorf("Cannot enable compression for database %q: it is reserved", name)
+	}
+	if DatabaseFlag(flags)&DupSort != 0 {
+		return "", false, fmt.Errorf("Cannot enable compression for database %q: it is DupSort", name)
+	}
+	// values written before compression was first enabled have no
+	// headers.
+	marker, err := self.Sequence(compressionMarkerPrefix + name)
+	if err != nil {
+		return "", false, err
+	}
+	if marker == 0 {
+		if empty, err := self.isEmpty(db); err != nil {
+			return "", false, self.opError("EnableCompression", db, nil, err)
+		} else if !empty {
+			return "", false, fmt.Errorf("Cannot enable compression for database %q: it is not empty", name)
+		}
+	}
+	return name, marker != 0, nil
+}
+
+// CompressionStats counts the values put into a database with
+// compression enabled, since compression was enabled. Puts in txns
+// which then abort are counted too.
+type CompressionStats struct {
+	// The number of values put.
+	Values uint64
+	// How many of those were compressed.
+	CompressedValues uint64
+	// The total size of the values put.
+	Bytes uint64
+	// The total size of the values as stored, including headers.
+	StoredBytes uint64
+}
+
+// Ratio is StoredBytes / Bytes: the smaller, the better. It is 1 if
+// no bytes have been put.
+func (self CompressionStats) Ratio() float64 {
+	if self.Bytes == 0 {
+		return 1
+	}
+	return float64(self.StoredBytes) / float64(self.Bytes)
+}
+
+// CompressionStats returns the CompressionStats of the database, and
+// false if compression is not enabled for it.
+func (self *LMDBClient) CompressionStats(db DBRef) (CompressionStats, bool) {
+	compression := self.environment.compression.get(db)
+	if compression == nil {
+		return CompressionStats{}, false
+	}
+	return CompressionStats{
+		Values:           atomic.LoadUint64(&compression.values),
+		CompressedValues: atomic.LoadUint64(&compression.compressedValues),
+		Bytes:            atomic.LoadUint64(&compression.bytes),
+		StoredBytes:      atomic.LoadUint64(&compression.storedBytes),
+	}, true
+}
+
+type dbCompression struct {
+	// 64-bit atomics first for alignment on 32-bit platforms.
+	values           uint64
+	compressedValues uint64
+	bytes            uint64
+	storedBytes      uint64
+	compressor       Compressor
+	threshold        int
+}
+
+// Returns val, with its header byte, and compressed if worthwhile.
+func (self *dbCompression) compress(val []byte) ([]byte, error) {
+	var stored []byte
+	if len(val) >= self.threshold {
+		compressed, err := self.compressor.Compress([]byte{valueCompressed}, val)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed) < 1+len(val) {
+			stored = compressed
+			atomic.AddUint64(&self.compressedValues, 1)
+		}
+	}
+	if stored == nil {
+		stored = make([]byte, 1, 1+len(val))
+		stored[0] = valueUncompressed
+		stored = append(stored, val...)
+	}
+	atomic.AddUint64(&self.values, 1)
+	atomic.AddUint64(&self.bytes, uint64(len(val)))
+	atomic.AddUint64(&self.storedBytes, uint64(len(stored)))
+	return stored, nil
+}
+
+// The inverse of compress. An uncompressed value aliases data.
+func (self *dbCompression) decompress(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("Compressed database value has no header: %w", Corrupted)
+	}
+	switch data[0] {
+	case valueUncompressed:
+		return data[1:], nil
+	case valueCompressed:
+		val, err := self.compressor.Decompress(nil, data[1:])
+		if err != nil {
+			return nil, fmt.Errorf("Cannot decompress value: %v: %w", err, Corrupted)
+		}
+		return val, nil
+	default:
+		return nil, fmt.Errorf("Compressed database value has unknown header %d: %w", data[0], Corrupted)
+	}
+}
+
+// The databases for which compression is enabled.
+type compressionRegistry struct {
+	// non-zero once any database is enabled, so that checks are cheap
+	// until then.
+	inUse uint32
+	lock  sync.RWMutex
+	dbs   map[DBRef]*dbCompression
+}
+
+func newCompressionRegistry() *compressionRegistry {
+	return &compressionRegistry{dbs: make(map[DBRef]*dbCompression)}
+}
+
+func (self *compressionRegistry) enable(db DBRef, compression *dbCompression) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.dbs[db] = compression
+	atomic.StoreUint32(&self.inUse, 1)
+}
+
+// Returns nil if compression is not enabled for db.
+func (self *compressionRegistry) get(db DBRef) *dbCompression {
+	if self == nil || atomic.LoadUint32(&self.inUse) == 0 {
+		return nil
+	}
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.dbs[db]
+}
+
+// Once a Drop has committed, the dropped database is no longer
+// compressed.
+func (self *compressionRegistry) dropped(db DBRef) {
+	if self == nil {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.dbs, db)
+}
@@ -0,0 +1,165 @@
+package golmdb_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/matryer/is"
+
+	"wellquite.org/golmdb"
+)
+
+func TestCompression(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	defer client.TerminateSync()
+
+	blobs, err := createDBRef(client, "blobs", 0)
+	is.NoErr(err)
+	compressor, err := golmdb.NewFlateCompressor(flate.BestSpeed)
+	is.NoErr(err)
+	is.NoErr(client.EnableCompression(blobs, compressor, 64))
+	// compression and versioning combine.
+	is.NoErr(client.EnableVersioning(blobs))
+
+	large := bytes.Repeat([]byte(`{"name":"golmdb","tags":["a","b"]}`), 100)
+	small := []byte(`{"name":"small"}`)
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		for idx := 0; idx < 10; idx++ {
+			if err := txn.Put(blobs, []byte(fmt.Sprintf("large%d", idx)), large, 0); err != nil {
+				return err
+			}
+		}
+		return txn.Put(blobs, []byte("small"), small, 0)
+	})
+	is.NoErr(err)
+
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		val, err := txn.Get(blobs, []byte("large3"))
+		is.NoErr(err)
+		is.Equal(val, large)
+		val, version, err := txn.GetVersioned(blobs, []byte("small"))
+		is.NoErr(err)
+		is.Equal(val, small)
+		is.True(version > 0)
+
+		cursor, err := txn.NewCursor(blobs)
+		is.NoErr(err)
+		defer cursor.Close()
+		count := 0
+		key, val, err := cursor.First()
+		for ; err == nil; key, val, err = cursor.Next() {
+			if string(key) == "small" {
+				is.Equal(val, small)
+			} else {
+				is.Equal(val, large)
+			}
+			count++
+		}
+		is.True(errors.Is(err, golmdb.NotFound))
+		is.Equal(count, 11)
+		return nil
+	})
+	is.NoErr(err)
+
+	stats, found := client.CompressionStats(blobs)
+	is.True(found)
+	is.Equal(stats.Values, uint64(11))
+	is.Equal(stats.CompressedValues, uint64(10))
+	is.Equal(stats.Bytes, uint64(10*len(large)+len(small)))
+	is.True(stats.Ratio() < 0.5)
+
+	plain, err := createDBRef(client, "plain", 0)
+	is.NoErr(err)
+	_, found = client.CompressionStats(plain)
+	is.True(!found)
+}
+
+func TestCompressionInvalid(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	defer client.TerminateSync()
+
+	_, err = golmdb.NewFlateCompressor(42)
+	is.True(err != nil)
+
+	compressor, err := golmdb.NewFlateCompressor(flate.DefaultCompression)
+	is.NoErr(err)
+	dupSort, err := createDBRef(client, "dupsort", golmdb.DupSort)
+	is.NoErr(err)
+	is.True(client.EnableCompression(dupSort, compressor, 0) != nil)
+	plain, err := createDBRef(client, "plain", 0)
+	is.NoErr(err)
+	is.True(client.EnableCompression(plain, nil, 0) != nil)
+	is.True(client.EnableCompression(plain, compressor, -1) != nil)
+
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		return txn.Put(plain, []byte("k"), []byte("v"), 0)
+	})
+	is.NoErr(err)
+	// plain already has values without headers.
+	is.True(client.EnableCompression(plain, compressor, 0) != nil)
+	_, found := client.CompressionStats(plain)
+	is.True(!found)
+}
+
+func TestCompressionReadOnly(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	blobs, err := createDBRef(client, "blobs", 0)
+	is.NoErr(err)
+	compressor, err := golmdb.NewFlateCompressor(flate.BestSpeed)
+	is.NoErr(err)
+	is.NoErr(client.EnableCompression(blobs, compressor, 0))
+	large := bytes.Repeat([]byte("golmdb"), 1000)
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		return txn.Put(blobs, []byte("large"), large, 0)
+	})
+	is.NoErr(err)
+	// the database is no longer empty, but compression was enabled
+	// before anything was put.
+	is.NoErr(client.EnableCompression(blobs, compressor, 0))
+	client.TerminateSync()
+
+	client, err = golmdb.Open(dir, golmdb.Options{Log: log, NumDBs: 4, Flags: golmdb.ReadOnly})
+	is.NoErr(err)
+	defer client.TerminateSync()
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) (err error) {
+		blobs, err = txn.DBRef("blobs", 0)
+		return err
+	})
+	is.NoErr(err)
+	is.NoErr(client.EnableCompression(blobs, compressor, 0))
+
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		blobs, err := txn.DBRef("blobs", 0)
+		if err != nil {
+			return err
+		}
+		val, err := txn.Get(blobs, []byte("large"))
+		is.NoErr(err)
+		is.Equal(val, large)
+		return nil
+	})
+	is.NoErr(err)
+}
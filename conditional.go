@@ -0,0 +1,168 @@
+package golmdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// ErrConflict is matched (see errors.Is) by every *ConflictError.
+var ErrConflict = errors.New("Conflict")
+
+// A ConflictError is returned when a Precondition does not hold, for
+// example because the value of a key is not what CompareAndSwap
+// expected. It matches ErrConflict (see errors.Is).
+type ConflictError struct {
+	Op     string
+	DB     string
+	Key    []byte
+	Reason string
+}
+
+func (self *ConflictError) Error() string {
+	return fmt.Sprintf("golmdb: %s on database %q with key %q: conflict: %s", self.Op, self.DB, self.Key, self.Reason)
+}
+
+func (self *ConflictError) Unwrap() error {
+	return ErrConflict
+}
+
+// A Precondition is a condition on the current value of a key,
+// checked with Check, or by the conditional writes CompareAndSwap,
+// PutIfAbsent and DeleteIfEquals.
+//
+// Keys are read with Get, so keys which have expired do not exist
+// (see LMDBClient.EnableExpiry). For DupSort databases, only the
+// first value of a key is considered.
+type Precondition struct {
+	db  DBRef
+	key []byte
+	// returns "" if the precondition holds, otherwise why not.
+	check func(val []byte, found bool) string
+}
+
+// KeyExists requires the key to exist.
+func KeyExists(db DBRef, key []byte) Precondition {
+	return Precondition{db: db, key: key, check: func(val []byte, found bool) string {
+		if !found {
+			return "key does not exist"
+		}
+		return ""
+	}}
+}
+
+// KeyAbsent requires the key not to exist.
+func KeyAbsent(db DBRef, key []byte) Precondition {
+	return Precondition{db: db, key: key, check: func(val []byte, found bool) string {
+		if found {
+			return "key exists"
+		}
+		return ""
+	}}
+}
+
+// ValueEquals requires the key to exist, with the given value.
+func ValueEquals(db DBRef, key, expected []byte) Precondition {
+	return Precondition{db: db, key: key, check: func(val []byte, found bool) string {
+		if !found {
+			return "key does not exist"
+		} else if !bytes.Equal(val, expected) {
+			return "value differs"
+		}
+		return ""
+	}}
+}
+
+// ValueMatches requires the key to exist, with a value for which
+// matches returns true. The value is owned by the database, so
+// matches must not modify or retain it.
+func ValueMatches(db DBRef, key []byte, matches func(val []byte) bool) Precondition {
+	return Precondition{db: db, key: key, check: func(val []byte, found bool) string {
+		if !found {
+			return "key does not exist"
+		} else if !matches(val) {
+			return "value does not match"
+		}
+		return ""
+	}}
+}
+
+// Check the preconditions, in order, returning a *ConflictError for
+// the first which does not hold.
+//
+// Within an Update, the check is atomic with the rest of the txn: no
+// other write can come between the check and the txn's own writes. So
+// optimistic concurrency needs nothing more than reading a value (and
+// perhaps deriving a version or ETag from it) in a View, and then
+// checking it is unchanged in the Update which writes:
+//
+//	err := client.Update(func(txn *golmdb.ReadWriteTxn) error {
+//		if err := txn.Check(golmdb.ValueEquals(db, key, seen)); err != nil {
+//			return err
+//		}
+//		return txn.Put(db, key, updated, 0)
+//	})
+//	if errors.Is(err, golmdb.ErrConflict) {
+//		// someone else changed it first
+//	}
+func (self *ReadOnlyTxn) Check(preconditions ...Precondition) error {
+	for _, precondition := range preconditions {
+		if err := self.check("Check", precondition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *ReadOnlyTxn) check(op string, precondition Precondition) error {
+	val, err := self.Get(precondition.db, precondition.key)
+	found := err == nil
+	if err != nil && !errors.Is(err, NotFound) {
+		return err
+	}
+	if reason := precondition.check(val, found); reason != "" {
+		return &ConflictError{
+			Op:     op,
+			DB:     self.names.get(precondition.db),
+			Key:    append([]byte(nil), precondition.key...),
+			Reason: reason,
+		}
+	}
+	return nil
+}
+
+// CompareAndSwap puts val as the value of the key, provided its current
+// value equals expected. If expected is nil, the key must not exist
+// (an empty but non-nil expected is an empty value). Otherwise, it
+// returns a *ConflictError and writes nothing.
+func (self *ReadWriteTxn) CompareAndSwap(db DBRef, key, expected, val []byte) error {
+	precondition := ValueEquals(db, key, expected)
+	if expected == nil {
+		precondition = KeyAbsent(db, key)
+	}
+	if err := self.check("CompareAndSwap", precondition); err != nil {
+		return err
+	}
+	return self.Put(db, key, val, 0)
+}
+
+// PutIfAbsent puts the key-value pair, provided the key does not
+// exist. Otherwise, it returns a *ConflictError. Unlike Put with
+// NoOverwrite (which returns KeyExist), the error tells you which key
+// conflicted.
+func (self *ReadWriteTxn) PutIfAbsent(db DBRef, key, val []byte) error {
+	if err := self.check("PutIfAbsent", KeyAbsent(db, key)); err != nil {
+		return err
+	}
+	return self.Put(db, key, val, 0)
+}
+
+// DeleteIfEquals deletes the key, provided its current value equals
+// expected. Otherwise, it returns a *ConflictError. It should not be
+// used with DupSort databases.
+func (self *ReadWriteTxn) DeleteIfEquals(db DBRef, key, expected []byte) error {
+	if err := self.check("DeleteIfEquals", ValueEquals(db, key, expected)); err != nil {
+		return err
+	}
+	return self.Delete(db, key, nil)
+}
@@ -0,0 +1,78 @@
+package golmdb_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/matryer/is"
+
+	"wellquite.org/golmdb"
+)
+
+func TestConditionalWrites(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	defer client.TerminateSync()
+
+	db, err := createDBRef(client, "docs", 0)
+	is.NoErr(err)
+	key := []byte("doc")
+
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		is.NoErr(txn.PutIfAbsent(db, key, []byte("v1")))
+		err := txn.PutIfAbsent(db, key, []byte("v2"))
+		is.True(errors.Is(err, golmdb.ErrConflict))
+		var conflict *golmdb.ConflictError
+		is.True(errors.As(err, &conflict))
+		is.Equal(conflict.Op, "PutIfAbsent")
+		is.Equal(conflict.DB, "docs")
+		is.Equal(string(conflict.Key), "doc")
+
+		// nil expected means absent.
+		is.True(errors.Is(txn.CompareAndSwap(db, key, nil, []byte("v2")), golmdb.ErrConflict))
+		is.True(errors.Is(txn.CompareAndSwap(db, key, []byte("v0"), []byte("v2")), golmdb.ErrConflict))
+		is.NoErr(txn.CompareAndSwap(db, key, []byte("v1"), []byte("v2")))
+		return nil
+	})
+	is.NoErr(err)
+
+	// optimistic concurrency: read in a View, then write only if
+	// unchanged.
+	var seen []byte
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		val, err := txn.Get(db, key)
+		seen = append([]byte(nil), val...)
+		return err
+	})
+	is.NoErr(err)
+	is.Equal(string(seen), "v2")
+
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		return txn.Put(db, key, []byte("v3"), 0)
+	})
+	is.NoErr(err)
+
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		if err := txn.Check(golmdb.KeyExists(db, key), golmdb.ValueEquals(db, key, seen)); err != nil {
+			return err
+		}
+		return txn.Put(db, key, []byte("lost update"), 0)
+	})
+	is.True(errors.Is(err, golmdb.ErrConflict))
+
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		is.True(errors.Is(txn.DeleteIfEquals(db, key, []byte("v2")), golmdb.ErrConflict))
+		is.NoErr(txn.Check(golmdb.ValueMatches(db, key, func(val []byte) bool { return val[0] == 'v' })))
+		is.NoErr(txn.DeleteIfEquals(db, key, []byte("v3")))
+		is.NoErr(txn.Check(golmdb.KeyAbsent(db, key)))
+		is.True(errors.Is(txn.DeleteIfEquals(db, key, []byte("v3")), golmdb.ErrConflict))
+		return nil
+	})
+	is.NoErr(err)
+}
@@ -16,12 +16,23 @@ import (
 type ReadOnlyCursor struct {
 	cursor         *C.MDB_cursor
 	resizeRequired *uint32
+	db             DBRef
+	names          *dbNames
+	// non-nil if expired keys are to be skipped
+	expiry *ReadOnlyTxn
+	// true if version headers are to be removed from values
+	versioned bool
+	// non-nil if values are to be decompressed
+	compression *dbCompression
 }
 
 // A ReadWriteCursor extends ReadOnlyCursor with methods for mutating
 // the database.
 type ReadWriteCursor struct {
 	ReadOnlyCursor
+	txn *ReadWriteTxn
+	// the indexes to update on Delete
+	indexes []*Index
 }
 
 // Create a new read-only cursor.
@@ -34,17 +45,42 @@ type ReadWriteCursor struct {
 // lifespan of its transaction, and you explicitly Close() each cursor
 // before the end of the transaction.
 //
+// If expiry is enabled for the database (see LMDBClient.EnableExpiry),
+// the cursor skips over keys which have expired.
+//
 // See http://www.lmdb.tech/doc/group__mdb.html#ga9ff5d7bd42557fd5ee235dc1d62613aa
 func (self *ReadOnlyTxn) NewCursor(db DBRef) (*ReadOnlyCursor, error) {
 	if atomic.LoadUint32(self.resizeRequired) == 1 {
 		return nil, MapFull
 	}
+	cursor, err := self.newCursor(db)
+	if err != nil {
+		return nil, err
+	}
+	if self.expiry.enabled(db) {
+		cursor.expiry = self
+	}
+	return cursor, nil
+}
+
+// A cursor which does not skip expired keys.
+func (self *ReadOnlyTxn) newCursor(db DBRef) (*ReadOnlyCursor, error) {
+	if err := self.merges.flush(db); err != nil {
+		return nil, err
+	}
 	var cursor *C.MDB_cursor
 	err := asError(C.mdb_cursor_open(self.txn, C.MDB_dbi(db), &cursor))
 	if err != nil {
-		return nil, err
+		return nil, self.opError("NewCursor", db, nil, err)
 	}
-	return &ReadOnlyCursor{cursor: cursor, resizeRequired: self.resizeRequired}, nil
+	return &ReadOnlyCursor{
+		cursor:         cursor,
+		resizeRequired: self.resizeRequired,
+		db:             db,
+		names:          self.names,
+		versioned:      self.versions.enabled(db),
+		compression:    self.compression.get(db),
+	}, nil
 }
 
 // Create a new read-write cursor.
@@ -57,14 +93,25 @@ func (self *ReadOnlyTxn) NewCursor(db DBRef) (*ReadOnlyCursor, error) {
 // lifespan of its transaction, and you explicitly Close() each cursor
 // before the end of the transaction.
 //
+// If expiry is enabled for the database (see LMDBClient.EnableExpiry),
+// the cursor skips over keys which have expired. Deleting with the
+// cursor does not remove a key's expiry. Deleting with the cursor
+// does update the database's indexes (see LMDBClient.DeclareIndex).
+//
 // See http://www.lmdb.tech/doc/group__mdb.html#ga9ff5d7bd42557fd5ee235dc1d62613aa
 func (self *ReadWriteTxn) NewCursor(db DBRef) (*ReadWriteCursor, error) {
-	var cursor *C.MDB_cursor
-	err := asError(C.mdb_cursor_open(self.txn, C.MDB_dbi(db), &cursor))
+	cursor, err := self.newCursor(db)
 	if err != nil {
 		return nil, err
 	}
-	return &ReadWriteCursor{ReadOnlyCursor{cursor: cursor, resizeRequired: self.resizeRequired}}, nil
+	if self.expiry.enabled(db) {
+		cursor.expiry = &self.ReadOnlyTxn
+	}
+	return &ReadWriteCursor{
+		ReadOnlyCursor: *cursor,
+		txn:            self,
+		indexes:        self.indexes.get(db),
+	}, nil
 }
 
 // Close the current cursor.
@@ -76,20 +123,38 @@ func (self *ReadOnlyCursor) Close() {
 	self.cursor = nil
 }
 
-func (self *ReadOnlyCursor) moveAndGet0(op cursorOp) (key, val []byte, err error) {
+// Wraps a non-nil err from LMDB in an OpError.
+func (self *ReadOnlyCursor) opError(op string, key []byte, err error) error {
+	if err == nil {
+		return nil
+	}
+	return newOpError(op, self.db, self.names.get(self.db), key, err)
+}
+
+func (self *ReadOnlyCursor) moveAndGet0(opName string, op cursorOp) (key, val []byte, err error) {
+	key, val, err = self.move0(opName, op)
+	return self.skipExpired(opName, op, key, val, err)
+}
+
+func (self *ReadOnlyCursor) move0(opName string, op cursorOp) (key, val []byte, err error) {
 	if atomic.LoadUint32(self.resizeRequired) == 1 {
 		return nil, nil, MapFull
 	}
 	var keyVal, valVal value
 	err = asError(C.mdb_cursor_get(self.cursor, (*C.MDB_val)(&keyVal), (*C.MDB_val)(&valVal), C.MDB_cursor_op(op)))
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, self.opError(opName, nil, err)
 	}
 
-	return keyVal.bytesNoCopy(), valVal.bytesNoCopy(), nil
+	return self.decodeValue(opName, keyVal.bytesNoCopy(), valVal.bytesNoCopy())
+}
+
+func (self *ReadOnlyCursor) moveAndGet1(opName string, op cursorOp, keyIn []byte) (key, val []byte, err error) {
+	key, val, err = self.move1(opName, op, keyIn)
+	return self.skipExpired(opName, op, key, val, err)
 }
 
-func (self *ReadOnlyCursor) moveAndGet1(op cursorOp, keyIn []byte) (key, val []byte, err error) {
+func (self *ReadOnlyCursor) move1(opName string, op cursorOp, keyIn []byte) (key, val []byte, err error) {
 	if atomic.LoadUint32(self.resizeRequired) == 1 {
 		return nil, nil, MapFull
 	}
@@ -98,13 +163,29 @@ func (self *ReadOnlyCursor) moveAndGet1(op cursorOp, keyIn []byte) (key, val []b
 		(*C.char)(unsafe.Pointer(&keyIn[0])), C.size_t(len(keyIn)),
 		(*C.MDB_val)(&keyVal), (*C.MDB_val)(&valVal), C.MDB_cursor_op(op)))
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, self.opError(opName, keyIn, err)
 	}
 
-	return keyVal.bytesNoCopy(), valVal.bytesNoCopy(), nil
+	return self.decodeValue(opName, keyVal.bytesNoCopy(), valVal.bytesNoCopy())
+}
+
+// Removes any version header from val, and decompresses it.
+func (self *ReadOnlyCursor) decodeValue(opName string, key, val []byte) ([]byte, []byte, error) {
+	var err error
+	if self.versioned {
+		if val, _, err = splitVersion(val); err != nil {
+			return nil, nil, self.opError(opName, key, err)
+		}
+	}
+	if self.compression != nil {
+		if val, err = self.compression.decompress(val); err != nil {
+			return nil, nil, self.opError(opName, key, err)
+		}
+	}
+	return key, val, nil
 }
 
-func (self *ReadOnlyCursor) moveAndGet2(op cursorOp, keyIn, valIn []byte) (val []byte, err error) {
+func (self *ReadOnlyCursor) moveAndGet2(opName string, op cursorOp, keyIn, valIn []byte) (val []byte, err error) {
 	if atomic.LoadUint32(self.resizeRequired) == 1 {
 		return nil, MapFull
 	}
@@ -115,7 +196,7 @@ func (self *ReadOnlyCursor) moveAndGet2(op cursorOp, keyIn, valIn []byte) (val [
 		(*C.MDB_val)(&valVal), C.MDB_cursor_op(op)))
 
 	if err != nil {
-		return nil, err
+		return nil, self.opError(opName, keyIn, err)
 	}
 
 	return valVal.bytesNoCopy(), nil
@@ -126,7 +207,7 @@ func (self *ReadOnlyCursor) moveAndGet2(op cursorOp, keyIn, valIn []byte) (val [
 // Do not write into the returned key or val byte slices. Doing so
 // will cause a segfault.
 func (self *ReadOnlyCursor) First() (key, val []byte, err error) {
-	return self.moveAndGet0(first)
+	return self.moveAndGet0("Cursor.First", first)
 }
 
 // Only for DupSort. Move to the first key-value pair without changing
@@ -135,7 +216,7 @@ func (self *ReadOnlyCursor) First() (key, val []byte, err error) {
 // Do not write into the returned val byte slice. Doing so will cause
 // a segfault.
 func (self *ReadOnlyCursor) FirstInSameKey() (val []byte, err error) {
-	_, val, err = self.moveAndGet0(firstDup)
+	_, val, err = self.moveAndGet0("Cursor.FirstInSameKey", firstDup)
 	return val, err
 }
 
@@ -144,7 +225,7 @@ func (self *ReadOnlyCursor) FirstInSameKey() (val []byte, err error) {
 // Do not write into the returned key or val byte slices. Doing so
 // will cause a segfault.
 func (self *ReadOnlyCursor) Last() (key, val []byte, err error) {
-	return self.moveAndGet0(last)
+	return self.moveAndGet0("Cursor.Last", last)
 }
 
 // Only for DupSort. Move to the last key-value pair without changing
@@ -153,7 +234,7 @@ func (self *ReadOnlyCursor) Last() (key, val []byte, err error) {
 // Do not write into the returned val byte slice. Doing so will cause
 // a segfault.
 func (self *ReadOnlyCursor) LastInSameKey() (val []byte, err error) {
-	_, val, err = self.moveAndGet0(lastDup)
+	_, val, err = self.moveAndGet0("Cursor.LastInSameKey", lastDup)
 	return val, err
 }
 
@@ -162,7 +243,7 @@ func (self *ReadOnlyCursor) LastInSameKey() (val []byte, err error) {
 // Do not write into the returned key or val byte slices. Doing so
 // will cause a segfault.
 func (self *ReadOnlyCursor) Current() (key, val []byte, err error) {
-	return self.moveAndGet0(getCurrent)
+	return self.moveAndGet0("Cursor.Current", getCurrent)
 }
 
 // Move to the next key-value pair.
@@ -174,7 +255,7 @@ func (self *ReadOnlyCursor) Current() (key, val []byte, err error) {
 // Do not write into the returned key or val byte slices. Doing so
 // will cause a segfault.
 func (self *ReadOnlyCursor) Next() (key, val []byte, err error) {
-	return self.moveAndGet0(next)
+	return self.moveAndGet0("Cursor.Next", next)
 }
 
 // Only for DupSort. Move to the next key-value pair, but only if the
@@ -183,7 +264,7 @@ func (self *ReadOnlyCursor) Next() (key, val []byte, err error) {
 // Do not write into the returned key or val byte slices. Doing so
 // will cause a segfault.
 func (self *ReadOnlyCursor) NextInSameKey() (key, val []byte, err error) {
-	return self.moveAndGet0(nextDup)
+	return self.moveAndGet0("Cursor.NextInSameKey", nextDup)
 }
 
 // Only for DupSort. Move to the first key-value pair of the next key.
@@ -191,7 +272,7 @@ func (self *ReadOnlyCursor) NextInSameKey() (key, val []byte, err error) {
 // Do not write into the returned key or val byte slices. Doing so
 // will cause a segfault.
 func (self *ReadOnlyCursor) NextKey() (key, val []byte, err error) {
-	return self.moveAndGet0(nextNoDup)
+	return self.moveAndGet0("Cursor.NextKey", nextNoDup)
 }
 
 // Move to the previous key-value pair.
@@ -203,7 +284,7 @@ func (self *ReadOnlyCursor) NextKey() (key, val []byte, err error) {
 // Do not write into the returned key or val byte slices. Doing so
 // will cause a segfault.
 func (self *ReadOnlyCursor) Prev() (key, val []byte, err error) {
-	return self.moveAndGet0(prev)
+	return self.moveAndGet0("Cursor.Prev", prev)
 }
 
 // Only for DupSort. Move to the previous key-value pair, but only if
@@ -212,7 +293,7 @@ func (self *ReadOnlyCursor) Prev() (key, val []byte, err error) {
 // Do not write into the returned key or val byte slices. Doing so
 // will cause a segfault.
 func (self *ReadOnlyCursor) PrevInSameKey() (key, val []byte, err error) {
-	return self.moveAndGet0(prevDup)
+	return self.moveAndGet0("Cursor.PrevInSameKey", prevDup)
 }
 
 // Only for DupSort. Move to the last key-value pair of the previous
@@ -221,7 +302,7 @@ func (self *ReadOnlyCursor) PrevInSameKey() (key, val []byte, err error) {
 // Do not write into the returned key or val byte slices. Doing so
 // will cause a segfault.
 func (self *ReadOnlyCursor) PrevKey() (key, val []byte, err error) {
-	return self.moveAndGet0(prevNoDup)
+	return self.moveAndGet0("Cursor.PrevKey", prevNoDup)
 }
 
 // Move to the key-value pair indicated by the given key.
@@ -233,7 +314,7 @@ func (self *ReadOnlyCursor) PrevKey() (key, val []byte, err error) {
 // Do not write into the returned val byte slice. Doing so will cause
 // a segfault.
 func (self *ReadOnlyCursor) SeekExactKey(key []byte) (val []byte, err error) {
-	_, val, err = self.moveAndGet1(setKey, key)
+	_, val, err = self.moveAndGet1("Cursor.SeekExactKey", setKey, key)
 	return val, err
 }
 
@@ -245,14 +326,14 @@ func (self *ReadOnlyCursor) SeekExactKey(key []byte) (val []byte, err error) {
 // Do not write into the returned keyOut or val byte slices. Doing so
 // will cause a segfault.
 func (self *ReadOnlyCursor) SeekGreaterThanOrEqualKey(keyIn []byte) (keyOut, val []byte, err error) {
-	return self.moveAndGet1(setRange, keyIn)
+	return self.moveAndGet1("Cursor.SeekGreaterThanOrEqualKey", setRange, keyIn)
 }
 
 // Only for DupSort. Move to the key-value pair indicated.
 //
 // If the exact key-value pair doesn't exist, return NotFound.
 func (self *ReadOnlyCursor) SeekExactKeyAndValue(keyIn, valIn []byte) (err error) {
-	_, err = self.moveAndGet2(getBoth, keyIn, valIn)
+	_, err = self.moveAndGet2("Cursor.SeekExactKeyAndValue", getBoth, keyIn, valIn)
 	return err
 }
 
@@ -263,7 +344,7 @@ func (self *ReadOnlyCursor) Count() (count uint64, err error) {
 	}
 	err = asError(C.mdb_cursor_count(self.cursor, (*C.size_t)(&count)))
 	if err != nil {
-		return 0, err
+		return 0, self.opError("Cursor.Count", nil, err)
 	}
 	return count, nil
 }
@@ -276,7 +357,7 @@ func (self *ReadOnlyCursor) Count() (count uint64, err error) {
 //
 // If there is no such value within the current key, return NotFound.
 func (self *ReadOnlyCursor) SeekGreaterThanOrEqualKeyAndValue(keyIn, valIn []byte) (valOut []byte, err error) {
-	return self.moveAndGet2(getBothRange, keyIn, valIn)
+	return self.moveAndGet2("Cursor.SeekGreaterThanOrEqualKeyAndValue", getBothRange, keyIn, valIn)
 }
 
 // Delete the key-value pair at the cursor.
@@ -284,7 +365,33 @@ func (self *ReadOnlyCursor) SeekGreaterThanOrEqualKeyAndValue(keyIn, valIn []byt
 // The only possible flag is NoDupData which is only for DupSort
 // databases, and means "delete all values for the current key".
 //
+// If the database has indexes (see LMDBClient.DeclareIndex), the
+// key's index entries are removed first. Should that, or the Delete,
+// fail, the txn should be aborted.
+//
 // See http://www.lmdb.tech/doc/group__mdb.html#ga26a52d3efcfd72e5bf6bd6960bf75f95
 func (self *ReadWriteCursor) Delete(flags PutFlag) error {
-	return asError(C.mdb_cursor_del(self.cursor, C.uint(flags)))
+	if len(self.indexes) != 0 {
+		if err := self.deleteIndexEntries(); err != nil {
+			return err
+		}
+	}
+	return self.opError("Cursor.Delete", nil, asError(C.mdb_cursor_del(self.cursor, C.uint(flags))))
+}
+
+// Removes the index entries of the key-value pair at the cursor. The
+// cursor cannot be used within a child txn, so unlike
+// ReadWriteTxn.Delete, only the index updates are made in one.
+func (self *ReadWriteCursor) deleteIndexEntries() error {
+	key, val, err := self.move0("Cursor.Delete", getCurrent)
+	if err != nil {
+		return err
+	}
+	// both are owned by LMDB, and the index updates may reuse their
+	// memory: indexChanges copies the index keys.
+	key = append([]byte(nil), key...)
+	changes := indexChanges(self.indexes, key, val, true, nil, false)
+	return self.txn.nested("Cursor.Delete", self.db, key, func() error {
+		return self.txn.applyIndexChanges(changes, key)
+	})
 }
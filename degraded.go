@@ -0,0 +1,173 @@
+package golmdb
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"wellquite.org/actors"
+)
+
+// DegradedError is returned by Update whilst the client is in
+// degraded read-only mode. This happens when the disk is full
+// (ENOSPC), or the map could not be grown: rather than the actor
+// terminating, Views carry on working, and Updates fail fast with
+// this error until Resume succeeds.
+//
+// Use errors.As to test for it. The Cause is also available through
+// errors.Is, e.g. errors.Is(err, syscall.ENOSPC).
+type DegradedError struct {
+	Cause error
+}
+
+func (self *DegradedError) Error() string {
+	return "golmdb is in degraded read-only mode: " + self.Cause.Error()
+}
+
+func (self *DegradedError) Unwrap() error {
+	return self.Cause
+}
+
+// Shared between the client and the actor. Only the actor enters and
+// leaves degraded mode; the client just checks it.
+type degradedState struct {
+	isDegraded uint32
+	lock       sync.Mutex
+	err        *DegradedError
+	// If non-zero, the map size we failed to grow to, which Resume
+	// should retry.
+	mapSize uint64
+	// Called, in a new go-routine, on entering degraded mode.
+	onDegraded func(error)
+}
+
+// Returns nil unless degraded.
+func (self *degradedState) check() error {
+	if atomic.LoadUint32(&self.isDegraded) == 0 {
+		return nil
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.err == nil {
+		return nil
+	}
+	return self.err
+}
+
+func (self *degradedState) enter(cause error, mapSize uint64) *DegradedError {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.err != nil {
+		// already degraded: keep the original cause.
+		if mapSize > self.mapSize {
+			self.mapSize = mapSize
+		}
+		return self.err
+	}
+	self.err = &DegradedError{Cause: cause}
+	self.mapSize = mapSize
+	atomic.StoreUint32(&self.isDegraded, 1)
+	if self.onDegraded != nil {
+		go self.onDegraded(self.err)
+	}
+	return self.err
+}
+
+func (self *degradedState) leave() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.err = nil
+	self.mapSize = 0
+	atomic.StoreUint32(&self.isDegraded, 0)
+}
+
+func (self *degradedState) forgetMapSize() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.mapSize = 0
+}
+
+// Degraded mode is not fatal to the actor.
+func nonFatal(err error) error {
+	var degradedErr *DegradedError
+	if errors.As(err, &degradedErr) {
+		return nil
+	}
+	return err
+}
+
+func isNoSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
+
+// --- Client side API ---
+
+// Degraded returns nil if the client is working normally. If the
+// client is in degraded read-only mode, it returns the *DegradedError
+// that Updates are failing with. See DegradedError.
+func (self *LMDBClient) Degraded() error {
+	return self.degraded.check()
+}
+
+// Resume attempts to return the client from degraded read-only mode to
+// normal operation, typically once you have freed up some disk space.
+// If the client entered degraded mode because the map could not be
+// grown, the resize is retried; otherwise a small write txn is
+// committed, to check that writing works again. If that fails, the
+// client stays degraded and the error is returned. Setting a new
+// MapSizePolicy discards any failed resize, so Resume will not retry
+// it. If the client is not degraded, Resume does nothing.
+func (self *LMDBClient) Resume() error {
+	if self.environment.readOnly {
+		return nil
+	}
+	if err := self.inFlight.enter(); err != nil {
+		return err
+	}
+	defer self.inFlight.exit()
+
+	msg := &resumeMsg{}
+	if self.SendSync(msg, true) {
+		return msg.err
+	} else {
+		return errTerminated
+	}
+}
+
+// --- Server side ---
+
+type resumeMsg struct {
+	actors.MsgSyncBase
+	err error // output
+}
+
+// Enter degraded mode. mapSize is the size the map failed to grow to,
+// if that's the cause.
+func (self *server) degrade(cause error, mapSize uint64) *DegradedError {
+	err := self.degraded.enter(cause, mapSize)
+	self.Log.Error().Err(cause).Msg("entering degraded read-only mode")
+	return err
+}
+
+func (self *server) resume() error {
+	if self.degraded.check() == nil {
+		return nil
+	}
+	self.degraded.lock.Lock()
+	mapSize := self.degraded.mapSize
+	self.degraded.lock.Unlock()
+
+	if mapSize > self.environment.mapSize {
+		if err := self.resize(mapSize, true); err != nil {
+			return err
+		}
+	} else if err := self.environment.probeWrite(); err != nil {
+		// e.g. the disk is still full.
+		self.Log.Error().Err(err).Msg("resuming from degraded read-only mode")
+		return self.degrade(err, 0)
+	}
+	self.degraded.leave()
+	self.Log.Info().Msg("resumed from degraded read-only mode")
+	return nil
+}
@@ -0,0 +1,138 @@
+package golmdb_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"wellquite.org/golmdb"
+)
+
+func TestDegradedMode(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	dir, err := os.MkdirTemp("", "golmdb")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	degradedCh := make(chan error, 1)
+	client, err := golmdb.Open(dir, golmdb.Options{
+		Log:        log,
+		NumDBs:     4,
+		OnDegraded: func(err error) { degradedCh <- err },
+	})
+	is.NoErr(err)
+	defer client.TerminateSync()
+
+	dbRef, err := createDBRef(client, t.Name(), 0)
+	is.NoErr(err)
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		return txn.Put(dbRef, []byte("key"), []byte("value"), 0)
+	})
+	is.NoErr(err)
+	is.NoErr(client.Degraded())
+
+	// every resize fails, as if the map could not be mapped.
+	golmdb.SetRemapHook(client, func(size uint64) error { return syscall.ENOMEM })
+	err = client.SetMapSizePolicy(golmdb.MapSizePolicy{InitialSize: 64 << 20, GrowthFactor: 2})
+	var degradedErr *golmdb.DegradedError
+	is.True(errors.As(err, &degradedErr))
+	is.True(errors.Is(err, syscall.ENOMEM))
+
+	select {
+	case err := <-degradedCh:
+		is.True(errors.As(err, &degradedErr))
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnDegraded was not called")
+	}
+	is.True(client.Degraded() != nil)
+
+	// Views still work, on the reopened environment.
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		val, err := txn.Get(dbRef, []byte("key"))
+		is.NoErr(err)
+		is.Equal(string(val), "value")
+		return nil
+	})
+	is.NoErr(err)
+
+	// Updates fail fast.
+	ran := false
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		ran = true
+		return nil
+	})
+	is.True(errors.As(err, &degradedErr))
+	is.True(!ran)
+
+	// retrying the same resize fails again.
+	err = client.Resume()
+	is.True(errors.As(err, &degradedErr))
+	is.True(client.Degraded() != nil)
+
+	// once resizing works again, Resume retries the resize.
+	golmdb.SetRemapHook(client, nil)
+	is.NoErr(client.Resume())
+	is.NoErr(client.Degraded())
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		return txn.Put(dbRef, []byte("key"), []byte("value2"), 0)
+	})
+	is.NoErr(err)
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		val, err := txn.Get(dbRef, []byte("key"))
+		is.NoErr(err)
+		is.Equal(string(val), "value2")
+		return nil
+	})
+	is.NoErr(err)
+}
+
+func TestProactiveResizeFailure(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	dir, err := os.MkdirTemp("", "golmdb")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	client, err := golmdb.Open(dir, golmdb.Options{
+		Log:    log,
+		NumDBs: 4,
+		MapSizePolicy: golmdb.MapSizePolicy{
+			InitialSize:     1 << 20,
+			GrowthIncrement: 1 << 20,
+			ResizeThreshold: 0.1,
+		},
+	})
+	is.NoErr(err)
+	defer client.TerminateSync()
+
+	dbRef, err := createDBRef(client, t.Name(), 0)
+	is.NoErr(err)
+
+	golmdb.SetRemapHook(client, func(size uint64) error { return syscall.ENOMEM })
+	// enough to pass the threshold, but not to fill the map: each
+	// commit tries to grow the map, and fails, and carries on.
+	val := make([]byte, 1024)
+	for idx := 0; idx < 100; idx++ {
+		err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+			return txn.Put(dbRef, []byte(fmt.Sprint(idx)), val, 0)
+		})
+		is.NoErr(err)
+	}
+	is.NoErr(client.Degraded())
+
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		_, err := txn.Get(dbRef, []byte("99"))
+		return err
+	})
+	is.NoErr(err)
+}
@@ -3,11 +3,14 @@ package golmdb
 /*
 #include <lmdb.h>
 #include <stdlib.h>
+#include "golmdb.h"
 */
 import "C"
 import (
+	"context"
 	"io/fs"
 	"os"
+	"path/filepath"
 	"unsafe"
 
 	"github.com/rs/zerolog"
@@ -17,9 +20,36 @@ import (
 type environment struct {
 	env        *C.MDB_env
 	readOnly   bool
+	path       string
+	flags      EnvironmentFlag
+	mode       fs.FileMode
 	numReaders uint
+	numDBs     uint
 	mapSize    uint64
-	pageSize   uint64
+	// LMDB's page size: the OS page size until a data file is opened,
+	// then the page size recorded in the data file.
+	pageSize uint64
+	// only used by the writer
+	mapSizePolicy MapSizePolicy
+	// bounds the number of concurrent read txns to numReaders
+	readerSlots *readerSlots
+	// names of the databases opened, for errors
+	dbNames *dbNames
+	// the indexes declared with DeclareIndex
+	indexes *indexRegistry
+	// the databases passed to EnableExpiry
+	expiry *expiryRegistry
+	// the merge operators set with SetMergeOperator
+	merges *mergeRegistry
+	// the databases passed to EnableVersioning
+	versions *versionRegistry
+	// the databases passed to EnableCompression
+	compression *compressionRegistry
+	// the sequences database, once opened
+	sequences *sequencesRef
+	// only for tests: if non-nil, called by remap, which fails with
+	// its error instead of resizing the map.
+	remapHook func(size uint64) error
 }
 
 func newEnvironment() (*environment, error) {
@@ -29,8 +59,15 @@ func newEnvironment() (*environment, error) {
 		return nil, err
 	}
 	return &environment{
-		env:      env,
-		pageSize: uint64(os.Getpagesize()),
+		env:         env,
+		pageSize:    uint64(os.Getpagesize()),
+		dbNames:     newDBNames(),
+		indexes:     newIndexRegistry(),
+		expiry:      newExpiryRegistry(),
+		merges:      newMergeRegistry(),
+		versions:    newVersionRegistry(),
+		compression: newCompressionRegistry(),
+		sequences:   new(sequencesRef),
 	}, nil
 }
 
@@ -64,15 +101,64 @@ func (self *environment) setMapSize(size uint64) error {
 	return asError(C.mdb_env_set_mapsize(self.env, C.size_t(size)))
 }
 
+// Resizes the map of the open environment. If this fails, LMDB may
+// already have unmapped the old map, and a later mdb_env_set_mapsize
+// does not map it again: the environment must be reopened before it
+// is used again.
+func (self *environment) remap(size uint64) error {
+	if self.remapHook != nil {
+		if err := self.remapHook(size); err != nil {
+			return err
+		}
+	}
+	return self.setMapSize(size)
+}
+
 // Uses mdb_env_info to access the current map size.
 // http://www.lmdb.tech/doc/group__mdb.html#ga18769362c7e7d6cf91889a028a5c5947
 func (self *environment) getMapSize() (uint64, error) {
+	info, err := self.info()
+	if err != nil {
+		return 0, err
+	}
+	return info.mapSize, nil
+}
+
+type envInfo struct {
+	mapSize        uint64
+	lastPageNumber uint64
+	lastTxnID      uint64
+	maxReaders     uint
+	numReaders     uint
+}
+
+// mdb_env_info. http://www.lmdb.tech/doc/group__mdb.html#ga18769362c7e7d6cf91889a028a5c5947
+func (self *environment) info() (envInfo, error) {
 	var cInfo C.MDB_envinfo
 	err := asError(C.mdb_env_info(self.env, &cInfo))
+	if err != nil {
+		return envInfo{}, err
+	}
+	return envInfo{
+		mapSize:        uint64(cInfo.me_mapsize),
+		lastPageNumber: uint64(cInfo.me_last_pgno),
+		lastTxnID:      uint64(cInfo.me_last_txnid),
+		maxReaders:     uint(cInfo.me_maxreaders),
+		numReaders:     uint(cInfo.me_numreaders),
+	}, nil
+}
+
+// mdb_env_stat. http://www.lmdb.tech/doc/group__mdb.html#gaf881dca452050efbd434cd16e4bae255
+// Returns the page size of the opened environment. This is the page
+// size recorded in the data file, which is not necessarily the same
+// as os.Getpagesize().
+func (self *environment) filePageSize() (uint64, error) {
+	var cStat C.MDB_stat
+	err := asError(C.mdb_env_stat(self.env, &cStat))
 	if err != nil {
 		return 0, err
 	}
-	return uint64(cInfo.me_mapsize), nil
+	return uint64(cStat.ms_psize), nil
 }
 
 // mdb_env_set_maxreaders. http://www.lmdb.tech/doc/group__mdb.html#gae687966c24b790630be2a41573fe40e2
@@ -106,7 +192,34 @@ func (self *environment) sync(force bool) error {
 	return asError(C.mdb_env_sync(self.env, C.int(forceNum)))
 }
 
+// LMDB's main (unnamed) database, in which the named databases are
+// recorded.
+const mainDBI = C.MDB_dbi(1)
+
+// Checks that a write txn can commit, by putting and then deleting a
+// key in the main database. The commit still has to write pages, so
+// it fails if, for example, the disk is still full.
+func (self *environment) probeWrite() error {
+	txn, err := self.txnBegin(false, nil)
+	if err != nil {
+		return err
+	}
+	key := []byte("golmdb.probe")
+	keyPtr, keyLen := (*C.char)(unsafe.Pointer(&key[0])), C.size_t(len(key))
+	err = asError(C.golmdb_mdb_put(txn, mainDBI, keyPtr, keyLen, keyPtr, keyLen, 0))
+	if err == nil {
+		err = asError(C.golmdb_mdb_del(txn, mainDBI, keyPtr, keyLen, nil, 0))
+	}
+	if err != nil {
+		C.mdb_txn_abort(txn)
+		return err
+	}
+	return asError(C.mdb_txn_commit(txn))
+}
+
 // mdb_env_copy2. http://www.lmdb.tech/doc/group__mdb.html#ga3bf50d7793b36aaddf6b481a44e24244
+// The copy uses a read txn, so the caller must hold one of the
+// readerSlots.
 func (self *environment) copy(path string, compact bool) error {
 	cPath := C.CString(path)
 	defer C.free(unsafe.Pointer(cPath))
@@ -118,7 +231,8 @@ func (self *environment) copy(path string, compact bool) error {
 }
 
 // NewLMDB opens an LMDB database at the given path, creating it if
-// necessary, and returns a client to that LMDB database.
+// necessary, and returns a client to that LMDB database. Open offers
+// the same, and more, with the settings supplied as Options.
 //
 // NoTLS is always added to the flags automatically. The value 0 is a
 // perfectly sensible default. Using NoReadAhead will probably help if
@@ -139,21 +253,7 @@ func (self *environment) copy(path string, compact bool) error {
 // batchSize is the number of go-routines that could concurrently
 // submit Update transactions.
 func NewLMDB(log zerolog.Logger, path string, mode fs.FileMode, numReaders, numDBs uint, flags EnvironmentFlag, batchSize uint) (*LMDBClient, error) {
-	environment, err := setupEnvironment(path, mode, numReaders, numDBs, flags)
-	if err != nil {
-		return nil, err
-	}
-
-	if flags&ReadOnly != 0 {
-		return readOnlyLMDBClient(environment), nil
-
-	} else {
-		client, err := spawnLMDBActor(nil, &log, environment, batchSize)
-		if err != nil {
-			return nil, err
-		}
-		return client, nil
-	}
+	return Open(path, positionalOptions(log, nil, mode, numReaders, numDBs, flags, batchSize))
 }
 
 // NewManagedLMDB opens an LMDB database at the given path, creating
@@ -163,55 +263,184 @@ func NewLMDB(log zerolog.Logger, path string, mode fs.FileMode, numReaders, numD
 // actor (if it is spawned) is spawned as a child of the manager,
 // rather than an unmanaged stand-alone actor.
 func NewManagedLMDB(manager actors.ManagerClient, path string, mode fs.FileMode, numReaders, numDBs uint, flags EnvironmentFlag, batchSize uint) (*LMDBClient, error) {
-	environment, err := setupEnvironment(path, mode, numReaders, numDBs, flags)
-	if err != nil {
-		return nil, err
-	}
+	return Open(path, positionalOptions(zerolog.Logger{}, manager, mode, numReaders, numDBs, flags, batchSize))
+}
 
+// NewLMDB and NewManagedLMDB have always ignored the batchSize and
+// manager when opening ReadOnly, whereas Open rejects them. And a
+// batchSize of 0 has always meant no limit: a batch is only run once
+// no further Updates are queued up.
+func positionalOptions(log zerolog.Logger, manager actors.ManagerClient, mode fs.FileMode, numReaders, numDBs uint, flags EnvironmentFlag, batchSize uint) Options {
+	options := Options{
+		Log:        log,
+		Manager:    manager,
+		Mode:       mode,
+		NumReaders: numReaders,
+		NumDBs:     numDBs,
+		Flags:      flags,
+		BatchSize:  batchSize,
+		positional: true,
+	}
 	if flags&ReadOnly != 0 {
-		return readOnlyLMDBClient(environment), nil
-
-	} else {
-		client, err := spawnLMDBActor(manager, nil, environment, batchSize)
-		if err != nil {
-			return nil, err
-		}
-		return client, nil
+		options.Manager = nil
+		options.BatchSize = 0
 	}
+	return options
 }
 
-func setupEnvironment(path string, mode fs.FileMode, numReaders, numDBs uint, flags EnvironmentFlag) (*environment, error) {
+func setupEnvironment(path string, options *Options) (*environment, error) {
 	environment, err := newEnvironment()
 	if err != nil {
 		return nil, err
 	}
-	if err := environment.setMaxReaders(numReaders); err != nil {
+	environment.mapSizePolicy = options.MapSizePolicy
+	environment.path = path
+	environment.flags = options.Flags
+	environment.mode = options.Mode
+	environment.numReaders = options.NumReaders
+	environment.numDBs = options.NumDBs
+	environment.readerSlots = newReaderSlots(options.NumReaders)
+
+	if err := environment.configureAndOpen(0); err != nil {
 		return nil, err
 	}
-	environment.numReaders = numReaders
+	return environment, nil
+}
 
-	if err := environment.setMaxNumberOfDBs(numDBs); err != nil {
-		return nil, err
+// Applies the settings recorded in the environment to a freshly
+// created MDB_env, opens the path, and records the resulting map
+// size. A mapSize of 0 leaves LMDB to choose (which means the size
+// recorded in the data file, or LMDB's default for a new file). In
+// either case, the map size is then grown if necessary to the
+// policy's initial size. If the resulting error is non-nil, the
+// environment has been closed.
+func (self *environment) configureAndOpen(mapSize uint64) error {
+	if err := self.setMaxReaders(self.numReaders); err != nil {
+		self.close()
+		return err
 	}
-	if err := environment.open(path, flags|NoTLS, mode); err != nil {
-		environment.close()
-		return nil, err
+	if err := self.setMaxNumberOfDBs(self.numDBs); err != nil {
+		self.close()
+		return err
+	}
+	if mapSize != 0 {
+		if err := self.setMapSize(mapSize); err != nil {
+			self.close()
+			return err
+		}
+	}
+	if err := self.open(self.path, self.flags|NoTLS, self.mode); err != nil {
+		self.close()
+		return err
 	}
 
-	mapSize, err := environment.getMapSize()
+	mapSize, err := self.getMapSize()
 	if err != nil {
-		environment.close()
-		return nil, err
+		self.close()
+		return err
+	}
+	if self.pageSize, err = self.filePageSize(); err != nil {
+		self.close()
+		return err
 	}
 
-	if remainder := mapSize % environment.pageSize; remainder != 0 {
-		mapSize = (mapSize + environment.pageSize) - remainder
-		if err := environment.setMapSize(mapSize); err != nil {
-			environment.close()
-			return nil, err
+	aligned := self.mapSizePolicy.roundUp(mapSize)
+	if self.flags&ReadOnly == 0 {
+		if initialSize := self.mapSizePolicy.initialSize(); aligned < initialSize {
+			aligned = initialSize
 		}
 	}
-	environment.mapSize = mapSize
+	if aligned != mapSize {
+		mapSize = aligned
+		if err := self.setMapSize(mapSize); err != nil {
+			self.close()
+			return err
+		}
+	}
+	self.mapSize = mapSize
 
-	return environment, nil
+	return nil
+}
+
+// Closes the environment and then opens its path again with a fresh
+// MDB_env. The swap func is called in between, whilst nothing in
+// this process has the data file open. It is up to the caller to
+// guarantee there are no transactions running at all, and no further
+// use of any DBRef until the same DBRefs have been opened again. If
+// openErr is non-nil then the environment is unusable.
+func (self *environment) reopen(mapSize uint64, swap func() error) (swapErr, openErr error) {
+	self.close()
+	if swapErr = swap(); swapErr != nil {
+		// the old data file should still be in place, so carry on with it.
+		mapSize = self.mapSize
+	}
+	var env *C.MDB_env
+	if openErr = asError(C.mdb_env_create(&env)); openErr != nil {
+		return swapErr, openErr
+	}
+	self.env = env
+	return swapErr, self.configureAndOpen(mapSize)
+}
+
+// The number of bytes of the map in use by the most recently
+// committed txn.
+func (self *environment) usedSize() (uint64, error) {
+	info, err := self.info()
+	if err != nil {
+		return 0, err
+	}
+	return (info.lastPageNumber + 1) * self.pageSize, nil
+}
+
+// LMDB's default map size, which is what a new data file gets unless
+// the map size is set explicitly.
+const defaultMapSize = 1024 * 1024
+
+// The path of the data file itself, which depends on whether or not
+// the environment was opened with NoSubDir.
+func (self *environment) dataFilePath() string {
+	if self.flags&NoSubDir != 0 {
+		return self.path
+	}
+	return filepath.Join(self.path, dataFileName)
+}
+
+// Writes a compacted copy of the environment alongside its data file,
+// so that it can later be renamed into place. Returns the path of the
+// copy's data file, and a func to remove whatever is left of the
+// copy.
+func (self *environment) compactedCopy() (copyPath string, cleanup func(), err error) {
+	if err := self.readerSlots.acquire(context.Background()); err != nil {
+		return "", nil, err
+	}
+	defer self.readerSlots.release()
+	if self.flags&NoSubDir != 0 {
+		copyPath = self.path + ".compact"
+		// mdb_env_copy2 will not overwrite an existing file, which
+		// might be left over from a crash part way through Compact.
+		if err := os.Remove(copyPath); err != nil && !os.IsNotExist(err) {
+			return "", nil, err
+		}
+		cleanup = func() { os.Remove(copyPath) }
+		err = self.copy(copyPath, true)
+
+	} else {
+		var dir string
+		dir, err = os.MkdirTemp(self.path, ".golmdb-compact-")
+		if err != nil {
+			return "", nil, err
+		}
+		copyPath = filepath.Join(dir, dataFileName)
+		cleanup = func() { os.RemoveAll(dir) }
+		err = self.copy(dir, true)
+	}
+
+	if err == nil {
+		err = syncFile(copyPath)
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return copyPath, cleanup, nil
 }
@@ -0,0 +1,152 @@
+package golmdb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// OpError is the error returned by the methods of ReadOnlyTxn,
+// ReadWriteTxn, and their cursors when LMDB returns an error. It
+// records which operation failed, on which database, and with which
+// key.
+//
+// OpError implements Unwrap, so errors.Is(err, NotFound) and the like
+// work as you would expect. Do not compare errors from these methods
+// with == : use errors.Is.
+//
+// Building an OpError allocates, which matters only if you expect a
+// lot of misses: ReadOnlyTxn.GetIfExists reports a missing key without
+// an error, and so without allocating.
+type OpError struct {
+	// The operation that failed, e.g. "Get" or "Cursor.Next".
+	Op string
+	// The database the operation was on, if any.
+	DBRef DBRef
+	// The name of the database, if known. The unnamed database has the
+	// name "".
+	DB string
+	// The key the operation was given, if any. At most the first 64
+	// bytes of it are kept; KeyLen is the length of the whole key.
+	Key    []byte
+	KeyLen int
+	// The underlying error: usually an LMDBError or a syscall.Errno.
+	Err error
+}
+
+// Keys in errors are truncated to this length so that errors (and
+// the logs they end up in) stay a reasonable size.
+const maxErrorKeyLen = 64
+
+func newOpError(op string, dbRef DBRef, db string, key []byte, err error) *OpError {
+	keyLen := len(key)
+	if keyLen > maxErrorKeyLen {
+		key = key[:maxErrorKeyLen]
+	}
+	return &OpError{
+		Op:    op,
+		DBRef: dbRef,
+		DB:    db,
+		// take a copy: the key may be memory owned by LMDB, or reused
+		// by the caller.
+		Key:    append([]byte(nil), key...),
+		KeyLen: keyLen,
+		Err:    err,
+	}
+}
+
+func (self *OpError) Error() string {
+	var builder strings.Builder
+	builder.WriteString("golmdb: ")
+	builder.WriteString(self.Op)
+	if self.DB != "" {
+		fmt.Fprintf(&builder, " on database %q", self.DB)
+	} else if self.DBRef != 0 {
+		fmt.Fprintf(&builder, " on DBRef %d", self.DBRef)
+	}
+	if self.KeyLen > 0 {
+		fmt.Fprintf(&builder, " with key %q", self.Key)
+		if self.KeyLen > len(self.Key) {
+			fmt.Fprintf(&builder, "... (%d bytes)", self.KeyLen)
+		}
+	}
+	builder.WriteString(": ")
+	builder.WriteString(self.Err.Error())
+	return builder.String()
+}
+
+func (self *OpError) Unwrap() error {
+	return self.Err
+}
+
+// IsRetryable reports whether err is a transient condition: one where
+// the same operation, tried again later, may well succeed. For
+// example, the map being full or resized, the reader table being
+// full, or the client being in degraded read-only mode.
+func IsRetryable(err error) bool {
+	var degradedErr *DegradedError
+	return errors.Is(err, MapFull) ||
+		errors.Is(err, MapResized) ||
+		errors.Is(err, ReadersFull) ||
+		errors.As(err, &degradedErr) ||
+		errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.EINTR) ||
+		errors.Is(err, syscall.EBUSY)
+}
+
+// IsCorruption reports whether err indicates that the data file is
+// corrupt. Restoring from a backup (see Restore) is probably needed.
+func IsCorruption(err error) bool {
+	return errors.Is(err, Corrupted) ||
+		errors.Is(err, PageNotFound) ||
+		errors.Is(err, Invalid)
+}
+
+// IsFatal reports whether err means the client can no longer be used:
+// corruption, LMDB having panicked, an I/O error, or the client
+// having been terminated or closed.
+func IsFatal(err error) bool {
+	return IsCorruption(err) ||
+		errors.Is(err, PanicMDB) ||
+		errors.Is(err, VersionMismatch) ||
+		errors.Is(err, syscall.EIO) ||
+		errors.Is(err, errTerminated) ||
+		errors.Is(err, ErrClosed)
+}
+
+// The names of the databases opened by DBRef, so that OpErrors can
+// include them.
+type dbNames struct {
+	lock  sync.RWMutex
+	names map[DBRef]string
+}
+
+func newDBNames() *dbNames {
+	return &dbNames{names: make(map[DBRef]string)}
+}
+
+func (self *dbNames) set(dbRef DBRef, name string) {
+	if self == nil {
+		return
+	}
+	self.lock.RLock()
+	existing, found := self.names[dbRef]
+	self.lock.RUnlock()
+	if found && existing == name {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.names[dbRef] = name
+}
+
+func (self *dbNames) get(dbRef DBRef) string {
+	if self == nil {
+		return ""
+	}
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.names[dbRef]
+}
@@ -0,0 +1,133 @@
+package golmdb_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+
+	"wellquite.org/golmdb"
+)
+
+func TestOpError(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	defer client.TerminateSync()
+
+	dbRef, err := createDBRef(client, t.Name(), 0)
+	is.NoErr(err)
+
+	longKey := bytes.Repeat([]byte("k"), 200)
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		_, err := txn.Get(dbRef, []byte("missing"))
+		is.True(errors.Is(err, golmdb.NotFound))
+		var opErr *golmdb.OpError
+		is.True(errors.As(err, &opErr))
+		is.Equal(opErr.Op, "Get")
+		is.Equal(opErr.DB, t.Name())
+		is.Equal(opErr.DBRef, dbRef)
+		is.Equal(string(opErr.Key), "missing")
+		is.True(strings.Contains(err.Error(), t.Name()))
+		is.True(strings.Contains(err.Error(), "missing"))
+
+		_, err = txn.Get(dbRef, longKey)
+		is.True(errors.As(err, &opErr))
+		is.Equal(opErr.KeyLen, len(longKey))
+		is.True(len(opErr.Key) < len(longKey))
+
+		cursor, err := txn.NewCursor(dbRef)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close()
+		_, _, err = cursor.First()
+		is.True(errors.Is(err, golmdb.NotFound))
+		is.True(errors.As(err, &opErr))
+		is.Equal(opErr.Op, "Cursor.First")
+
+		_, err = txn.DBRef("no such database", 0)
+		is.True(errors.Is(err, golmdb.NotFound))
+		is.True(strings.Contains(err.Error(), "no such database"))
+
+		// a miss is not an error for GetIfExists.
+		val, found, err := txn.GetIfExists(dbRef, []byte("missing"))
+		is.NoErr(err)
+		is.True(!found)
+		is.Equal(val, nil)
+		return nil
+	})
+	is.NoErr(err)
+}
+
+func BenchmarkGetNotFound(b *testing.B) {
+	benchmarkMisses(b, func(txn *golmdb.ReadOnlyTxn, dbRef golmdb.DBRef, key []byte) error {
+		if _, err := txn.Get(dbRef, key); !errors.Is(err, golmdb.NotFound) {
+			return err
+		}
+		return nil
+	})
+}
+
+func BenchmarkGetIfExistsNotFound(b *testing.B) {
+	benchmarkMisses(b, func(txn *golmdb.ReadOnlyTxn, dbRef golmdb.DBRef, key []byte) error {
+		_, _, err := txn.GetIfExists(dbRef, key)
+		return err
+	})
+}
+
+func benchmarkMisses(b *testing.B, get func(txn *golmdb.ReadOnlyTxn, dbRef golmdb.DBRef, key []byte) error) {
+	log := NewTestLogger(b)
+	is := is.New(b)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	defer client.TerminateSync()
+
+	dbRef, err := createDBRef(client, "misses", 0)
+	is.NoErr(err)
+
+	key := []byte("missing")
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		b.ReportAllocs()
+		b.ResetTimer()
+		for idx := 0; idx < b.N; idx++ {
+			if err := get(txn, dbRef, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	is.NoErr(err)
+}
+
+func TestErrorClassification(t *testing.T) {
+	is := is.New(t)
+
+	wrap := func(err error) error { return fmt.Errorf("wrapped: %w", err) }
+
+	is.True(golmdb.IsRetryable(wrap(golmdb.MapFull)))
+	is.True(golmdb.IsRetryable(golmdb.ReadersFull))
+	is.True(golmdb.IsRetryable(&golmdb.DegradedError{Cause: errors.New("disk full")}))
+	is.True(!golmdb.IsRetryable(golmdb.NotFound))
+
+	is.True(golmdb.IsCorruption(wrap(golmdb.Corrupted)))
+	is.True(golmdb.IsCorruption(golmdb.PageNotFound))
+	is.True(!golmdb.IsCorruption(golmdb.MapFull))
+
+	is.True(golmdb.IsFatal(golmdb.Corrupted))
+	is.True(golmdb.IsFatal(golmdb.PanicMDB))
+	is.True(golmdb.IsFatal(golmdb.ErrClosed))
+	is.True(!golmdb.IsFatal(golmdb.KeyExist))
+	is.True(!golmdb.IsFatal(nil))
+	is.True(!golmdb.IsRetryable(nil))
+}
@@ -0,0 +1,502 @@
+package golmdb
+
+/*
+#include <lmdb.h>
+*/
+import "C"
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// The reserved databases in which expiries are kept. Both use keys of
+// the form name\x00key, where name is the name of the expiring
+// database (which, being a C string, cannot contain \x00):
+//
+//   - expiryDeadlinesDBName: deadline|name\x00key -> nothing. Ordered
+//     by deadline, for the sweeper.
+//   - expiryKeysDBName: name\x00key -> deadline. For finding a key's
+//     expiry.
+//
+// Deadlines are 8-byte big-endian Unix nanoseconds.
+const (
+	expiryDeadlinesDBName = "golmdb.expiry-deadlines"
+	expiryKeysDBName      = "golmdb.expiry-keys"
+)
+
+// DefaultExpirySweepBatchSize is used if Options.ExpirySweepBatchSize
+// is 0.
+const DefaultExpirySweepBatchSize = 1000
+
+// EnableExpiry allows keys of the database to be given an expiry, with
+// PutWithTTL and ExpireAt. Expired keys are NotFound to Get and are
+// skipped by cursors straight away, and are deleted by SweepExpired
+// (which can be run automatically: see Options.ExpirySweepInterval).
+//
+// The database must be a named database, and must not be DupSort. The
+// expiries are kept in two reserved databases, so Options.NumDBs must
+// allow for them.
+//
+// Like DeclareIndex, this is not persistent: each program must enable
+// expiry every time it opens the database, before it reads or writes
+// the database. Expiries are kept regardless, but without this, they
+// are ignored. That includes programs which open the database
+// ReadOnly (for them, db may come from a View), though if no expiry
+// has ever been set in the data file, there is nothing for them to
+// ignore, and this does nothing.
+func (self *LMDBClient) EnableExpiry(db DBRef) error {
+	var name string
+	var deadlinesDB, keysDB DBRef
+	if self.environment.readOnly {
+		// the reserved databases can't be created, and their DBRefs
+		// must outlive this txn. As must db's: otherwise, a later View
+		// could reopen it as a different DBRef.
+		noExpiries := false
+		err := self.viewAndKeepDBRefs(func(txn *ReadOnlyTxn) (err error) {
+			if name, err = txn.checkExpirable(db); err != nil {
+				return err
+			}
+			deadlinesDB, err = txn.DBRef(expiryDeadlinesDBName, 0)
+			if errors.Is(err, NotFound) {
+				noExpiries = true
+				return nil
+			} else if err != nil {
+				return err
+			}
+			keysDB, err = txn.DBRef(expiryKeysDBName, 0)
+			return err
+		})
+		if err != nil || noExpiries {
+			return err
+		}
+	} else {
+		err := self.Update(func(txn *ReadWriteTxn) (err error) {
+			if name, err = txn.checkExpirable(db); err != nil {
+				return err
+			}
+			if deadlinesDB, err = txn.DBRef(expiryDeadlinesDBName, Create); err != nil {
+				return err
+			}
+			keysDB, err = txn.DBRef(expiryKeysDBName, Create)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	self.environment.expiry.enable(db, name, deadlinesDB, keysDB)
+	return nil
+}
+
+func (self *ReadOnlyTxn) checkExpirable(db DBRef) (name string, err error) {
+	if self.names.get(db) == "" {
+		return "", errors.New("Cannot enable expiry: only named databases can expire")
+	}
+	if name, err = self.reopen(db); err != nil {
+		return "", fmt.Errorf("Cannot enable expiry: %w", err)
+	}
+	var flags C.uint
+	if err = asError(C.mdb_dbi_flags(self.txn, C.MDB_dbi(db), &flags)); err != nil {
+		return "", self.opError("EnableExpiry", db, nil, err)
+	}
+	if DatabaseFlag(flags)&DupSort != 0 {
+		return "", fmt.Errorf("Cannot enable expiry for database %q: it is DupSort", name)
+	}
+	return name, nil
+}
+
+// PutWithTTL puts the key-value pair (exactly as Put), and sets it to
+// expire once ttl has elapsed. ttl must be positive.
+func (self *ReadWriteTxn) PutWithTTL(db DBRef, key, val []byte, ttl time.Duration, flags PutFlag) error {
+	if ttl <= 0 {
+		return errors.New("Cannot put with TTL: ttl must be positive")
+	}
+	if err := self.Put(db, key, val, flags); err != nil {
+		return err
+	}
+	return self.ExpireAt(db, key, time.Now().Add(ttl))
+}
+
+// ExpireAt sets the key to expire at the given time, replacing any
+// existing expiry. If the key doesn't exist (or has already expired),
+// the error matches NotFound.
+func (self *ReadWriteTxn) ExpireAt(db DBRef, key []byte, at time.Time) error {
+	name, deadlinesDB, keysDB, ok := self.expiry.lookup(db)
+	if !ok {
+		return fmt.Errorf("Cannot expire: expiry is not enabled for database %q", self.names.get(db))
+	}
+	if _, err := self.Get(db, key); err != nil {
+		return err
+	}
+	if err := self.clearExpiry(db, key); err != nil {
+		return err
+	}
+	deadline := binary.BigEndian.AppendUint64(nil, unixNanos(at))
+	expiryKey := expiryKey(name, key)
+	if err := self.put(keysDB, expiryKey, deadline, 0); err != nil {
+		return err
+	}
+	return self.put(deadlinesDB, append(deadline, expiryKey...), nil, 0)
+}
+
+// Persist removes the key's expiry, if it has one. If the key doesn't
+// exist (or has already expired), the error matches NotFound.
+func (self *ReadWriteTxn) Persist(db DBRef, key []byte) error {
+	if _, err := self.Get(db, key); err != nil {
+		return err
+	}
+	return self.clearExpiry(db, key)
+}
+
+// ExpiresAt returns when the key expires. found is false if the key
+// has no expiry (or expiry is not enabled for the database).
+func (self *ReadOnlyTxn) ExpiresAt(db DBRef, key []byte) (at time.Time, found bool, err error) {
+	name, _, keysDB, ok := self.expiry.lookup(db)
+	if !ok {
+		return at, false, nil
+	}
+	deadline, found, err := self.deadline(keysDB, expiryKey(name, key))
+	if !found || err != nil {
+		return at, false, err
+	}
+	return time.Unix(0, int64(deadline)), true, nil
+}
+
+// SweepExpired runs an Update which looks at up to max expiries, soonest
+// deadline first, deletes those keys which have expired, and returns
+// how many it deleted. Bounding each Update keeps it from growing too
+// large (see TxnFull), and from holding up other Updates for too long.
+//
+// Only keys of databases for which EnableExpiry has been called are
+// swept: the expiries of other databases are looked at, and count
+// towards max, but are left alone. So a sweep which deletes fewer
+// than max keys may not have finished: the next sweep carries on
+// after the last expiry this one looked at, until it reaches the end,
+// or expiries which have not yet passed. Deleting an expired key
+// updates any indexes of its database, as Delete does.
+func (self *LMDBClient) SweepExpired(max int) (swept int, err error) {
+	swept, _, err = self.sweepExpired(max)
+	return swept, err
+}
+
+// As SweepExpired, also returning whether there's more to sweep.
+func (self *LMDBClient) sweepExpired(max int) (swept int, more bool, err error) {
+	if max <= 0 {
+		return 0, false, errors.New("Cannot sweep expired keys: max must be positive")
+	}
+	err = self.Update(func(txn *ReadWriteTxn) (err error) {
+		swept, more, err = txn.sweepExpired(time.Now(), max)
+		return err
+	})
+	return swept, more, err
+}
+
+func (self *ReadWriteTxn) sweepExpired(now time.Time, max int) (swept int, more bool, err error) {
+	deadlinesDB, ok := self.expiry.deadlines()
+	if !ok {
+		return 0, false, nil
+	}
+	type expiredKey struct {
+		db  DBRef
+		key []byte
+	}
+	var expired []expiredKey
+
+	cursor, err := self.newCursor(deadlinesDB)
+	if err != nil {
+		return 0, false, err
+	}
+	var key []byte
+	from := self.expiry.getSweepFrom()
+	if from == nil {
+		key, _, err = cursor.First()
+	} else if key, _, err = cursor.SeekGreaterThanOrEqualKey(from); err == nil && bytes.Equal(key, from) {
+		key, _, err = cursor.Next()
+	}
+	nowNanos := unixNanos(now)
+	visited := 0
+	var last []byte
+	for ; err == nil; key, _, err = cursor.Next() {
+		if visited == max {
+			more = true
+			break
+		}
+		if len(key) < 8 {
+			err = fmt.Errorf("Expiry deadline key of %d bytes: %w", len(key), Corrupted)
+			break
+		}
+		if binary.BigEndian.Uint64(key) > nowNanos {
+			break
+		}
+		name, dbKey, found := bytes.Cut(key[8:], []byte{0})
+		if !found {
+			err = fmt.Errorf("Expiry deadline key without a name: %w", Corrupted)
+			break
+		}
+		visited++
+		last = append(last[:0], key...)
+		if db, ok := self.expiry.byName(string(name)); ok {
+			expired = append(expired, expiredKey{db: db, key: append([]byte(nil), dbKey...)})
+		}
+	}
+	cursor.Close()
+	if err != nil && !errors.Is(err, NotFound) {
+		return 0, false, err
+	}
+	// expiries before from which have since passed are left for the
+	// next sweep which starts from the beginning.
+	if more {
+		self.expiry.setSweepFrom(last)
+	} else {
+		self.expiry.setSweepFrom(nil)
+	}
+
+	for _, expiredKey := range expired {
+		// Delete removes the expiry too.
+		if err := self.Delete(expiredKey.db, expiredKey.key, nil); err != nil && !errors.Is(err, NotFound) {
+			return 0, false, err
+		}
+	}
+	return len(expired), more, nil
+}
+
+// Whether the key has an expiry which has passed. Always false if
+// expiry is not enabled for the database.
+func (self *ReadOnlyTxn) expired(db DBRef, key []byte) (bool, error) {
+	name, _, keysDB, ok := self.expiry.lookup(db)
+	if !ok {
+		return false, nil
+	}
+	deadline, found, err := self.deadline(keysDB, expiryKey(name, key))
+	return found && deadline <= unixNanos(time.Now()), err
+}
+
+func (self *ReadOnlyTxn) deadline(keysDB DBRef, expiryKey []byte) (deadline uint64, found bool, err error) {
+	val, err := self.get(keysDB, expiryKey)
+	if errors.Is(err, NotFound) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	if len(val) != 8 {
+		return 0, false, fmt.Errorf("Expiry deadline of %d bytes: %w", len(val), Corrupted)
+	}
+	return binary.BigEndian.Uint64(val), true, nil
+}
+
+// Removes the key's expiry, if it has one.
+func (self *ReadWriteTxn) clearExpiry(db DBRef, key []byte) error {
+	name, deadlinesDB, keysDB, ok := self.expiry.lookup(db)
+	if !ok {
+		return nil
+	}
+	expiryKey := expiryKey(name, key)
+	deadline, found, err := self.deadline(keysDB, expiryKey)
+	if !found || err != nil {
+		return err
+	}
+	if err = self.delete(keysDB, expiryKey, nil); err != nil {
+		return err
+	}
+	return self.delete(deadlinesDB, append(binary.BigEndian.AppendUint64(nil, deadline), expiryKey...), nil)
+}
+
+func expiryKey(name string, key []byte) []byte {
+	expiryKey := make([]byte, 0, len(name)+1+len(key))
+	return append(append(append(expiryKey, name...), 0), key...)
+}
+
+// Times before 1970 are treated as 1970: in the past either way.
+func unixNanos(at time.Time) uint64 {
+	if nanos := at.UnixNano(); nanos > 0 {
+		return uint64(nanos)
+	}
+	return 0
+}
+
+// If the cursor skips expired keys, and the key it has moved to has
+// expired, carry on moving in the same direction. Ops which don't
+// move in a direction find nothing.
+func (self *ReadOnlyCursor) skipExpired(opName string, op cursorOp, key, val []byte, err error) ([]byte, []byte, error) {
+	if err != nil || self.expiry == nil {
+		return key, val, err
+	}
+	for {
+		expired, err := self.expiry.expired(self.db, key)
+		if err != nil {
+			return nil, nil, err
+		} else if !expired {
+			return key, val, nil
+		}
+		switch op {
+		case first, next, setRange:
+			op = next
+		case last, prev:
+			op = prev
+		case nextNoDup, prevNoDup:
+		default:
+			return nil, nil, self.opError(opName, key, NotFound)
+		}
+		if key, val, err = self.move0(opName, op); err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// The databases for which expiry is enabled.
+type expiryRegistry struct {
+	// non-zero once any database is enabled, so that checks are cheap
+	// until then.
+	inUse       uint32
+	lock        sync.RWMutex
+	names       map[DBRef]string
+	dbs         map[string]DBRef
+	deadlinesDB DBRef
+	keysDB      DBRef
+	// where the next sweep carries on from; nil to start from the
+	// soonest deadline.
+	sweepFrom []byte
+}
+
+func newExpiryRegistry() *expiryRegistry {
+	return &expiryRegistry{names: make(map[DBRef]string), dbs: make(map[string]DBRef)}
+}
+
+func (self *expiryRegistry) enable(db DBRef, name string, deadlinesDB, keysDB DBRef) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.names[db] = name
+	self.dbs[name] = db
+	self.deadlinesDB, self.keysDB = deadlinesDB, keysDB
+	atomic.StoreUint32(&self.inUse, 1)
+}
+
+func (self *expiryRegistry) enabled(db DBRef) bool {
+	_, _, _, ok := self.lookup(db)
+	return ok
+}
+
+func (self *expiryRegistry) lookup(db DBRef) (name string, deadlinesDB, keysDB DBRef, ok bool) {
+	if self == nil || atomic.LoadUint32(&self.inUse) == 0 {
+		return "", 0, 0, false
+	}
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	name, ok = self.names[db]
+	return name, self.deadlinesDB, self.keysDB, ok
+}
+
+func (self *expiryRegistry) byName(name string) (DBRef, bool) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	db, ok := self.dbs[name]
+	return db, ok
+}
+
+func (self *expiryRegistry) deadlines() (DBRef, bool) {
+	if self == nil || atomic.LoadUint32(&self.inUse) == 0 {
+		return 0, false
+	}
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.deadlinesDB, true
+}
+
+func (self *expiryRegistry) getSweepFrom() []byte {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.sweepFrom
+}
+
+func (self *expiryRegistry) setSweepFrom(from []byte) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.sweepFrom = from
+}
+
+// Once a Drop has committed, the dropped database no longer expires.
+func (self *expiryRegistry) dropped(db DBRef) {
+	if self == nil {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if name, found := self.names[db]; found {
+		delete(self.names, db)
+		delete(self.dbs, name)
+	}
+}
+
+// Runs SweepExpired every interval, repeating straight away whilst
+// there's more to sweep.
+type expirySweeper struct {
+	client    *LMDBClient
+	log       zerolog.Logger
+	interval  time.Duration
+	batchSize int
+
+	lock    sync.Mutex
+	timer   *time.Timer
+	stopped bool
+}
+
+func newExpirySweeper(client *LMDBClient, log zerolog.Logger, options *Options) *expirySweeper {
+	if options.ExpirySweepInterval <= 0 {
+		return nil
+	}
+	sweeper := &expirySweeper{
+		client:    client,
+		log:       log,
+		interval:  options.ExpirySweepInterval,
+		batchSize: int(options.ExpirySweepBatchSize),
+	}
+	sweeper.schedule()
+	return sweeper
+}
+
+func (self *expirySweeper) schedule() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.stopped {
+		self.timer = time.AfterFunc(self.interval, self.sweep)
+	}
+}
+
+func (self *expirySweeper) sweep() {
+	total := 0
+	for {
+		swept, more, err := self.client.sweepExpired(self.batchSize)
+		total += swept
+		if errors.Is(err, ErrClosed) || errors.Is(err, errTerminated) {
+			return
+		} else if err != nil {
+			self.log.Error().Err(err).Msg("sweeping expired keys")
+			break
+		} else if !more {
+			break
+		}
+	}
+	if total > 0 {
+		self.log.Debug().Int("swept", total).Msg("expired keys swept")
+	}
+	self.schedule()
+}
+
+func (self *expirySweeper) stop() {
+	if self == nil {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.stopped = true
+	if self.timer != nil {
+		self.timer.Stop()
+	}
+}
@@ -0,0 +1,368 @@
+package golmdb_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"wellquite.org/golmdb"
+)
+
+func TestExpiry(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	defer client.TerminateSync()
+
+	sessions, err := createDBRef(client, "sessions", 0)
+	is.NoErr(err)
+	is.NoErr(client.EnableExpiry(sessions))
+
+	past := time.Now().Add(-time.Second)
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		if err := txn.PutWithTTL(sessions, []byte("a"), []byte("alive"), time.Hour, 0); err != nil {
+			return err
+		}
+		if err := txn.Put(sessions, []byte("b"), []byte("expired"), 0); err != nil {
+			return err
+		}
+		if err := txn.ExpireAt(sessions, []byte("b"), past); err != nil {
+			return err
+		}
+		if err := txn.Put(sessions, []byte("c"), []byte("forever"), 0); err != nil {
+			return err
+		}
+		err := txn.ExpireAt(sessions, []byte("missing"), past)
+		is.True(errors.Is(err, golmdb.NotFound))
+		return nil
+	})
+	is.NoErr(err)
+
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		val, err := txn.Get(sessions, []byte("a"))
+		is.NoErr(err)
+		is.Equal(string(val), "alive")
+		_, err = txn.Get(sessions, []byte("b"))
+		is.True(errors.Is(err, golmdb.NotFound))
+
+		at, found, err := txn.ExpiresAt(sessions, []byte("a"))
+		is.NoErr(err)
+		is.True(found)
+		is.True(at.After(time.Now()))
+		_, found, err = txn.ExpiresAt(sessions, []byte("c"))
+		is.NoErr(err)
+		is.True(!found)
+
+		cursor, err := txn.NewCursor(sessions)
+		is.NoErr(err)
+		defer cursor.Close()
+		var keys []string
+		key, _, err := cursor.First()
+		for ; err == nil; key, _, err = cursor.Next() {
+			keys = append(keys, string(key))
+		}
+		is.True(errors.Is(err, golmdb.NotFound))
+		is.Equal(keys, []string{"a", "c"})
+
+		key, _, err = cursor.SeekGreaterThanOrEqualKey([]byte("b"))
+		is.NoErr(err)
+		is.Equal(string(key), "c")
+		key, _, err = cursor.Prev()
+		is.NoErr(err)
+		is.Equal(string(key), "a")
+		_, err = cursor.SeekExactKey([]byte("b"))
+		is.True(errors.Is(err, golmdb.NotFound))
+		return nil
+	})
+	is.NoErr(err)
+
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		// an expired key doesn't block NoOverwrite, and Put removes
+		// expiries.
+		if err := txn.Put(sessions, []byte("b"), []byte("again"), golmdb.NoOverwrite); err != nil {
+			return err
+		}
+		if err := txn.Put(sessions, []byte("a"), []byte("kept"), 0); err != nil {
+			return err
+		}
+		for _, key := range []string{"a", "b"} {
+			_, found, err := txn.ExpiresAt(sessions, []byte(key))
+			is.NoErr(err)
+			is.True(!found)
+		}
+		return nil
+	})
+	is.NoErr(err)
+}
+
+func TestExpirySweep(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	defer client.TerminateSync()
+
+	sessions, err := createDBRef(client, "sessions", 0)
+	is.NoErr(err)
+	is.NoErr(client.EnableExpiry(sessions))
+	// an index keeps pointing at expired keys until they are swept.
+	byPrefix, err := client.DeclareIndex(sessions, "sessions-by-prefix", 0, func(key, val []byte) [][]byte {
+		return [][]byte{key[:1]}
+	})
+	is.NoErr(err)
+
+	past := time.Now().Add(-time.Second)
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		for idx := 0; idx < 25; idx++ {
+			key := []byte(fmt.Sprintf("x%02d", idx))
+			if err := txn.Put(sessions, key, key, 0); err != nil {
+				return err
+			}
+			if err := txn.ExpireAt(sessions, key, past); err != nil {
+				return err
+			}
+		}
+		return txn.PutWithTTL(sessions, []byte("y"), []byte("y"), time.Hour, 0)
+	})
+	is.NoErr(err)
+
+	for _, expected := range []int{10, 10, 5, 0} {
+		swept, err := client.SweepExpired(10)
+		is.NoErr(err)
+		is.Equal(swept, expected)
+	}
+
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		primaryKeys, err := byPrefix.Lookup(txn, []byte("x"))
+		is.NoErr(err)
+		is.Equal(len(primaryKeys), 0)
+		_, err = txn.Get(sessions, []byte("y"))
+		is.NoErr(err)
+		return byPrefix.Verify(txn)
+	})
+	is.NoErr(err)
+}
+
+func TestExpirySweeper(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	dir, err := os.MkdirTemp("", "golmdb")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	client, err := golmdb.Open(dir, golmdb.Options{
+		Log:                  log,
+		NumDBs:               4,
+		ExpirySweepInterval:  5 * time.Millisecond,
+		ExpirySweepBatchSize: 3,
+	})
+	is.NoErr(err)
+	defer client.TerminateSync()
+
+	sessions, err := createDBRef(client, "sessions", 0)
+	is.NoErr(err)
+	is.NoErr(client.EnableExpiry(sessions))
+	byPrefix, err := client.DeclareIndex(sessions, "sessions-by-prefix", 0, func(key, val []byte) [][]byte {
+		return [][]byte{key[:1]}
+	})
+	is.NoErr(err)
+
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		for idx := 0; idx < 10; idx++ {
+			key := []byte(fmt.Sprintf("x%02d", idx))
+			if err := txn.PutWithTTL(sessions, key, key, time.Millisecond, 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	is.NoErr(err)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var remaining int
+		err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+			primaryKeys, err := byPrefix.Lookup(txn, []byte("x"))
+			remaining = len(primaryKeys)
+			return err
+		})
+		is.NoErr(err)
+		if remaining == 0 {
+			break
+		}
+		is.True(time.Now().Before(deadline)) // sweeper never finished
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestExpiryInvalid(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	defer client.TerminateSync()
+
+	dupSort, err := createDBRef(client, "dupsort", golmdb.DupSort)
+	is.NoErr(err)
+	is.True(client.EnableExpiry(dupSort) != nil)
+
+	plain, err := createDBRef(client, "plain", 0)
+	is.NoErr(err)
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		if err := txn.Put(plain, []byte("k"), []byte("v"), 0); err != nil {
+			return err
+		}
+		// expiry hasn't been enabled for plain.
+		is.True(txn.ExpireAt(plain, []byte("k"), time.Now()) != nil)
+		is.True(txn.PutWithTTL(plain, []byte("k"), []byte("v"), 0, 0) != nil)
+		return nil
+	})
+	is.NoErr(err)
+
+	_, err = golmdb.Open(dir, golmdb.Options{Flags: golmdb.ReadOnly, ExpirySweepInterval: time.Second})
+	is.True(err != nil)
+}
+
+func TestExpirySweepSkipsOtherDatabases(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	others, err := createDBRef(client, "others", 0)
+	is.NoErr(err)
+	sessions, err := createDBRef(client, "sessions", 0)
+	is.NoErr(err)
+	is.NoErr(client.EnableExpiry(others))
+	is.NoErr(client.EnableExpiry(sessions))
+
+	// the expiries of others all come before those of sessions.
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		for idx := 0; idx < 15; idx++ {
+			key := []byte(fmt.Sprintf("o%02d", idx))
+			if err := txn.Put(others, key, key, 0); err != nil {
+				return err
+			}
+			if err := txn.ExpireAt(others, key, time.Now().Add(-2*time.Second)); err != nil {
+				return err
+			}
+		}
+		for idx := 0; idx < 5; idx++ {
+			key := []byte(fmt.Sprintf("s%02d", idx))
+			if err := txn.Put(sessions, key, key, 0); err != nil {
+				return err
+			}
+			if err := txn.ExpireAt(sessions, key, time.Now().Add(-time.Second)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	is.NoErr(err)
+	client.TerminateSync()
+
+	// a program which only knows about sessions.
+	client, err = golmdb.Open(dir, golmdb.Options{Log: log, NumDBs: 4})
+	is.NoErr(err)
+	defer client.TerminateSync()
+	sessions, err = createDBRef(client, "sessions", 0)
+	is.NoErr(err)
+	is.NoErr(client.EnableExpiry(sessions))
+
+	// each sweep looks at no more than 10 expiries, and carries on
+	// from where the last left off.
+	for _, expected := range []int{0, 5, 0} {
+		swept, err := client.SweepExpired(10)
+		is.NoErr(err)
+		is.Equal(swept, expected)
+	}
+
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		_, err := txn.Get(sessions, []byte("s00"))
+		is.True(errors.Is(err, golmdb.NotFound))
+		others, err := txn.DBRef("others", 0)
+		is.NoErr(err)
+		_, err = txn.Get(others, []byte("o00"))
+		is.NoErr(err)
+		return nil
+	})
+	is.NoErr(err)
+}
+
+func TestExpiryReadOnly(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	sessions, err := createDBRef(client, "sessions", 0)
+	is.NoErr(err)
+	is.NoErr(client.EnableExpiry(sessions))
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		if err := txn.PutWithTTL(sessions, []byte("a"), []byte("alive"), time.Hour, 0); err != nil {
+			return err
+		}
+		if err := txn.Put(sessions, []byte("b"), []byte("expired"), 0); err != nil {
+			return err
+		}
+		return txn.ExpireAt(sessions, []byte("b"), time.Now().Add(-time.Second))
+	})
+	is.NoErr(err)
+	client.TerminateSync()
+
+	client, err = golmdb.Open(dir, golmdb.Options{Log: log, NumDBs: 4, Flags: golmdb.ReadOnly})
+	is.NoErr(err)
+	defer client.TerminateSync()
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) (err error) {
+		sessions, err = txn.DBRef("sessions", 0)
+		return err
+	})
+	is.NoErr(err)
+	is.NoErr(client.EnableExpiry(sessions))
+
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		sessions, err := txn.DBRef("sessions", 0)
+		if err != nil {
+			return err
+		}
+		_, err = txn.Get(sessions, []byte("a"))
+		is.NoErr(err)
+		_, err = txn.Get(sessions, []byte("b"))
+		is.True(errors.Is(err, golmdb.NotFound))
+
+		cursor, err := txn.NewCursor(sessions)
+		is.NoErr(err)
+		defer cursor.Close()
+		var keys []string
+		key, _, err := cursor.First()
+		for ; err == nil; key, _, err = cursor.Next() {
+			keys = append(keys, string(key))
+		}
+		is.True(errors.Is(err, golmdb.NotFound))
+		is.Equal(keys, []string{"a"})
+		return nil
+	})
+	is.NoErr(err)
+}
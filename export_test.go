@@ -0,0 +1,10 @@
+package golmdb
+
+// Hooks for the tests in golmdb_test.
+
+// SetRemapHook makes every resize of the client's map call hook
+// first, and fail with its error, if any, as if mmap had failed. nil
+// removes the hook. Only call this whilst the client is idle.
+func SetRemapHook(client *LMDBClient, hook func(size uint64) error) {
+	client.environment.remapHook = hook
+}
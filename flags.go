@@ -151,6 +151,9 @@ type LMDBError C.int
 // expect to deal with in application code. The rest of them probably
 // indicate something has gone terribly wrong.
 //
+// Errors from transactions and cursors are wrapped in an OpError, so
+// test for these with errors.Is, not ==.
+//
 // See
 // http://www.lmdb.tech/doc/group__errors.html
 const (
@@ -9,6 +9,9 @@
  * the cgo contract and do not copy go pointers into other go
  * pointers. Those areas, copyright Matthew Sackman.
  */
+#include <errno.h>
+#include <stdlib.h>
+#include <string.h>
 #include <lmdb.h>
 #include "golmdb.h"
 
@@ -68,3 +71,41 @@ int golmdb_mdb_cursor_put(MDB_cursor *cur, char *kdata, size_t kn, char *vdata,
   GOLMDB_SET_VAL(&val, vn, vdata);
   return mdb_cursor_put(cur, &key, &val, flags);
 }
+
+typedef struct golmdb_buf {
+  char *data;
+  size_t len;
+  size_t cap;
+} golmdb_buf;
+
+static int golmdb_buf_append(const char *msg, void *ctx) {
+  golmdb_buf *buf = (golmdb_buf *)ctx;
+  size_t n = strlen(msg);
+  if (buf->len + n + 1 > buf->cap) {
+    size_t cap = (buf->cap == 0) ? 256 : buf->cap;
+    while (buf->len + n + 1 > cap) {
+      cap *= 2;
+    }
+    char *data = realloc(buf->data, cap);
+    if (data == NULL) {
+      return -1;
+    }
+    buf->data = data;
+    buf->cap = cap;
+  }
+  memcpy(buf->data + buf->len, msg, n + 1);
+  buf->len += n;
+  return 0;
+}
+
+int golmdb_mdb_reader_list(MDB_env *env, char **out, size_t *outLen) {
+  golmdb_buf buf = {NULL, 0, 0};
+  int rc = mdb_reader_list(env, golmdb_buf_append, &buf);
+  if (rc < 0) {
+    free(buf.data);
+    return ENOMEM;
+  }
+  *out = buf.data;
+  *outLen = buf.len;
+  return MDB_SUCCESS;
+}
@@ -31,4 +31,8 @@ int golmdb_mdb_cursor_get1(MDB_cursor *cur, char *kdata, size_t kn, MDB_val *key
 int golmdb_mdb_cursor_get2(MDB_cursor *cur, char *kdata, size_t kn, char *vdata, size_t vn, MDB_val *val, MDB_cursor_op op);
 int golmdb_mdb_cursor_put(MDB_cursor *cur, char *kdata, size_t kn, char *vdata, size_t vn, unsigned int flags);
 
+/* Collects the output of mdb_reader_list into a single malloc'd
+ * string, which the caller must free. */
+int golmdb_mdb_reader_list(MDB_env *env, char **out, size_t *outLen);
+
 #endif
@@ -9,6 +9,8 @@ import (
 	"math/rand"
 	"os"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"unsafe"
 
@@ -81,6 +83,73 @@ func TestOpenClose(t *testing.T) {
 	client.TerminateSync()
 }
 
+func TestUpdatePanic(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 8)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	defer client.TerminateSync()
+
+	dbRef, err := createDBRef(client, t.Name(), 0)
+	is.NoErr(err)
+
+	// panic in one of a batch of Updates: only that one should fail.
+	boom := errors.New("boom")
+	const panicker = 5
+	errs := make([]error, 16)
+	var wg sync.WaitGroup
+	for idx := range errs {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			key := []byte{byte(idx)}
+			errs[idx] = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+				if err := txn.Put(dbRef, key, key, 0); err != nil {
+					return err
+				}
+				if idx == panicker {
+					panic(boom)
+				}
+				return nil
+			})
+		}(idx)
+	}
+	wg.Wait()
+
+	for idx, err := range errs {
+		if idx != panicker {
+			is.NoErr(err)
+			continue
+		}
+		var panicErr *golmdb.PanicError
+		is.True(errors.As(err, &panicErr))
+		is.True(errors.Is(err, boom))
+		is.True(strings.Contains(string(panicErr.Stack), "TestUpdatePanic"))
+	}
+
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		for idx := range errs {
+			_, err := txn.Get(dbRef, []byte{byte(idx)})
+			if idx == panicker {
+				is.True(errors.Is(err, golmdb.NotFound))
+			} else {
+				is.NoErr(err)
+			}
+		}
+		return nil
+	})
+	is.NoErr(err)
+
+	// and the actor is still alive.
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		return txn.Put(dbRef, []byte{panicker}, []byte{panicker}, 0)
+	})
+	is.NoErr(err)
+}
+
 func TestDBRef(t *testing.T) {
 	SetGlobalLogLevelDebug()
 	log := NewTestLogger(t)
@@ -95,7 +164,7 @@ func TestDBRef(t *testing.T) {
 		_, err = txn.DBRef(t.Name(), 0) // should error because no Create flag
 		return err
 	})
-	is.True(err == golmdb.NotFound)
+	is.True(errors.Is(err, golmdb.NotFound))
 
 	dbRef1, err := createDBRef(client, t.Name(), 0) // will exist after this
 	is.NoErr(err)
@@ -176,7 +245,7 @@ func TestEmptyDrop(t *testing.T) {
 		}
 		if _, err := txn.Get(dbRef, key); err == nil {
 			return fmt.Errorf("Key-value pair still exists after emptying db.")
-		} else if err == golmdb.NotFound {
+		} else if errors.Is(err, golmdb.NotFound) {
 			return nil
 		} else {
 			return err
@@ -192,7 +261,7 @@ func TestEmptyDrop(t *testing.T) {
 		}
 		if _, err := txn.Get(dbRef, key); err == nil {
 			return fmt.Errorf("Key-value pair still exists after emptying db.")
-		} else if err != golmdb.NotFound {
+		} else if !errors.Is(err, golmdb.NotFound) {
 			return err
 		}
 		if err = txn.Drop(dbRef); err != nil {
@@ -261,7 +330,7 @@ func TestWriteReadDelete(t *testing.T) {
 		binary.BigEndian.PutUint64(key, uint64(idx))
 		return txn.Put(dbRef, key, key, golmdb.NoOverwrite)
 	})
-	is.True(err == golmdb.KeyExist)
+	is.True(errors.Is(err, golmdb.KeyExist))
 
 	val := make([]byte, 8)
 	// rewrite them all
@@ -320,7 +389,7 @@ func TestWriteReadDelete(t *testing.T) {
 			val, err := txn.Get(dbRef, key)
 
 			if idx%2 == 0 { // should be deleted
-				if err == golmdb.NotFound {
+				if errors.Is(err, golmdb.NotFound) {
 					err = nil
 					continue
 				} else {
@@ -363,7 +432,7 @@ func TestWriteReadDelete(t *testing.T) {
 			val, err := txn.Get(dbRef, key)
 
 			if idx%2 == 0 { // should be deleted
-				if err == golmdb.NotFound {
+				if errors.Is(err, golmdb.NotFound) {
 					err = nil
 					continue
 				} else {
@@ -401,7 +470,7 @@ func expectCursor(fun func() (key, val []byte, err error), expectedKeyNum, expec
 
 	gotKey, gotVal, gotErr := fun()
 
-	if expectedErr != gotErr {
+	if !errors.Is(gotErr, expectedErr) {
 		return fmt.Errorf("Expected error %v but got %v", expectedErr, gotErr)
 	}
 	if gotErr != nil {
@@ -459,7 +528,7 @@ func TestCursor(t *testing.T) {
 			}
 			return err
 		})
-		is.True(err == golmdb.NotFound)
+		is.True(errors.Is(err, golmdb.NotFound))
 	}
 
 	// write some key-value pairs
@@ -573,7 +642,7 @@ func TestCursor(t *testing.T) {
 		val, err = cursor.SeekExactKey(key)
 		if val != nil {
 			return errors.New("Expected nil val")
-		} else if err != golmdb.NotFound {
+		} else if !errors.Is(err, golmdb.NotFound) {
 			return fmt.Errorf("Expected NotFound err. Got %v", err)
 		} else {
 			err = nil
@@ -585,7 +654,7 @@ func TestCursor(t *testing.T) {
 			return errors.New("Expected nil val")
 		} else if keyOut != nil {
 			return errors.New("Expected nil returned key")
-		} else if err != golmdb.NotFound {
+		} else if !errors.Is(err, golmdb.NotFound) {
 			return fmt.Errorf("Expected NotFound err. Got %v", err)
 		} else {
 			err = nil
@@ -714,7 +783,7 @@ func TestDupDB(t *testing.T) {
 				if err = txn.Put(dbRef, key, val, 0); err != nil {
 					return err
 				}
-				if err = txn.Put(dbRef, key, val, golmdb.NoDupData); err == golmdb.KeyExist {
+				if err = txn.Put(dbRef, key, val, golmdb.NoDupData); errors.Is(err, golmdb.KeyExist) {
 					err = nil
 				} else {
 					return fmt.Errorf("Expected KeyExist error, but got %v", err)
@@ -817,7 +886,7 @@ func TestDupDB(t *testing.T) {
 		}
 
 		_, err = cursor.SeekExactKey(key)
-		if err != golmdb.NotFound {
+		if !errors.Is(err, golmdb.NotFound) {
 			return fmt.Errorf("Wrong error: expected NotFound, got %v", err)
 		} else {
 			err = nil
@@ -860,7 +929,7 @@ func TestDupDB(t *testing.T) {
 		}
 		binary.BigEndian.PutUint64(val, 29)
 		err = cursor.SeekExactKeyAndValue(key, val)
-		if err != golmdb.NotFound {
+		if !errors.Is(err, golmdb.NotFound) {
 			return fmt.Errorf("Wrong error: expected NotFonud, got %v", err)
 		} else {
 			err = nil
@@ -881,7 +950,7 @@ func TestDupDB(t *testing.T) {
 		binary.BigEndian.PutUint64(key, 32)
 		binary.BigEndian.PutUint64(val, 0)
 		_, err = cursor.SeekGreaterThanOrEqualKeyAndValue(key, val)
-		if err != golmdb.NotFound {
+		if !errors.Is(err, golmdb.NotFound) {
 			return fmt.Errorf("Wrong error: expected NotFonud, got %v", err)
 		} else {
 			err = nil
@@ -1007,7 +1076,7 @@ func TestLexicalSort(t *testing.T) {
 
 			if !gotoLast {
 				_, _, err := cursor.SeekGreaterThanOrEqualKey(nextKeyBytes)
-				if err == golmdb.NotFound { // there is nothing after
+				if errors.Is(err, golmdb.NotFound) { // there is nothing after
 					gotoLast = true
 					err = nil
 				} else if err != nil {
@@ -1078,7 +1147,7 @@ func TestIntegerSort(t *testing.T) {
 			is.Equal(keyNum, uint64(keys[idx]))
 			idx -= 1
 		}
-		if err == golmdb.NotFound {
+		if errors.Is(err, golmdb.NotFound) {
 			err = nil
 		}
 		is.NoErr(err)
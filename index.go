@@ -0,0 +1,517 @@
+package golmdb
+
+/*
+#include <lmdb.h>
+*/
+import "C"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// An IndexFunc extracts the index keys from a key-value pair of a
+// primary database. It may return any number of index keys, including
+// none. Empty index keys, and repeats, are ignored. The returned
+// slices may alias key and val.
+//
+// An IndexFunc must be deterministic: given the same key and val, it
+// must always return the same index keys, otherwise the index cannot
+// be kept consistent when the key-value pair is later overwritten or
+// deleted.
+type IndexFunc func(key, val []byte) [][]byte
+
+// IndexFlags are used when declaring an index with DeclareIndex.
+type IndexFlag uint
+
+const (
+	// Each index key may refer to only one key of the primary
+	// database. A Put which would break this fails with a
+	// *UniqueIndexError.
+	UniqueIndex IndexFlag = 1 << iota
+)
+
+// An Index is a secondary index of a primary database: a database
+// which maps each index key (as extracted by the IndexFunc) to the
+// keys of the primary database that it was extracted from. Non-unique
+// indexes are DupSort databases.
+//
+// Once declared, every Put and Delete through ReadWriteTxn on the
+// primary database, and every ReadWriteCursor.Delete, also updates the
+// index, within the same txn. Writes by other processes, or by
+// programs that have not declared the index, do not: in those cases,
+// use Rebuild.
+type Index struct {
+	name    string
+	primary DBRef
+	db      DBRef
+	unique  bool
+	extract IndexFunc
+}
+
+// A UniqueIndexError is returned when a Put would add an index key to
+// a UniqueIndex that already refers to a different primary key. It
+// matches KeyExist (see errors.Is).
+type UniqueIndexError struct {
+	Index              string
+	IndexKey           []byte
+	PrimaryKey         []byte
+	ExistingPrimaryKey []byte
+}
+
+func (self *UniqueIndexError) Error() string {
+	return fmt.Sprintf("Unique index %q: key %q of primary key %q already refers to primary key %q",
+		self.Index, self.IndexKey, self.PrimaryKey, self.ExistingPrimaryKey)
+}
+
+func (self *UniqueIndexError) Unwrap() error {
+	return KeyExist
+}
+
+// ErrIndexInconsistent is returned (wrapped) by Index.Verify.
+var ErrIndexInconsistent = errors.New("Index is inconsistent with its primary database")
+
+// DeclareIndex declares an index on the primary database, stored in
+// the named database, which is created if necessary. The primary
+// database must not be DupSort.
+//
+// Indexes are not persistent: each program must declare its indexes
+// every time it opens the database, before it writes to the primary
+// database (including with a ReadWriteCursor opened earlier, which
+// maintains only the indexes declared when it was opened). If an index is declared on a primary database which
+// already contains data, use Index.Rebuild to populate it.
+func (self *LMDBClient) DeclareIndex(primary DBRef, name string, flags IndexFlag, extract IndexFunc) (*Index, error) {
+	if extract == nil {
+		return nil, errors.New("Cannot declare index: IndexFunc is nil")
+	}
+	index := &Index{
+		name:    name,
+		primary: primary,
+		unique:  flags&UniqueIndex != 0,
+		extract: extract,
+	}
+	err := self.Update(func(txn *ReadWriteTxn) (err error) {
+		var primaryFlags C.uint
+		if err = asError(C.mdb_dbi_flags(txn.txn, C.MDB_dbi(primary), &primaryFlags)); err != nil {
+			return txn.opError("DeclareIndex", primary, nil, err)
+		}
+		if DatabaseFlag(primaryFlags)&DupSort != 0 {
+			return fmt.Errorf("Cannot declare index %q: the primary database is DupSort", name)
+		}
+		dbFlags := Create
+		if !index.unique {
+			dbFlags |= DupSort
+		}
+		index.db, err = txn.DBRef(name, dbFlags)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	self.environment.indexes.add(index)
+	return index, nil
+}
+
+// The name of the database holding the index.
+func (self *Index) Name() string {
+	return self.name
+}
+
+// The DBRef of the database holding the index.
+func (self *Index) DBRef() DBRef {
+	return self.db
+}
+
+// Lookup returns the primary keys that the index key refers to, in
+// order. If there are none, the result is empty, and err is nil.
+//
+// The returned bytes are owned by the database, and the same rules
+// apply as for ReadOnlyTxn.Get.
+func (self *Index) Lookup(txn Txn, indexKey []byte) (primaryKeys [][]byte, err error) {
+	cursor, err := txn.readOnly().NewCursor(self.db)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	primaryKey, err := cursor.SeekExactKey(indexKey)
+	for ; err == nil; _, primaryKey, err = cursor.NextInSameKey() {
+		primaryKeys = append(primaryKeys, primaryKey)
+		if self.unique {
+			break
+		}
+	}
+	if err != nil && !errors.Is(err, NotFound) {
+		return nil, err
+	}
+	return primaryKeys, nil
+}
+
+// Get returns the first primary key that the index key refers to, and
+// its value from the primary database. If there is none, the error
+// matches NotFound. This is most useful with a UniqueIndex.
+func (self *Index) Get(txn Txn, indexKey []byte) (primaryKey, val []byte, err error) {
+	roTxn := txn.readOnly()
+	primaryKey, err = roTxn.Get(self.db, indexKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	val, err = roTxn.Get(self.primary, primaryKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return primaryKey, val, nil
+}
+
+// Scan calls fun for each entry of the index with an index key
+// greater than or equal to start, and less than end, in order of
+// index key and then primary key. A nil start means from the first
+// entry, and a nil end means to the last. val is the value from the
+// primary database. If fun returns an error, the scan stops and that
+// error is returned.
+//
+// fun must not modify the database.
+func (self *Index) Scan(txn Txn, start, end []byte, fun func(indexKey, primaryKey, val []byte) error) error {
+	roTxn := txn.readOnly()
+	cursor, err := roTxn.NewCursor(self.db)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+
+	var indexKey, primaryKey []byte
+	if start == nil {
+		indexKey, primaryKey, err = cursor.First()
+	} else {
+		indexKey, primaryKey, err = cursor.SeekGreaterThanOrEqualKey(start)
+	}
+	for ; err == nil; indexKey, primaryKey, err = cursor.Next() {
+		if end != nil && bytes.Compare(indexKey, end) >= 0 {
+			return nil
+		}
+		val, err := roTxn.Get(self.primary, primaryKey)
+		if errors.Is(err, NotFound) {
+			continue // expired, but not yet swept
+		} else if err != nil {
+			return err
+		}
+		if err = fun(indexKey, primaryKey, val); err != nil {
+			return err
+		}
+	}
+	if errors.Is(err, NotFound) {
+		return nil
+	}
+	return err
+}
+
+// Rebuild empties the index, and then repopulates it from every
+// key-value pair of the primary database.
+func (self *Index) Rebuild(txn *ReadWriteTxn) error {
+	if err := txn.Empty(self.db); err != nil {
+		return err
+	}
+	return self.walkPrimary(&txn.ReadOnlyTxn, func(primaryKey []byte, indexKeys [][]byte) error {
+		for _, indexKey := range indexKeys {
+			if err := txn.addIndexEntry(self, indexKey, primaryKey); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Verify checks that the index contains exactly the entries that the
+// IndexFunc extracts from the primary database. If not, the error
+// wraps ErrIndexInconsistent.
+func (self *Index) Verify(txn Txn) error {
+	roTxn := txn.readOnly()
+	expected := uint64(0)
+	err := self.walkPrimary(roTxn, func(primaryKey []byte, indexKeys [][]byte) error {
+		for _, indexKey := range indexKeys {
+			found, err := self.hasEntry(roTxn, indexKey, primaryKey)
+			if err != nil {
+				return err
+			}
+			if !found {
+				return fmt.Errorf("Index %q: no entry for key %q of primary key %q: %w", self.name, indexKey, primaryKey, ErrIndexInconsistent)
+			}
+			expected++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	count, err := roTxn.walkDB(self.db, nil)
+	if err != nil {
+		return err
+	}
+	if count != expected {
+		return fmt.Errorf("Index %q: found %d entries but expected %d: %w", self.name, count, expected, ErrIndexInconsistent)
+	}
+	return nil
+}
+
+func (self *Index) hasEntry(txn *ReadOnlyTxn, indexKey, primaryKey []byte) (bool, error) {
+	var err error
+	if self.unique {
+		var existing []byte
+		existing, err = txn.Get(self.db, indexKey)
+		if err == nil {
+			return bytes.Equal(existing, primaryKey), nil
+		}
+	} else {
+		var cursor *ReadOnlyCursor
+		cursor, err = txn.NewCursor(self.db)
+		if err != nil {
+			return false, err
+		}
+		defer cursor.Close()
+		err = cursor.SeekExactKeyAndValue(indexKey, primaryKey)
+	}
+	if errors.Is(err, NotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Calls fun with (copies of) each key of the primary database, and
+// the index keys extracted from it. fun may modify the database.
+func (self *Index) walkPrimary(txn *ReadOnlyTxn, fun func(primaryKey []byte, indexKeys [][]byte) error) error {
+	// expired keys are still indexed until they are swept.
+	cursor, err := txn.newCursor(self.primary)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+
+	key, val, err := cursor.First()
+	for ; err == nil; key, val, err = cursor.Next() {
+		if err = fun(append([]byte(nil), key...), self.indexKeys(key, val)); err != nil {
+			return err
+		}
+	}
+	if errors.Is(err, NotFound) {
+		return nil
+	}
+	return err
+}
+
+// Runs the IndexFunc, and returns copies of the non-empty, distinct
+// index keys.
+func (self *Index) indexKeys(key, val []byte) [][]byte {
+	extracted := self.extract(key, val)
+	indexKeys := make([][]byte, 0, len(extracted))
+	for _, indexKey := range extracted {
+		if len(indexKey) != 0 && !containsKey(indexKeys, indexKey) {
+			indexKeys = append(indexKeys, append([]byte(nil), indexKey...))
+		}
+	}
+	return indexKeys
+}
+
+func containsKey(keys [][]byte, key []byte) bool {
+	for _, candidate := range keys {
+		if bytes.Equal(candidate, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// The index keys (of one Index) to remove and to add for a Put or
+// Delete of a key of the primary database.
+type indexChange struct {
+	index   *Index
+	removed [][]byte
+	added   [][]byte
+}
+
+// Works out the changes to every index, given the old and new values
+// of the key. The old value must be read before the primary database
+// is modified, as LMDB may then reuse its memory.
+func indexChanges(indexes []*Index, key, oldVal []byte, oldFound bool, newVal []byte, newFound bool) []indexChange {
+	changes := make([]indexChange, len(indexes))
+	for idx, index := range indexes {
+		var oldKeys, newKeys [][]byte
+		if oldFound {
+			oldKeys = index.indexKeys(key, oldVal)
+		}
+		if newFound {
+			newKeys = index.indexKeys(key, newVal)
+		}
+		change := indexChange{index: index}
+		for _, indexKey := range oldKeys {
+			if !containsKey(newKeys, indexKey) {
+				change.removed = append(change.removed, indexKey)
+			}
+		}
+		for _, indexKey := range newKeys {
+			if !containsKey(oldKeys, indexKey) {
+				change.added = append(change.added, indexKey)
+			}
+		}
+		changes[idx] = change
+	}
+	return changes
+}
+
+func (self *ReadWriteTxn) applyIndexChanges(changes []indexChange, primaryKey []byte) error {
+	for _, change := range changes {
+		for _, indexKey := range change.removed {
+			if err := self.removeIndexEntry(change.index, indexKey, primaryKey); err != nil {
+				return err
+			}
+		}
+		for _, indexKey := range change.added {
+			if err := self.addIndexEntry(change.index, indexKey, primaryKey); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (self *ReadWriteTxn) putIndexed(indexes []*Index, db DBRef, key, val []byte, flags PutFlag) error {
+	// key may be memory owned by LMDB (e.g. from a cursor), and it is
+	// needed after the Put.
+	key = append([]byte(nil), key...)
+	return self.nested("Put", db, key, func() error {
+		oldVal, err := self.get(db, key)
+		if err != nil && !errors.Is(err, NotFound) {
+			return err
+		}
+		changes := indexChanges(indexes, key, oldVal, err == nil, val, true)
+		if err = self.put(db, key, val, flags); err != nil {
+			return err
+		}
+		return self.applyIndexChanges(changes, key)
+	})
+}
+
+func (self *ReadWriteTxn) deleteIndexed(indexes []*Index, db DBRef, key []byte) error {
+	key = append([]byte(nil), key...)
+	return self.nested("Delete", db, key, func() error {
+		oldVal, err := self.get(db, key)
+		if err != nil {
+			return err
+		}
+		changes := indexChanges(indexes, key, oldVal, true, nil, false)
+		if err = self.delete(db, key, nil); err != nil {
+			return err
+		}
+		return self.applyIndexChanges(changes, key)
+	})
+}
+
+func (self *ReadWriteTxn) addIndexEntry(index *Index, indexKey, primaryKey []byte) error {
+	if !index.unique {
+		return self.put(index.db, indexKey, primaryKey, 0)
+	}
+	err := self.put(index.db, indexKey, primaryKey, NoOverwrite)
+	if errors.Is(err, KeyExist) {
+		existing, getErr := self.Get(index.db, indexKey)
+		if getErr != nil {
+			return getErr
+		}
+		return &UniqueIndexError{
+			Index:              index.name,
+			IndexKey:           append([]byte(nil), indexKey...),
+			PrimaryKey:         append([]byte(nil), primaryKey...),
+			ExistingPrimaryKey: append([]byte(nil), existing...),
+		}
+	}
+	return err
+}
+
+func (self *ReadWriteTxn) removeIndexEntry(index *Index, indexKey, primaryKey []byte) error {
+	if index.unique {
+		return self.delete(index.db, indexKey, nil)
+	}
+	return self.delete(index.db, indexKey, primaryKey)
+}
+
+// Runs fun within a child txn, so that a Put or Delete and its index
+// updates either all happen, or none do.
+func (self *ReadWriteTxn) nested(op string, db DBRef, key []byte, fun func() error) error {
+	var child *C.MDB_txn
+	if err := asError(C.mdb_txn_begin(C.mdb_txn_env(self.txn), self.txn, 0, &child)); err != nil {
+		return self.opError(op, db, key, err)
+	}
+	parent := self.txn
+	self.txn = child
+	// if fun panics, aborting the parent txn also aborts the child.
+	defer func() { self.txn = parent }()
+	// fun may apply pending merges within the child: should the child
+	// abort, they must be pending again.
+	mergesSnapshot := self.merges.snapshot()
+
+	if err := fun(); err != nil {
+		C.mdb_txn_abort(child)
+		self.merges.restore(mergesSnapshot)
+		return err
+	}
+	return self.opError(op, db, key, asError(C.mdb_txn_commit(child)))
+}
+
+// The indexes declared on each primary database. Indexes are declared
+// by clients, and used by the actor.
+type indexRegistry struct {
+	lock      sync.RWMutex
+	byPrimary map[DBRef][]*Index
+}
+
+func newIndexRegistry() *indexRegistry {
+	return &indexRegistry{byPrimary: make(map[DBRef][]*Index)}
+}
+
+func (self *indexRegistry) add(index *Index) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	indexes := self.byPrimary[index.primary]
+	for idx, existing := range indexes {
+		if existing.db == index.db {
+			// redeclared: replace it rather than maintain it twice.
+			updated := append([]*Index(nil), indexes...)
+			updated[idx] = index
+			self.byPrimary[index.primary] = updated
+			return
+		}
+	}
+	self.byPrimary[index.primary] = append(indexes[:len(indexes):len(indexes)], index)
+}
+
+func (self *indexRegistry) get(primary DBRef) []*Index {
+	if self == nil {
+		return nil
+	}
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.byPrimary[primary]
+}
+
+// Once a Drop has committed, the dropped database is neither a primary
+// database nor an index.
+func (self *indexRegistry) dropped(db DBRef) {
+	if self == nil {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.byPrimary, db)
+	for primary, indexes := range self.byPrimary {
+		var kept []*Index
+		for _, index := range indexes {
+			if index.db != db {
+				kept = append(kept, index)
+			}
+		}
+		if len(kept) == 0 {
+			delete(self.byPrimary, primary)
+		} else {
+			self.byPrimary[primary] = kept
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package golmdb_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/matryer/is"
+
+	"wellquite.org/golmdb"
+)
+
+// Values are "email|city".
+func emailOf(key, val []byte) [][]byte {
+	return [][]byte{bytes.SplitN(val, []byte("|"), 2)[0]}
+}
+
+func cityOf(key, val []byte) [][]byte {
+	parts := bytes.SplitN(val, []byte("|"), 2)
+	if len(parts) < 2 {
+		return nil
+	}
+	return [][]byte{parts[1]}
+}
+
+func TestIndex(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	defer client.TerminateSync()
+
+	users, err := createDBRef(client, "users", 0)
+	is.NoErr(err)
+	byEmail, err := client.DeclareIndex(users, "users-by-email", golmdb.UniqueIndex, emailOf)
+	is.NoErr(err)
+	byCity, err := client.DeclareIndex(users, "users-by-city", 0, cityOf)
+	is.NoErr(err)
+
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		for _, kv := range [][2]string{
+			{"u1", "ann@x|leeds"},
+			{"u2", "bob@x|york"},
+			{"u3", "cat@x|leeds"},
+			{"u4", "dan@x|bath"},
+		} {
+			if err := txn.Put(users, []byte(kv[0]), []byte(kv[1]), 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	is.NoErr(err)
+
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		primaryKey, val, err := byEmail.Get(txn, []byte("bob@x"))
+		is.NoErr(err)
+		is.Equal(string(primaryKey), "u2")
+		is.Equal(string(val), "bob@x|york")
+
+		primaryKeys, err := byCity.Lookup(txn, []byte("leeds"))
+		is.NoErr(err)
+		is.Equal(len(primaryKeys), 2)
+		is.Equal(string(primaryKeys[0]), "u1")
+		is.Equal(string(primaryKeys[1]), "u3")
+
+		primaryKeys, err = byCity.Lookup(txn, []byte("hull"))
+		is.NoErr(err)
+		is.Equal(len(primaryKeys), 0)
+
+		// cities from "c" (inclusive) to "y" (exclusive): leeds twice.
+		var scanned []string
+		err = byCity.Scan(txn, []byte("c"), []byte("y"), func(indexKey, primaryKey, val []byte) error {
+			scanned = append(scanned, string(indexKey)+"="+string(primaryKey))
+			return nil
+		})
+		is.NoErr(err)
+		is.Equal(scanned, []string{"leeds=u1", "leeds=u3"})
+
+		is.NoErr(byEmail.Verify(txn))
+		is.NoErr(byCity.Verify(txn))
+		return nil
+	})
+	is.NoErr(err)
+
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		// taking someone else's email is rejected, and changes nothing.
+		err := txn.Put(users, []byte("u4"), []byte("ann@x|hull"), 0)
+		var uniqueErr *golmdb.UniqueIndexError
+		is.True(errors.As(err, &uniqueErr))
+		is.True(errors.Is(err, golmdb.KeyExist))
+		is.Equal(string(uniqueErr.ExistingPrimaryKey), "u1")
+		val, err := txn.Get(users, []byte("u4"))
+		is.NoErr(err)
+		is.Equal(string(val), "dan@x|bath")
+
+		// moving and deleting update the indexes.
+		if err = txn.Put(users, []byte("u1"), []byte("ann@x|york"), 0); err != nil {
+			return err
+		}
+		return txn.Delete(users, []byte("u2"), nil)
+	})
+	is.NoErr(err)
+
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		primaryKeys, err := byCity.Lookup(txn, []byte("leeds"))
+		is.NoErr(err)
+		is.Equal(len(primaryKeys), 1)
+		is.Equal(string(primaryKeys[0]), "u3")
+
+		primaryKeys, err = byCity.Lookup(txn, []byte("york"))
+		is.NoErr(err)
+		is.Equal(len(primaryKeys), 1)
+		is.Equal(string(primaryKeys[0]), "u1")
+
+		_, _, err = byEmail.Get(txn, []byte("bob@x"))
+		is.True(errors.Is(err, golmdb.NotFound))
+
+		is.NoErr(byEmail.Verify(txn))
+		is.NoErr(byCity.Verify(txn))
+		return nil
+	})
+	is.NoErr(err)
+
+	// damage the index behind its back, then rebuild it.
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		if err := txn.Delete(byCity.DBRef(), []byte("bath"), []byte("u4")); err != nil {
+			return err
+		}
+		is.True(errors.Is(byCity.Verify(txn), golmdb.ErrIndexInconsistent))
+		if err := txn.Put(byCity.DBRef(), []byte("bath"), []byte("u4"), 0); err != nil {
+			return err
+		}
+		if err := txn.Put(byCity.DBRef(), []byte("nowhere"), []byte("u9"), 0); err != nil {
+			return err
+		}
+		is.True(errors.Is(byCity.Verify(txn), golmdb.ErrIndexInconsistent))
+		if err := byCity.Rebuild(txn); err != nil {
+			return err
+		}
+		return byCity.Verify(txn)
+	})
+	is.NoErr(err)
+}
+
+func TestIndexOnDupSortPrimary(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	defer client.TerminateSync()
+
+	dupSort, err := createDBRef(client, "dupsort", golmdb.DupSort)
+	is.NoErr(err)
+	_, err = client.DeclareIndex(dupSort, "dupsort-index", 0, cityOf)
+	is.True(err != nil)
+}
+
+func TestIndexCursorDelete(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	defer client.TerminateSync()
+
+	users, err := createDBRef(client, "users", 0)
+	is.NoErr(err)
+	byEmail, err := client.DeclareIndex(users, "users-by-email", golmdb.UniqueIndex, emailOf)
+	is.NoErr(err)
+	byCity, err := client.DeclareIndex(users, "users-by-city", 0, cityOf)
+	is.NoErr(err)
+
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		for _, kv := range [][2]string{
+			{"u1", "ann@x|leeds"},
+			{"u2", "bob@x|york"},
+			{"u3", "cat@x|leeds"},
+		} {
+			if err := txn.Put(users, []byte(kv[0]), []byte(kv[1]), 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	is.NoErr(err)
+
+	// delete everyone in leeds with a cursor.
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		cursor, err := txn.NewCursor(users)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close()
+		_, val, err := cursor.First()
+		for ; err == nil; _, val, err = cursor.Next() {
+			if bytes.HasSuffix(val, []byte("|leeds")) {
+				if err := cursor.Delete(0); err != nil {
+					return err
+				}
+			}
+		}
+		if !errors.Is(err, golmdb.NotFound) {
+			return err
+		}
+		return nil
+	})
+	is.NoErr(err)
+
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		primaryKeys, err := byCity.Lookup(txn, []byte("leeds"))
+		is.NoErr(err)
+		is.Equal(len(primaryKeys), 0)
+		_, _, err = byEmail.Get(txn, []byte("ann@x"))
+		is.True(errors.Is(err, golmdb.NotFound))
+		primaryKey, _, err := byEmail.Get(txn, []byte("bob@x"))
+		is.NoErr(err)
+		is.Equal(string(primaryKey), "u2")
+
+		is.NoErr(byEmail.Verify(txn))
+		is.NoErr(byCity.Verify(txn))
+		return nil
+	})
+	is.NoErr(err)
+}
@@ -0,0 +1,109 @@
+package golmdb
+
+/*
+#include <lmdb.h>
+*/
+import "C"
+import (
+	"errors"
+	"sync/atomic"
+
+	"wellquite.org/actors"
+)
+
+// When several processes share the same database, any of them may
+// grow the map. The others then get MapResized when they next begin
+// a txn, and must adopt the new size (by calling mdb_env_set_mapsize
+// with 0) before they can carry on. That can only be done whilst this
+// process has no txns running, so it's done under the write lock of
+// the resizingLock: by the actor, or for read-only clients (which
+// have no actor), by the View that discovered the resize.
+
+type adoptMapSizeMsg struct {
+	actors.MsgSyncBase
+	err error // output
+}
+
+// Adopt the map size set by another process.
+//
+// See http://www.lmdb.tech/doc/group__mdb.html#gaa2506ec8dab3d969b0e609cd82e619e5
+func (self *environment) adoptMapSize() error {
+	if err := self.setMapSize(0); err != nil {
+		return err
+	}
+	mapSize, err := self.getMapSize()
+	if err != nil {
+		return err
+	}
+	self.mapSize = mapSize
+	return nil
+}
+
+// --- Client side ---
+
+// Begins a read txn, adopting the new map size if another process has
+// resized the map. Must be called with the resizingLock read-locked.
+func (self *LMDBClient) beginReadTxn() (*C.MDB_txn, error) {
+	for {
+		txn, err := self.environment.txnBegin(true, nil)
+		if !errors.Is(err, MapResized) {
+			return txn, err
+		}
+		if err = self.adoptMapSize(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Must be called with the resizingLock read-locked; it is released
+// whilst the new map size is adopted.
+func (self *LMDBClient) adoptMapSize() error {
+	self.resizingLock.RUnlock()
+	defer self.resizingLock.RLock()
+
+	if self.environment.readOnly {
+		self.resizingLock.Lock()
+		defer self.resizingLock.Unlock()
+		return self.environment.adoptMapSize()
+	}
+
+	msg := &adoptMapSizeMsg{}
+	if self.SendSync(msg, true) {
+		return msg.err
+	} else {
+		return errTerminated
+	}
+}
+
+// --- Server side ---
+
+func (self *server) adoptMapSize() error {
+	atomic.StoreUint32(&self.resizeRequired, 1)
+	self.resizingLock.Lock()
+	defer self.resizingLock.Unlock()
+	defer atomic.StoreUint32(&self.resizeRequired, 0)
+
+	currentMapSize := self.environment.mapSize
+	if err := self.environment.adoptMapSize(); err != nil {
+		self.Log.Error().Err(err).Msg("adopting map size set by another process")
+		return err
+	}
+	if self.Log.Debug().Enabled() {
+		self.Log.Debug().Uint64("current size", currentMapSize).Uint64("new size", self.environment.mapSize).Msg("adopted map size set by another process")
+	}
+	return nil
+}
+
+// Begins a top-level write txn, adopting the new map size if another
+// process has resized the map.
+func (self *server) beginWriteTxn() (*C.MDB_txn, error) {
+	for {
+		txn, err := self.environment.txnBegin(false, nil)
+		if !errors.Is(err, MapResized) {
+			return txn, err
+		}
+		if err = self.adoptMapSize(); err != nil {
+			return nil, err
+		}
+	}
+}
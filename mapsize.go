@@ -0,0 +1,147 @@
+package golmdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrMapSizeLimit is returned (wrapped) when an Update needs the map
+// to grow, but growing it would exceed MapSizePolicy.MaxSize. Use
+// errors.Is to test for it.
+var ErrMapSizeLimit = errors.New("map size limit reached")
+
+// A MapSizePolicy controls the size of LMDB's memory map, which is the
+// upper limit on the size of the data file.
+//
+// LMDB returns MapFull when a write transaction needs more space than
+// the map currently allows. golmdb handles this automatically: the map
+// is grown and the Update transactions re-run. Each time the map is
+// grown, the new size is the current size multiplied by GrowthFactor,
+// plus GrowthIncrement, rounded up to a multiple of Alignment. Either
+// the factor or the increment (or both) can be used.
+//
+// Growing the map is not free: all Views have to be interrupted and
+// restarted, and the batch of Updates that ran out of space has to be
+// re-run. So it is worth picking an InitialSize reasonably close to
+// the size you expect the data to be, and growth settings such that
+// resizes are infrequent. Most filesystems support sparse files, so a
+// large map does not cost disk space until it is used.
+type MapSizePolicy struct {
+	// The minimum map size when opening the database. If the data file
+	// already has a larger map size, that is kept. If 0, LMDB's own
+	// default (1MB) is used for new data files.
+	InitialSize uint64
+	// Each time the map is grown, the current size is multiplied by
+	// this. Values of 1 or less disable multiplicative growth.
+	GrowthFactor float64
+	// Each time the map is grown, this many bytes are added (after
+	// multiplying by GrowthFactor).
+	GrowthIncrement uint64
+	// The map will never be grown beyond this size. If growing is
+	// necessary but would exceed this, the Update transactions that
+	// needed the space fail with an error wrapping ErrMapSizeLimit. If
+	// 0, there is no limit.
+	MaxSize uint64
+	// Map sizes are always rounded up to a multiple of this. It must
+	// be a multiple of the OS page size (os.Getpagesize()). If 0, the
+	// OS page size is used.
+	Alignment uint64
+	// After every commit, if the proportion of the map that is in use
+	// is at or above this, the map is grown straight away, rather than
+	// waiting for an Update to fail with MapFull (which requires the
+	// whole batch of Updates to be re-run). It must be less than 1. If
+	// 0, the map is only ever grown in response to MapFull.
+	ResizeThreshold float64
+}
+
+// DefaultMapSizePolicy is the policy used unless you provide your
+// own: LMDB's default initial size, growing by 50% each time once
+// the map is 90% full, with no limit.
+func DefaultMapSizePolicy() MapSizePolicy {
+	return MapSizePolicy{
+		GrowthFactor:    1.5,
+		ResizeThreshold: 0.9,
+	}
+}
+
+func (self MapSizePolicy) validate() error {
+	pageSize := uint64(os.Getpagesize())
+	if self.GrowthFactor <= 1 && self.GrowthIncrement == 0 {
+		return errors.New("Invalid MapSizePolicy: at least one of GrowthFactor (> 1) or GrowthIncrement (> 0) must be set")
+	}
+	if self.Alignment%pageSize != 0 {
+		return fmt.Errorf("Invalid MapSizePolicy: Alignment (%d) must be a multiple of the OS page size (%d)", self.Alignment, pageSize)
+	}
+	if self.ResizeThreshold < 0 || self.ResizeThreshold >= 1 {
+		return fmt.Errorf("Invalid MapSizePolicy: ResizeThreshold (%v) must be at least 0 and less than 1", self.ResizeThreshold)
+	}
+	if initialSize := self.initialSize(); self.MaxSize != 0 && initialSize > self.MaxSize {
+		return fmt.Errorf("Invalid MapSizePolicy: InitialSize (%d) is greater than MaxSize (%d)", initialSize, self.MaxSize)
+	}
+	return nil
+}
+
+func (self MapSizePolicy) alignment() uint64 {
+	if self.Alignment == 0 {
+		return uint64(os.Getpagesize())
+	}
+	return self.Alignment
+}
+
+func (self MapSizePolicy) roundUp(size uint64) uint64 {
+	alignment := self.alignment()
+	if remainder := size % alignment; remainder != 0 {
+		size = (size + alignment) - remainder
+	}
+	return size
+}
+
+// The initial map size, rounded up to the alignment.
+func (self MapSizePolicy) initialSize() uint64 {
+	if self.InitialSize == 0 {
+		return self.roundUp(defaultMapSize)
+	}
+	return self.roundUp(self.InitialSize)
+}
+
+// Calculate the size the map should grow to from its current size.
+func (self MapSizePolicy) next(current uint64) (uint64, error) {
+	size := current
+	if self.GrowthFactor > 1 {
+		size = uint64(float64(current) * self.GrowthFactor)
+	}
+	size = self.roundUp(size + self.GrowthIncrement)
+	if size <= current {
+		size = self.roundUp(current + 1)
+	}
+
+	if self.MaxSize != 0 && size > self.MaxSize {
+		// grow as far as we are allowed, if that is any growth at all.
+		alignment := self.alignment()
+		if capped := self.MaxSize - (self.MaxSize % alignment); capped > current {
+			return capped, nil
+		}
+		return 0, fmt.Errorf("cannot grow map beyond %d bytes (current size %d): %w", self.MaxSize, current, ErrMapSizeLimit)
+	}
+	return size, nil
+}
+
+// Whether the map should be grown now, given how much of it is used.
+func (self MapSizePolicy) shouldGrow(used, mapSize uint64) bool {
+	return self.ResizeThreshold > 0 && float64(used) >= self.ResizeThreshold*float64(mapSize)
+}
+
+// The map size to use once the data has been compacted down to used
+// bytes: room to grow by one step without resizing, but no smaller
+// than the initial size.
+func (self MapSizePolicy) rightSize(used uint64) uint64 {
+	size, err := self.next(self.roundUp(used))
+	if err != nil {
+		size = self.roundUp(used)
+	}
+	if initialSize := self.initialSize(); size < initialSize {
+		size = initialSize
+	}
+	return size
+}
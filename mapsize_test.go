@@ -0,0 +1,135 @@
+package golmdb_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/matryer/is"
+
+	"wellquite.org/golmdb"
+)
+
+func TestMapSizePolicyValidation(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	defer client.TerminateSync()
+
+	// no growth at all
+	is.True(client.SetMapSizePolicy(golmdb.MapSizePolicy{}) != nil)
+	// alignment not a multiple of the page size
+	is.True(client.SetMapSizePolicy(golmdb.MapSizePolicy{GrowthFactor: 2, Alignment: uint64(os.Getpagesize()) + 1}) != nil)
+	// initial size beyond the max size
+	is.True(client.SetMapSizePolicy(golmdb.MapSizePolicy{GrowthFactor: 2, InitialSize: 8 << 20, MaxSize: 4 << 20}) != nil)
+
+	is.NoErr(client.SetMapSizePolicy(golmdb.DefaultMapSizePolicy()))
+}
+
+func TestMapSizeLimit(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	defer client.TerminateSync()
+
+	err = client.SetMapSizePolicy(golmdb.MapSizePolicy{
+		InitialSize:     2 << 20,
+		GrowthIncrement: 1 << 20,
+		MaxSize:         4 << 20,
+	})
+	is.NoErr(err)
+
+	dbRef, err := createDBRef(client, t.Name(), 0)
+	is.NoErr(err)
+
+	key := make([]byte, 8)
+	val := make([]byte, 512*1024)
+	written := 0
+	for ; written < 16; written++ {
+		binary.BigEndian.PutUint64(key, uint64(written))
+		err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+			return txn.Put(dbRef, key, val, 0)
+		})
+		if err != nil {
+			break
+		}
+	}
+	// 16 * 512KB would need at least 8MB.
+	is.True(errors.Is(err, golmdb.ErrMapSizeLimit))
+	is.True(written > 0)
+
+	// the client should carry on working: reads are fine, and so are
+	// writes that fit.
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		binary.BigEndian.PutUint64(key, 0)
+		_, err := txn.Get(dbRef, key)
+		return err
+	})
+	is.NoErr(err)
+
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		binary.BigEndian.PutUint64(key, 0)
+		return txn.Delete(dbRef, key, nil)
+	})
+	is.NoErr(err)
+
+	// raising the limit allows the write to succeed.
+	is.NoErr(client.SetMapSizePolicy(golmdb.MapSizePolicy{GrowthFactor: 2}))
+	binary.BigEndian.PutUint64(key, uint64(written))
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		return txn.Put(dbRef, key, val, 0)
+	})
+	is.NoErr(err)
+}
+
+func TestProactiveResize(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	defer client.TerminateSync()
+
+	is.True(client.SetMapSizePolicy(golmdb.MapSizePolicy{GrowthFactor: 2, ResizeThreshold: 1}) != nil)
+
+	err = client.SetMapSizePolicy(golmdb.MapSizePolicy{
+		InitialSize:     2 << 20,
+		GrowthIncrement: 4 << 20,
+		ResizeThreshold: 0.5,
+	})
+	is.NoErr(err)
+
+	dbRef, err := createDBRef(client, t.Name(), 0)
+	is.NoErr(err)
+
+	// This fits in 2MB, but uses more than half of it, so the map
+	// should be grown to 6MB straight after the commit.
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		return txn.Put(dbRef, []byte("a"), make([]byte, 1280*1024), 0)
+	})
+	is.NoErr(err)
+
+	// Now prevent any further growth. If the map had not already been
+	// grown, this next Update would not fit.
+	err = client.SetMapSizePolicy(golmdb.MapSizePolicy{
+		InitialSize:     2 << 20,
+		GrowthIncrement: 4 << 20,
+		MaxSize:         2 << 20,
+	})
+	is.NoErr(err)
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		return txn.Put(dbRef, []byte("b"), make([]byte, 2<<20), 0)
+	})
+	is.NoErr(err)
+}
@@ -0,0 +1,368 @@
+package golmdb
+
+/*
+#include <lmdb.h>
+*/
+import "C"
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// A MergeOperator combines the operands given to ReadWriteTxn.Merge
+// with the existing value of a key, producing its new value. Set one
+// for a database with LMDBClient.SetMergeOperator.
+//
+// Merges are not applied straight away: several merges to the same
+// key, even from different Updates within the same batch, are
+// collected and then applied with a single call to Merge. So Merge
+// must give the same result for operands [a, b] as for [a] followed
+// by [b].
+type MergeOperator interface {
+	// Merge applies the operands, in order, to the existing value of
+	// the key and returns the new value. If the key does not exist,
+	// existing is nil and found is false. existing is owned by the
+	// database, so must not be modified; the result may alias it.
+	Merge(key, existing []byte, found bool, operands [][]byte) ([]byte, error)
+}
+
+// The built-in MergeOperators.
+var (
+	// Int64Add adds int64 operands to an int64 value, which is 0 if
+	// the key does not exist. Overflow wraps, as in Go. See
+	// EncodeInt64.
+	Int64Add MergeOperator = int64Merge(func(a, b int64) int64 { return a + b })
+	// Int64Max sets an int64 value to the greatest of its operands and
+	// its existing value.
+	Int64Max MergeOperator = int64Merge(func(a, b int64) int64 {
+		if b > a {
+			return b
+		}
+		return a
+	})
+	// Int64Min sets an int64 value to the least of its operands and
+	// its existing value.
+	Int64Min MergeOperator = int64Merge(func(a, b int64) int64 {
+		if b < a {
+			return b
+		}
+		return a
+	})
+	// BytesAppend appends its operands to the existing value.
+	BytesAppend MergeOperator = bytesAppend{}
+	// SetUnion adds each operand as a value of the key, unless it is
+	// already present. It may only be used with DupSort databases,
+	// and is the only MergeOperator which may be.
+	SetUnion MergeOperator = setUnion{}
+)
+
+// EncodeInt64 encodes n as the Int64Add, Int64Max and Int64Min
+// operators expect, both for operands and for values: 8 bytes,
+// big-endian, two's complement. This is the same encoding as
+// BinaryCodec[int64].
+func EncodeInt64(n int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(n))
+}
+
+// DecodeInt64 decodes a value encoded with EncodeInt64.
+func DecodeInt64(data []byte) (int64, error) {
+	if len(data) != 8 {
+		return 0, fmt.Errorf("Cannot decode int64 from %d bytes", len(data))
+	}
+	return int64(binary.BigEndian.Uint64(data)), nil
+}
+
+type int64Merge func(a, b int64) int64
+
+func (self int64Merge) Merge(key, existing []byte, found bool, operands [][]byte) ([]byte, error) {
+	var acc int64
+	if found {
+		var err error
+		if acc, err = DecodeInt64(existing); err != nil {
+			return nil, fmt.Errorf("%v: %w", err, Corrupted)
+		}
+	}
+	for idx, operand := range operands {
+		n, err := DecodeInt64(operand)
+		if err != nil {
+			return nil, err
+		}
+		if idx == 0 && !found {
+			acc = n
+		} else {
+			acc = self(acc, n)
+		}
+	}
+	return EncodeInt64(acc), nil
+}
+
+type bytesAppend struct{}
+
+func (bytesAppend) Merge(key, existing []byte, found bool, operands [][]byte) ([]byte, error) {
+	size := len(existing)
+	for _, operand := range operands {
+		size += len(operand)
+	}
+	merged := make([]byte, 0, size)
+	merged = append(merged, existing...)
+	for _, operand := range operands {
+		merged = append(merged, operand...)
+	}
+	return merged, nil
+}
+
+// setUnion is applied with Puts of each operand (see mergeBuffer.apply)
+// rather than by replacing the value, so this is only used to check
+// operands.
+type setUnion struct{}
+
+func (setUnion) Merge(key, existing []byte, found bool, operands [][]byte) ([]byte, error) {
+	for _, operand := range operands {
+		if len(operand) == 0 {
+			return nil, errors.New("SetUnion operands must not be empty")
+		}
+	}
+	return nil, nil
+}
+
+// SetMergeOperator sets the MergeOperator used by ReadWriteTxn.Merge
+// for the database, replacing any previous one. Only SetUnion may be
+// used with a DupSort database, and SetUnion may only be used with a
+// DupSort database.
+//
+// Like DeclareIndex, this is not persistent: each program must set the
+// merge operator every time it opens the database, before it merges
+// into it. Databases without a merge operator do not support Merge.
+func (self *LMDBClient) SetMergeOperator(db DBRef, operator MergeOperator) error {
+	if operator == nil {
+		return errors.New("Cannot set merge operator: operator must not be nil")
+	}
+	err := self.Update(func(txn *ReadWriteTxn) error {
+		var flags C.uint
+		if err := asError(C.mdb_dbi_flags(txn.txn, C.MDB_dbi(db), &flags)); err != nil {
+			return txn.opError("SetMergeOperator", db, nil, err)
+		}
+		dupSort := DatabaseFlag(flags)&DupSort != 0
+		_, isSetUnion := operator.(setUnion)
+		if dupSort && !isSetUnion {
+			return fmt.Errorf("Cannot set merge operator for database %q: it is DupSort, so only SetUnion may be used", txn.names.get(db))
+		} else if !dupSort && isSetUnion {
+			return fmt.Errorf("Cannot set merge operator for database %q: SetUnion requires a DupSort database", txn.names.get(db))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	self.environment.merges.set(db, operator)
+	return nil
+}
+
+// Merge the operand into the value of the key, using the database's
+// MergeOperator (see LMDBClient.SetMergeOperator). For example, with
+// Int64Add:
+//
+//	txn.Merge(counters, []byte("hits"), golmdb.EncodeInt64(1))
+//
+// increments the hits counter, without having to Get, decode, modify
+// and Put it.
+//
+// The merge is buffered, and applied at the latest just before the
+// batch of Updates commits. Merges to the same key from all the
+// Updates in the batch are combined, so the key is read and written
+// only once. Reading the database within the txn (with Get or a
+// cursor), or writing to it with Put or Delete, first applies all the
+// buffered merges to that database, so a txn always sees its own
+// merges. If the txn fun returns an error, its merges are discarded.
+//
+// The merged value is written with Put, so the database's indexes are
+// updated and any expiry of the key is removed. The operand is copied,
+// so may be reused once Merge returns.
+func (self *ReadWriteTxn) Merge(db DBRef, key, operand []byte) error {
+	if len(key) == 0 {
+		return self.opError("Merge", db, key, errEmptyKey)
+	}
+	operator, found := self.merges.registry.get(db)
+	if !found {
+		return fmt.Errorf("Cannot merge into database %q: it has no merge operator", self.names.get(db))
+	}
+	// catch bad operands now, rather than when the merges are applied
+	// on behalf of some other txn.
+	if _, err := operator.Merge(key, nil, false, [][]byte{operand}); err != nil {
+		return self.opError("Merge", db, key, err)
+	}
+	self.merges.pending = append(self.merges.pending, pendingMerge{
+		db:      db,
+		key:     string(key),
+		operand: append([]byte(nil), operand...),
+	})
+	return nil
+}
+
+// The merge operators set on each database.
+type mergeRegistry struct {
+	lock      sync.RWMutex
+	operators map[DBRef]MergeOperator
+}
+
+func newMergeRegistry() *mergeRegistry {
+	return &mergeRegistry{operators: make(map[DBRef]MergeOperator)}
+}
+
+func (self *mergeRegistry) set(db DBRef, operator MergeOperator) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.operators[db] = operator
+}
+
+func (self *mergeRegistry) get(db DBRef) (MergeOperator, bool) {
+	if self == nil {
+		return nil, false
+	}
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	operator, found := self.operators[db]
+	return operator, found
+}
+
+// Once a Drop has committed, the dropped database no longer has a
+// merge operator.
+func (self *mergeRegistry) dropped(db DBRef) {
+	if self == nil {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.operators, db)
+}
+
+// Used within the server to retry a batch whose merges could not be
+// applied; it is never returned.
+var errMergeFailed = errors.New("Merge failed")
+
+type pendingMerge struct {
+	db      DBRef
+	key     string
+	operand []byte
+}
+
+// The merges which have not yet been applied. There's one of these,
+// owned by the server, and it spans the whole batch: merges from
+// child txns which have committed stay pending until they're needed,
+// or until the batch's txn is about to commit.
+//
+// pending is never modified in place: it is only appended to, or
+// replaced. So the server can snapshot it (with a capped slice)
+// before running each txn fun, and restore the snapshot should the
+// txn abort.
+type mergeBuffer struct {
+	txn      *ReadWriteTxn
+	registry *mergeRegistry
+	pending  []pendingMerge
+}
+
+func (self *mergeBuffer) snapshot() []pendingMerge {
+	if self == nil {
+		return nil
+	}
+	self.pending = self.pending[:len(self.pending):len(self.pending)]
+	return self.pending
+}
+
+func (self *mergeBuffer) restore(snapshot []pendingMerge) {
+	if self == nil {
+		return
+	}
+	self.pending = snapshot
+}
+
+func (self *mergeBuffer) reset() {
+	self.pending = nil
+}
+
+// Applies the pending merges to db, so that db can be read or written.
+func (self *mergeBuffer) flush(db DBRef) error {
+	if self == nil || len(self.pending) == 0 {
+		return nil
+	}
+	var flushing, kept []pendingMerge
+	for _, merge := range self.pending {
+		if merge.db == db {
+			flushing = append(flushing, merge)
+		} else {
+			kept = append(kept, merge)
+		}
+	}
+	if len(flushing) == 0 {
+		return nil
+	}
+	self.pending = kept
+	return self.apply(flushing)
+}
+
+// Applies all the pending merges.
+func (self *mergeBuffer) flushAll() error {
+	if self == nil || len(self.pending) == 0 {
+		return nil
+	}
+	flushing := self.pending
+	self.pending = nil
+	return self.apply(flushing)
+}
+
+// Merges to the same key are combined, and each key is then read and
+// written once. Keys are applied in the order they were first merged.
+func (self *mergeBuffer) apply(merges []pendingMerge) error {
+	type dbKey struct {
+		db  DBRef
+		key string
+	}
+	type group struct {
+		dbKey
+		operands [][]byte
+	}
+	var groups []*group
+	byKey := make(map[dbKey]*group, len(merges))
+	for _, merge := range merges {
+		k := dbKey{db: merge.db, key: merge.key}
+		g, found := byKey[k]
+		if !found {
+			g = &group{dbKey: k}
+			byKey[k] = g
+			groups = append(groups, g)
+		}
+		g.operands = append(g.operands, merge.operand)
+	}
+
+	txn := self.txn
+	for _, g := range groups {
+		operator, found := self.registry.get(g.db)
+		if !found {
+			return fmt.Errorf("Cannot merge into database %q: it has no merge operator", txn.names.get(g.db))
+		}
+		key := []byte(g.key)
+		if _, isSetUnion := operator.(setUnion); isSetUnion {
+			for _, operand := range g.operands {
+				if err := txn.Put(g.db, key, operand, NoDupData); err != nil && !errors.Is(err, KeyExist) {
+					return err
+				}
+			}
+			continue
+		}
+		existing, err := txn.Get(g.db, key)
+		found = err == nil
+		if err != nil && !errors.Is(err, NotFound) {
+			return err
+		}
+		merged, err := operator.Merge(key, existing, found, g.operands)
+		if err != nil {
+			return txn.opError("Merge", g.db, key, err)
+		}
+		if err = txn.Put(g.db, key, merged, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package golmdb_test
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/matryer/is"
+
+	"wellquite.org/golmdb"
+)
+
+func TestMergeInt64(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	defer client.TerminateSync()
+
+	counters, err := createDBRef(client, "counters", 0)
+	is.NoErr(err)
+	highs, err := createDBRef(client, "highs", 0)
+	is.NoErr(err)
+	lows, err := createDBRef(client, "lows", 0)
+	is.NoErr(err)
+	is.NoErr(client.SetMergeOperator(counters, golmdb.Int64Add))
+	is.NoErr(client.SetMergeOperator(highs, golmdb.Int64Max))
+	is.NoErr(client.SetMergeOperator(lows, golmdb.Int64Min))
+
+	// concurrent Updates are batched, and their merges coalesced.
+	const updates = 64
+	var wg sync.WaitGroup
+	for idx := 0; idx < updates; idx++ {
+		n := int64(idx)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := client.Update(func(txn *golmdb.ReadWriteTxn) error {
+				key := []byte("k")
+				if err := txn.Merge(counters, key, golmdb.EncodeInt64(1)); err != nil {
+					return err
+				}
+				if err := txn.Merge(highs, key, golmdb.EncodeInt64(n)); err != nil {
+					return err
+				}
+				return txn.Merge(lows, key, golmdb.EncodeInt64(n-10))
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// an aborted txn's merges are discarded, but a txn sees its own.
+	abort := errors.New("abort")
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		is.NoErr(txn.Merge(counters, []byte("k"), golmdb.EncodeInt64(100)))
+		val, err := txn.Get(counters, []byte("k"))
+		is.NoErr(err)
+		n, err := golmdb.DecodeInt64(val)
+		is.NoErr(err)
+		is.Equal(n, int64(updates+100))
+		return abort
+	})
+	is.True(errors.Is(err, abort))
+
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		for db, expected := range map[golmdb.DBRef]int64{counters: updates, highs: updates - 1, lows: -10} {
+			val, err := txn.Get(db, []byte("k"))
+			is.NoErr(err)
+			n, err := golmdb.DecodeInt64(val)
+			is.NoErr(err)
+			is.Equal(n, expected)
+		}
+		return nil
+	})
+	is.NoErr(err)
+}
+
+func TestMergeAppendAndUnion(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	defer client.TerminateSync()
+
+	logs, err := createDBRef(client, "logs", 0)
+	is.NoErr(err)
+	tags, err := createDBRef(client, "tags", golmdb.DupSort)
+	is.NoErr(err)
+	is.NoErr(client.SetMergeOperator(logs, golmdb.BytesAppend))
+	is.NoErr(client.SetMergeOperator(tags, golmdb.SetUnion))
+
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		if err := txn.Put(logs, []byte("l"), []byte("a"), 0); err != nil {
+			return err
+		}
+		for _, operand := range []string{"b", "c"} {
+			if err := txn.Merge(logs, []byte("l"), []byte(operand)); err != nil {
+				return err
+			}
+		}
+		for _, tag := range []string{"red", "blue", "red"} {
+			if err := txn.Merge(tags, []byte("t"), []byte(tag)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	is.NoErr(err)
+
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		if err := txn.Merge(logs, []byte("l"), []byte("d")); err != nil {
+			return err
+		}
+		// a Put after a Merge replaces the merged value.
+		if err := txn.Merge(logs, []byte("m"), []byte("lost")); err != nil {
+			return err
+		}
+		if err := txn.Put(logs, []byte("m"), []byte("kept"), 0); err != nil {
+			return err
+		}
+		return txn.Merge(tags, []byte("t"), []byte("blue"))
+	})
+	is.NoErr(err)
+
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		val, err := txn.Get(logs, []byte("l"))
+		is.NoErr(err)
+		is.Equal(string(val), "abcd")
+		val, err = txn.Get(logs, []byte("m"))
+		is.NoErr(err)
+		is.Equal(string(val), "kept")
+
+		cursor, err := txn.NewCursor(tags)
+		is.NoErr(err)
+		defer cursor.Close()
+		var values []string
+		_, val, err = cursor.First()
+		for ; err == nil; _, val, err = cursor.Next() {
+			values = append(values, string(val))
+		}
+		is.True(errors.Is(err, golmdb.NotFound))
+		is.Equal(values, []string{"blue", "red"})
+		return nil
+	})
+	is.NoErr(err)
+}
+
+func TestMergeInvalid(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	defer client.TerminateSync()
+
+	plain, err := createDBRef(client, "plain", 0)
+	is.NoErr(err)
+	dupSort, err := createDBRef(client, "dupsort", golmdb.DupSort)
+	is.NoErr(err)
+	is.True(client.SetMergeOperator(plain, golmdb.SetUnion) != nil)
+	is.True(client.SetMergeOperator(dupSort, golmdb.Int64Add) != nil)
+
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		// no merge operator has been set.
+		is.True(txn.Merge(plain, []byte("k"), golmdb.EncodeInt64(1)) != nil)
+		return nil
+	})
+	is.NoErr(err)
+
+	is.NoErr(client.SetMergeOperator(plain, golmdb.Int64Add))
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		is.True(txn.Merge(plain, []byte("k"), []byte("short")) != nil)
+		is.True(txn.Merge(plain, nil, golmdb.EncodeInt64(1)) != nil)
+		return txn.Put(plain, []byte("bad"), []byte("not an int64"), 0)
+	})
+	is.NoErr(err)
+
+	// merging into a value that isn't an int64 fails the txn that
+	// merged, and only that txn.
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		return txn.Merge(plain, []byte("bad"), golmdb.EncodeInt64(1))
+	})
+	is.True(errors.Is(err, golmdb.Corrupted))
+}
+
+func TestMergeSurvivesAbortedIndexedPut(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	defer client.TerminateSync()
+
+	counters, err := createDBRef(client, "counters", 0)
+	is.NoErr(err)
+	is.NoErr(client.SetMergeOperator(counters, golmdb.Int64Add))
+	_, err = client.DeclareIndex(counters, "counters-by-value", golmdb.UniqueIndex, func(key, val []byte) [][]byte {
+		return [][]byte{val}
+	})
+	is.NoErr(err)
+
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		if err := txn.Merge(counters, []byte("a"), golmdb.EncodeInt64(1)); err != nil {
+			return err
+		}
+		// applies the merge to a, then clashes with it in the index.
+		err := txn.Put(counters, []byte("b"), golmdb.EncodeInt64(1), 0)
+		var uniqueErr *golmdb.UniqueIndexError
+		is.True(errors.As(err, &uniqueErr))
+		return nil
+	})
+	is.NoErr(err)
+
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		val, err := txn.Get(counters, []byte("a"))
+		is.NoErr(err)
+		n, err := golmdb.DecodeInt64(val)
+		is.NoErr(err)
+		is.Equal(n, int64(1))
+		_, err = txn.Get(counters, []byte("b"))
+		is.True(errors.Is(err, golmdb.NotFound))
+		return nil
+	})
+	is.NoErr(err)
+}
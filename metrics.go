@@ -0,0 +1,204 @@
+package golmdb
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"syscall"
+	"time"
+)
+
+// Metrics receives measurements from the client and its actor. Set
+// Options.Metrics to an implementation of this to export them to
+// whichever metrics library you use. ExpvarMetrics is an
+// implementation which publishes via the standard library's expvar
+// package.
+//
+// Methods are called synchronously from the View and Update paths,
+// and from within the actor, so they must be cheap, and safe for
+// concurrent use. Embed NopMetrics in your own implementation so that
+// methods added to this interface in the future do not break it.
+type Metrics interface {
+	// Called by the actor each time it has run a batch of Update
+	// transactions: how many were in the batch, and how long the whole
+	// batch took to run and commit (including any retries).
+	BatchRun(size int, duration time.Duration)
+	// Called each time a top-level write txn is committed, with how
+	// long mdb_txn_commit took. Unless you're using NoSync, this
+	// includes fsync.
+	Commit(duration time.Duration)
+	// Called each time a batch (or an Update transaction within it) has
+	// to be re-run, with the cause: MapFull or TxnFull.
+	Retry(cause error)
+	// Called each time the map is resized.
+	Resize(fromSize, toSize uint64, duration time.Duration)
+	// Called at the end of each call to Sync, with how long the fsync
+	// took.
+	Sync(duration time.Duration)
+	// Called at the end of each View, with how long the whole View
+	// took (including waiting for a reader slot), and the error
+	// returned.
+	View(duration time.Duration, err error)
+	// Called at the end of each Update, with how long the whole Update
+	// took (including waiting for the actor), and the error returned.
+	Update(duration time.Duration, err error)
+	// Called whenever the number of Updates that have been submitted
+	// but have not yet returned changes.
+	UpdateQueueDepth(depth int)
+}
+
+// NopMetrics is a Metrics which does nothing. It is the default.
+type NopMetrics struct{}
+
+var _ Metrics = NopMetrics{}
+
+func (NopMetrics) BatchRun(size int, duration time.Duration)              {}
+func (NopMetrics) Commit(duration time.Duration)                          {}
+func (NopMetrics) Retry(cause error)                                      {}
+func (NopMetrics) Resize(fromSize, toSize uint64, duration time.Duration) {}
+func (NopMetrics) Sync(duration time.Duration)                            {}
+func (NopMetrics) View(duration time.Duration, err error)                 {}
+func (NopMetrics) Update(duration time.Duration, err error)               {}
+func (NopMetrics) UpdateQueueDepth(depth int)                             {}
+
+// ExpvarMetrics is a Metrics which records into an expvar.Map. Counts
+// and total durations (in nanoseconds) are recorded, from which rates
+// and mean latencies can be derived. Errors and retries are counted
+// per error.
+type ExpvarMetrics struct {
+	vars *expvar.Map
+
+	batches        expvar.Int
+	batchedUpdates expvar.Int
+	batchNanos     expvar.Int
+	maxBatchSize   expvar.Int
+	commits        expvar.Int
+	commitNanos    expvar.Int
+	syncs          expvar.Int
+	syncNanos      expvar.Int
+	resizes        expvar.Int
+	resizeNanos    expvar.Int
+	mapSize        expvar.Int
+	views          expvar.Int
+	viewNanos      expvar.Int
+	updates        expvar.Int
+	updateNanos    expvar.Int
+	queueDepth     expvar.Int
+	retries        expvar.Map
+	errors         expvar.Map
+}
+
+var _ Metrics = (*ExpvarMetrics)(nil)
+
+// NewExpvarMetrics creates an ExpvarMetrics. If name is not empty, the
+// metrics are published with expvar.Publish under that name, and so
+// (as with expvar.Publish) the name must not already be in use.
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	self := &ExpvarMetrics{vars: new(expvar.Map).Init()}
+	self.retries.Init()
+	self.errors.Init()
+	for key, value := range map[string]expvar.Var{
+		"batches":         &self.batches,
+		"batched_updates": &self.batchedUpdates,
+		"batch_ns":        &self.batchNanos,
+		"max_batch_size":  &self.maxBatchSize,
+		"commits":         &self.commits,
+		"commit_ns":       &self.commitNanos,
+		"syncs":           &self.syncs,
+		"sync_ns":         &self.syncNanos,
+		"resizes":         &self.resizes,
+		"resize_ns":       &self.resizeNanos,
+		"map_size":        &self.mapSize,
+		"views":           &self.views,
+		"view_ns":         &self.viewNanos,
+		"updates":         &self.updates,
+		"update_ns":       &self.updateNanos,
+		"update_queue":    &self.queueDepth,
+		"retries":         &self.retries,
+		"errors":          &self.errors,
+	} {
+		self.vars.Set(key, value)
+	}
+	if name != "" {
+		expvar.Publish(name, self.vars)
+	}
+	return self
+}
+
+// Vars returns the expvar.Map the metrics are recorded in.
+func (self *ExpvarMetrics) Vars() *expvar.Map {
+	return self.vars
+}
+
+func (self *ExpvarMetrics) BatchRun(size int, duration time.Duration) {
+	self.batches.Add(1)
+	self.batchedUpdates.Add(int64(size))
+	self.batchNanos.Add(int64(duration))
+	// racy, but only ever grows, so will settle on the right answer.
+	if int64(size) > self.maxBatchSize.Value() {
+		self.maxBatchSize.Set(int64(size))
+	}
+}
+
+func (self *ExpvarMetrics) Commit(duration time.Duration) {
+	self.commits.Add(1)
+	self.commitNanos.Add(int64(duration))
+}
+
+func (self *ExpvarMetrics) Retry(cause error) {
+	self.retries.Add(errorKey(cause), 1)
+}
+
+func (self *ExpvarMetrics) Resize(fromSize, toSize uint64, duration time.Duration) {
+	self.resizes.Add(1)
+	self.resizeNanos.Add(int64(duration))
+	self.mapSize.Set(int64(toSize))
+}
+
+func (self *ExpvarMetrics) Sync(duration time.Duration) {
+	self.syncs.Add(1)
+	self.syncNanos.Add(int64(duration))
+}
+
+func (self *ExpvarMetrics) View(duration time.Duration, err error) {
+	self.views.Add(1)
+	self.viewNanos.Add(int64(duration))
+	if err != nil {
+		self.errors.Add(errorKey(err), 1)
+	}
+}
+
+func (self *ExpvarMetrics) Update(duration time.Duration, err error) {
+	self.updates.Add(1)
+	self.updateNanos.Add(int64(duration))
+	if err != nil {
+		self.errors.Add(errorKey(err), 1)
+	}
+}
+
+func (self *ExpvarMetrics) UpdateQueueDepth(depth int) {
+	self.queueDepth.Set(int64(depth))
+}
+
+// Errors are counted by kind rather than by message, so that errors
+// returned by txn funs cannot create an unbounded number of keys.
+func errorKey(err error) string {
+	var lmdbErr LMDBError
+	var errno syscall.Errno
+	switch {
+	case errors.As(err, &lmdbErr):
+		return lmdbErr.Error()
+	case errors.As(err, &errno):
+		return errno.Error()
+	case errors.Is(err, ErrMapSizeLimit):
+		return ErrMapSizeLimit.Error()
+	case errors.Is(err, errTerminated):
+		return errTerminated.Error()
+	case errors.Is(err, context.Canceled):
+		return context.Canceled.Error()
+	case errors.Is(err, context.DeadlineExceeded):
+		return context.DeadlineExceeded.Error()
+	default:
+		return "other"
+	}
+}
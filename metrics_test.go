@@ -0,0 +1,72 @@
+package golmdb_test
+
+import (
+	"errors"
+	"expvar"
+	"os"
+	"testing"
+
+	"github.com/matryer/is"
+
+	"wellquite.org/golmdb"
+)
+
+func TestExpvarMetrics(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	dir, err := os.MkdirTemp("", "golmdb")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	metrics := golmdb.NewExpvarMetrics("")
+	client, err := golmdb.Open(dir, golmdb.Options{
+		Log:           log,
+		NumDBs:        4,
+		Metrics:       metrics,
+		MapSizePolicy: golmdb.MapSizePolicy{GrowthFactor: 2},
+	})
+	is.NoErr(err)
+	defer client.TerminateSync()
+
+	dbRef, err := createDBRef(client, t.Name(), 0)
+	is.NoErr(err)
+
+	// big enough to need the (1MB) map to grow.
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		return txn.Put(dbRef, []byte("big"), make([]byte, 2<<20), 0)
+	})
+	is.NoErr(err)
+
+	myErr := errors.New("my error")
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		return myErr
+	})
+	is.Equal(err, myErr)
+
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		_, err := txn.Get(dbRef, []byte("missing"))
+		return err
+	})
+	is.True(errors.Is(err, golmdb.NotFound))
+	is.NoErr(client.Sync(true))
+
+	vars := metrics.Vars()
+	value := func(key string) int64 { return vars.Get(key).(*expvar.Int).Value() }
+	is.Equal(value("updates"), int64(3))
+	is.Equal(value("views"), int64(1))
+	is.Equal(value("syncs"), int64(1))
+	is.Equal(value("update_queue"), int64(0))
+	is.Equal(value("batches"), int64(3))
+	is.Equal(value("batched_updates"), int64(3))
+	is.True(value("commits") >= 2)
+	is.True(value("resizes") >= 1)
+	is.True(value("map_size") >= 2<<20)
+
+	retries := vars.Get("retries").(*expvar.Map)
+	is.True(retries.Get(golmdb.MapFull.Error()).(*expvar.Int).Value() >= 1)
+	errs := vars.Get("errors").(*expvar.Map)
+	is.Equal(errs.Get(golmdb.NotFound.Error()).(*expvar.Int).Value(), int64(1))
+	is.Equal(errs.Get("other").(*expvar.Int).Value(), int64(1))
+}
@@ -0,0 +1,142 @@
+package golmdb_test
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+
+	"github.com/matryer/is"
+
+	"wellquite.org/golmdb"
+)
+
+// Environment variables used to make the test binary act as a helper
+// process for TestMultiProcess*: it opens the database in
+// GOLMDB_HELPER_DIR, and Puts a value of GOLMDB_HELPER_SIZE bytes
+// under the key GOLMDB_HELPER_KEY, which will grow the map.
+const (
+	helperDirEnv  = "GOLMDB_HELPER_DIR"
+	helperKeyEnv  = "GOLMDB_HELPER_KEY"
+	helperSizeEnv = "GOLMDB_HELPER_SIZE"
+	multiDBName   = "multi"
+)
+
+func TestMultiProcessHelper(t *testing.T) {
+	dir := os.Getenv(helperDirEnv)
+	if dir == "" {
+		t.Skip("only run as a helper process")
+	}
+	is := is.New(t)
+	size, err := strconv.Atoi(os.Getenv(helperSizeEnv))
+	is.NoErr(err)
+
+	client, err := golmdb.Open(dir, golmdb.Options{NumDBs: 4})
+	is.NoErr(err)
+	defer client.TerminateSync()
+	dbRef, err := createDBRef(client, multiDBName, 0)
+	is.NoErr(err)
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		return txn.Put(dbRef, []byte(os.Getenv(helperKeyEnv)), make([]byte, size), 0)
+	})
+	is.NoErr(err)
+}
+
+// Runs the helper in a separate process, and waits for it to finish.
+func runHelper(t *testing.T, dir, key string, size int) {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestMultiProcessHelper$", "-test.count=1")
+	cmd.Env = append(os.Environ(),
+		helperDirEnv+"="+dir,
+		helperKeyEnv+"="+key,
+		helperSizeEnv+"="+strconv.Itoa(size),
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("helper process failed: %v\n%s", err, out)
+	}
+}
+
+func TestMultiProcessMapResized(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	dir, err := os.MkdirTemp("", "golmdb")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	// the writer: with a small map which it has no need to grow itself.
+	client, err := golmdb.Open(dir, golmdb.Options{
+		Log:           log,
+		NumDBs:        4,
+		MapSizePolicy: golmdb.MapSizePolicy{InitialSize: 1 << 20, GrowthFactor: 2},
+	})
+	is.NoErr(err)
+	defer client.TerminateSync()
+	dbRef, err := createDBRef(client, multiDBName, 0)
+	is.NoErr(err)
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		return txn.Put(dbRef, []byte("parent"), []byte("parent"), 0)
+	})
+	is.NoErr(err)
+
+	// another process grows the map well beyond our map size.
+	runHelper(t, dir, "child", 8<<20)
+
+	// both Views and Updates must cope with MapResized.
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		val, err := txn.Get(dbRef, []byte("child"))
+		if err == nil {
+			is.Equal(len(val), 8<<20)
+		}
+		return err
+	})
+	is.NoErr(err)
+
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		return txn.Put(dbRef, []byte("parent again"), []byte("parent"), 0)
+	})
+	is.NoErr(err)
+
+	// and so must Copy.
+	copyDir, err := os.MkdirTemp("", "golmdb")
+	is.NoErr(err)
+	defer os.RemoveAll(copyDir)
+	runHelper(t, dir, "child again", 32<<20)
+	is.NoErr(client.Copy(copyDir, false))
+}
+
+func TestMultiProcessMapResizedReadOnly(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	dir, err := os.MkdirTemp("", "golmdb")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	runHelper(t, dir, "first", 1024)
+
+	client, err := golmdb.Open(dir, golmdb.Options{Log: log, NumDBs: 4, Flags: golmdb.ReadOnly})
+	is.NoErr(err)
+	defer client.TerminateSync()
+
+	readKey := func(key string, size int) error {
+		return client.View(func(txn *golmdb.ReadOnlyTxn) error {
+			dbRef, err := txn.DBRef(multiDBName, 0)
+			if err != nil {
+				return err
+			}
+			val, err := txn.Get(dbRef, []byte(key))
+			if err == nil && len(val) != size {
+				return errors.New("wrong value length")
+			}
+			return err
+		})
+	}
+	is.NoErr(readKey("first", 1024))
+
+	runHelper(t, dir, "second", 8<<20)
+	is.NoErr(readKey("second", 8<<20))
+}
@@ -0,0 +1,199 @@
+package golmdb
+
+import (
+	"errors"
+	"io/fs"
+	"time"
+
+	"github.com/rs/zerolog"
+	"wellquite.org/actors"
+)
+
+// Options for opening an LMDB database with Open. The zero value is
+// usable: it opens (creating if necessary) a read-write database with
+// sensible defaults.
+type Options struct {
+	// The logger the actor should use. The zero value logs nothing.
+	// Ignored if Manager is set, as the actor then inherits its logger
+	// from the manager.
+	Log zerolog.Logger
+	// If set, the actor that runs Update transactions is spawned as a
+	// child of this manager, rather than as an unmanaged stand-alone
+	// actor. Must not be set with ReadOnly.
+	Manager actors.ManagerClient
+	// The file mode used when creating the data and lock files. If 0,
+	// DefaultMode is used.
+	Mode fs.FileMode
+	// The maximum number of concurrent View transactions. If 0,
+	// DefaultNumReaders is used.
+	NumReaders uint
+	// The maximum number of named databases that can be used. If 0,
+	// only the unnamed database can be used.
+	NumDBs uint
+	// Environment flags. NoTLS is always added automatically. See the
+	// documentation for NewLMDB.
+	Flags EnvironmentFlag
+	// The maximum number of Update transactions that are batched
+	// together into a single commit. See the documentation for
+	// NewLMDB. If 0, DefaultBatchSize is used. Must not be set with
+	// ReadOnly.
+	BatchSize uint
+	// Controls the size of the map, and how it grows. If the zero
+	// value, DefaultMapSizePolicy() is used. Must not be set with
+	// ReadOnly.
+	MapSizePolicy MapSizePolicy
+	// If non-zero, the actor runs ReaderCheck at this interval, and
+	// logs how many stale reader slots were cleared, and the age of
+	// the oldest active reader. That age is measured in txns, not
+	// time: it is how many txns have committed since the reader's
+	// snapshot (LMDB does not record when readers started; see
+	// SlowViewThreshold for Views held open for too long). Must not
+	// be set with ReadOnly.
+	ReaderCheckInterval time.Duration
+	// Receives measurements of batches, commits, resizes, Views,
+	// Updates and so on. If nil, NopMetrics is used.
+	Metrics Metrics
+	// Called at each step of Views, Updates, and the batching and
+	// committing of Updates. If nil, NopTracer is used.
+	Tracer Tracer
+	// Views which hold their read txn open for longer than this are
+	// logged at Warn level. A long-running View prevents the map being
+	// resized, and so can stall Updates. If the actor has to wait for
+	// longer than this for Views to finish before it can resize, that
+	// is logged too. 0 disables this.
+	SlowViewThreshold time.Duration
+	// Update txn funs which take longer than this to run are logged at
+	// Warn level: whilst a txn fun runs, every other Update is blocked.
+	// The actor also warns, every SlowUpdateThreshold, whilst a txn fun
+	// is still running. 0 disables this. Must not be set with ReadOnly.
+	SlowUpdateThreshold time.Duration
+	// If set, the stacks of callers of View and Update are captured so
+	// that they can be included when slow txns are logged. This has a
+	// cost for every View and Update, so is best enabled only whilst
+	// tracking down slow txns.
+	SlowTxnStacks bool
+	// Called (in a new go-routine) when the client enters degraded
+	// read-only mode, with the *DegradedError that Updates will fail
+	// with. See DegradedError and LMDBClient.Resume. Must not be set
+	// with ReadOnly.
+	OnDegraded func(err error)
+	// If non-zero, expired keys are swept (see LMDBClient.SweepExpired)
+	// at this interval. Must not be set with ReadOnly.
+	ExpirySweepInterval time.Duration
+	// The maximum number of expired keys deleted by each Update of the
+	// sweeper. If 0, DefaultExpirySweepBatchSize is used. Must not be
+	// set with ReadOnly.
+	ExpirySweepBatchSize uint
+
+	// Set by NewLMDB and NewManagedLMDB, whose zero values for mode,
+	// numReaders and batchSize have always been passed through as is,
+	// rather than replaced by defaults.
+	positional bool
+}
+
+// Defaults used by Open for zero-valued Options fields.
+const (
+	DefaultMode       = fs.FileMode(0666)
+	DefaultNumReaders = 126 // LMDB's own default
+	DefaultBatchSize  = 16
+)
+
+// Open an LMDB database at the given path, and return a client to it.
+//
+// This is the same as NewLMDB and NewManagedLMDB, but with the
+// settings supplied as Options. Invalid or incompatible options (for
+// example, ReadOnly with a BatchSize) are reported as an error before
+// anything is opened.
+func Open(path string, options Options) (*LMDBClient, error) {
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	options.setDefaults()
+
+	environment, err := setupEnvironment(path, &options)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.Flags&ReadOnly != 0 {
+		return readOnlyLMDBClient(environment, &options), nil
+
+	} else {
+		client, err := spawnLMDBActor(environment, &options)
+		if err != nil {
+			environment.close()
+			return nil, err
+		}
+		return client, nil
+	}
+}
+
+func (self *Options) validate() error {
+	if self.Flags&writeMap != 0 {
+		return errors.New("Invalid Options: WriteMap is not supported, as it is incompatible with nested transactions")
+	}
+	if self.Flags&ReadOnly != 0 {
+		if self.BatchSize != 0 {
+			return errors.New("Invalid Options: BatchSize cannot be used with ReadOnly")
+		}
+		if self.Manager != nil {
+			return errors.New("Invalid Options: Manager cannot be used with ReadOnly, as no actor is spawned")
+		}
+		if self.MapSizePolicy != (MapSizePolicy{}) {
+			return errors.New("Invalid Options: MapSizePolicy cannot be used with ReadOnly")
+		}
+		if self.ReaderCheckInterval != 0 {
+			return errors.New("Invalid Options: ReaderCheckInterval cannot be used with ReadOnly, as no actor is spawned")
+		}
+		if self.SlowUpdateThreshold != 0 {
+			return errors.New("Invalid Options: SlowUpdateThreshold cannot be used with ReadOnly")
+		}
+		if self.OnDegraded != nil {
+			return errors.New("Invalid Options: OnDegraded cannot be used with ReadOnly")
+		}
+		if self.ExpirySweepInterval != 0 || self.ExpirySweepBatchSize != 0 {
+			return errors.New("Invalid Options: ExpirySweepInterval and ExpirySweepBatchSize cannot be used with ReadOnly, as no actor is spawned")
+		}
+	}
+	if self.ExpirySweepInterval < 0 {
+		return errors.New("Invalid Options: ExpirySweepInterval must not be negative")
+	}
+	if self.ReaderCheckInterval < 0 {
+		return errors.New("Invalid Options: ReaderCheckInterval must not be negative")
+	}
+	if self.SlowViewThreshold < 0 || self.SlowUpdateThreshold < 0 {
+		return errors.New("Invalid Options: SlowViewThreshold and SlowUpdateThreshold must not be negative")
+	}
+	if self.MapSizePolicy != (MapSizePolicy{}) {
+		if err := self.MapSizePolicy.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *Options) setDefaults() {
+	if !self.positional {
+		if self.Mode == 0 {
+			self.Mode = DefaultMode
+		}
+		if self.NumReaders == 0 {
+			self.NumReaders = DefaultNumReaders
+		}
+		if self.BatchSize == 0 {
+			self.BatchSize = DefaultBatchSize
+		}
+	}
+	if self.MapSizePolicy == (MapSizePolicy{}) {
+		self.MapSizePolicy = DefaultMapSizePolicy()
+	}
+	if self.Metrics == nil {
+		self.Metrics = NopMetrics{}
+	}
+	if self.Tracer == nil {
+		self.Tracer = NopTracer{}
+	}
+	if self.ExpirySweepBatchSize == 0 {
+		self.ExpirySweepBatchSize = DefaultExpirySweepBatchSize
+	}
+}
@@ -0,0 +1,104 @@
+package golmdb_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/matryer/is"
+
+	"wellquite.org/golmdb"
+)
+
+func TestOpenOptions(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	dir, err := os.MkdirTemp("", "golmdb")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	// the zero value should be fine
+	client, err := golmdb.Open(dir, golmdb.Options{})
+	is.NoErr(err)
+	client.TerminateSync()
+
+	key := []byte("hello")
+	client, err = golmdb.Open(dir, golmdb.Options{
+		Log:           log,
+		NumReaders:    16,
+		NumDBs:        4,
+		Flags:         golmdb.NoReadAhead,
+		BatchSize:     4,
+		MapSizePolicy: golmdb.MapSizePolicy{InitialSize: 4 << 20, GrowthFactor: 2},
+	})
+	is.NoErr(err)
+	dbRef, err := createDBRef(client, t.Name(), 0)
+	is.NoErr(err)
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		return txn.Put(dbRef, key, key, 0)
+	})
+	is.NoErr(err)
+	client.TerminateSync()
+
+	client, err = golmdb.Open(dir, golmdb.Options{NumDBs: 4, Flags: golmdb.ReadOnly})
+	is.NoErr(err)
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		dbRef, err := txn.DBRef(t.Name(), 0)
+		if err != nil {
+			return err
+		}
+		_, err = txn.Get(dbRef, key)
+		return err
+	})
+	is.NoErr(err)
+	client.TerminateSync()
+}
+
+func TestOpenOptionsValidation(t *testing.T) {
+	is := is.New(t)
+
+	dir, err := os.MkdirTemp("", "golmdb")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	for _, options := range []golmdb.Options{
+		{Flags: golmdb.ReadOnly, BatchSize: 16},
+		{Flags: golmdb.ReadOnly, MapSizePolicy: golmdb.DefaultMapSizePolicy()},
+		{MapSizePolicy: golmdb.MapSizePolicy{InitialSize: 4 << 20}},
+	} {
+		_, err = golmdb.Open(dir, options)
+		is.True(err != nil)
+	}
+
+	// nothing should have been created
+	entries, err := os.ReadDir(dir)
+	is.NoErr(err)
+	is.Equal(len(entries), 0)
+}
+
+func TestNewLMDBZeroValues(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	dir, err := os.MkdirTemp("", "golmdb")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	// NewLMDB doesn't apply Open's defaults: 0 readers is rejected by
+	// LMDB, as it always has been.
+	_, err = golmdb.NewLMDB(log, dir, 0666, 0, 4, 0, 16)
+	is.True(err != nil)
+
+	// a batchSize of 0 means no limit on the batch size.
+	client, err := golmdb.NewLMDB(log, dir, 0666, 16, 4, 0, 0)
+	is.NoErr(err)
+	defer client.TerminateSync()
+	dbRef, err := createDBRef(client, t.Name(), 0)
+	is.NoErr(err)
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		return txn.Put(dbRef, []byte("hello"), []byte("world"), 0)
+	})
+	is.NoErr(err)
+}
@@ -0,0 +1,180 @@
+package golmdb
+
+/*
+#include <stdlib.h>
+#include <lmdb.h>
+#include "golmdb.h"
+*/
+import "C"
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+// A ReaderInfo describes a slot in LMDB's reader table. Every process
+// that has the database open shares the same reader table, so this
+// includes readers from other processes.
+type ReaderInfo struct {
+	// The process that owns the slot.
+	PID int
+	// The thread that owns the slot. Because golmdb uses NoTLS, this
+	// is the thread that last began a View in the slot, and has
+	// little meaning for Go programs.
+	Thread uint64
+	// The snapshot the reader is using. Only meaningful if Active.
+	TxnID uint64
+	// Whether a read transaction is currently running in the slot.
+	Active bool
+}
+
+// ReaderList lists the slots in LMDB's reader table that are in use.
+//
+// The number of slots is fixed when the database is opened (see
+// Options.NumReaders). Slots belonging to processes that crashed are
+// not freed automatically; see ReaderCheck.
+//
+// See http://www.lmdb.tech/doc/group__mdb.html#ga8550000cd0501a44f57ee6dff0188744
+func (self *LMDBClient) ReaderList() ([]ReaderInfo, error) {
+	if err := self.inFlight.enter(); err != nil {
+		return nil, err
+	}
+	defer self.inFlight.exit()
+	self.resizingLock.RLock()
+	defer self.resizingLock.RUnlock()
+	return self.environment.readerList()
+}
+
+// ReaderCheck clears the slots in LMDB's reader table that belong to
+// processes which no longer exist, and returns how many were
+// cleared. Stale slots both use up the table (leading to ReadersFull
+// errors) and prevent the pages of old snapshots from being reused
+// (causing the data file to grow).
+//
+// This can be run periodically by the actor: see
+// Options.ReaderCheckInterval.
+//
+// See http://www.lmdb.tech/doc/group__mdb.html#ga366923d08bb384b3d9580a98edf5d668
+func (self *LMDBClient) ReaderCheck() (int, error) {
+	if err := self.inFlight.enter(); err != nil {
+		return 0, err
+	}
+	defer self.inFlight.exit()
+	self.resizingLock.RLock()
+	defer self.resizingLock.RUnlock()
+	return self.environment.readerCheck()
+}
+
+// mdb_reader_list. http://www.lmdb.tech/doc/group__mdb.html#ga8550000cd0501a44f57ee6dff0188744
+func (self *environment) readerList() ([]ReaderInfo, error) {
+	var cOut *C.char
+	var cOutLen C.size_t
+	if err := asError(C.golmdb_mdb_reader_list(self.env, &cOut, &cOutLen)); err != nil {
+		return nil, err
+	}
+	out := C.GoStringN(cOut, C.int(cOutLen))
+	C.free(unsafe.Pointer(cOut))
+	return parseReaderList(out)
+}
+
+// The output of mdb_reader_list is a header line, followed by one
+// line per slot of pid (decimal), thread (hex), and txn id (decimal,
+// or "-" if the slot is idle). If there are no slots in use, there's
+// just a single line saying so.
+func parseReaderList(out string) ([]ReaderInfo, error) {
+	var readers []ReaderInfo
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[0] == "pid" || strings.HasPrefix(fields[0], "(") {
+			continue // header, or "(no active readers)"
+		}
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse reader list line %q: %w", scanner.Text(), err)
+		}
+		thread, err := strconv.ParseUint(fields[1], 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse reader list line %q: %w", scanner.Text(), err)
+		}
+		reader := ReaderInfo{PID: pid, Thread: thread}
+		if fields[2] != "-" {
+			reader.TxnID, err = strconv.ParseUint(fields[2], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to parse reader list line %q: %w", scanner.Text(), err)
+			}
+			reader.Active = true
+		}
+		readers = append(readers, reader)
+	}
+	return readers, scanner.Err()
+}
+
+// mdb_reader_check. http://www.lmdb.tech/doc/group__mdb.html#ga366923d08bb384b3d9580a98edf5d668
+func (self *environment) readerCheck() (int, error) {
+	var dead C.int
+	if err := asError(C.mdb_reader_check(self.env, &dead)); err != nil {
+		return 0, err
+	}
+	return int(dead), nil
+}
+
+// --- Server side ---
+
+// Sent asynchronously: nothing waits for the check.
+type readerCheckMsg struct{}
+
+// Arms the timer which will send the next readerCheckMsg to the actor.
+func (self *server) scheduleReaderCheck() {
+	if self.readerCheckInterval <= 0 {
+		return
+	}
+	self.readerCheckTimer = time.AfterFunc(self.readerCheckInterval, func() {
+		self.selfClient.Send(&readerCheckMsg{})
+	})
+}
+
+func (self *server) checkReaders() error {
+	defer self.scheduleReaderCheck()
+
+	dead, err := self.environment.readerCheck()
+	if err != nil {
+		self.Log.Error().Err(err).Msg("checking readers")
+		return nil // not fatal: the database itself is fine.
+	}
+	readers, err := self.environment.readerList()
+	if err != nil {
+		self.Log.Error().Err(err).Msg("listing readers")
+		return nil
+	}
+	info, err := self.environment.info()
+	if err != nil {
+		return err
+	}
+
+	active := 0
+	oldestTxnID := info.lastTxnID
+	for _, reader := range readers {
+		if reader.Active {
+			active++
+			if reader.TxnID < oldestTxnID {
+				oldestTxnID = reader.TxnID
+			}
+		}
+	}
+
+	event := self.Log.Debug()
+	if dead > 0 {
+		event = self.Log.Info()
+	}
+	if event.Enabled() {
+		// The age of the oldest reader is measured in txns: how many
+		// txns have committed since its snapshot. Pages freed by those
+		// txns cannot be reused until that reader finishes.
+		event.Int("stale slots cleared", dead).Int("active readers", active).Uint64("oldest reader age (txns)", info.lastTxnID-oldestTxnID).Msg("reader check")
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package golmdb_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"wellquite.org/golmdb"
+)
+
+func TestReaderList(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	dir, err := os.MkdirTemp("", "golmdb")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	client, err := golmdb.Open(dir, golmdb.Options{
+		Log:                 log,
+		NumDBs:              4,
+		ReaderCheckInterval: 10 * time.Millisecond,
+	})
+	is.NoErr(err)
+	defer client.TerminateSync()
+
+	dbRef, err := createDBRef(client, t.Name(), 0)
+	is.NoErr(err)
+
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		readers, err := client.ReaderList()
+		if err != nil {
+			return err
+		}
+		active := 0
+		for _, reader := range readers {
+			if reader.Active {
+				is.Equal(reader.PID, os.Getpid())
+				active++
+			}
+		}
+		is.Equal(active, 1)
+		_, err = txn.Get(dbRef, []byte("missing"))
+		is.True(errors.Is(err, golmdb.NotFound))
+		return nil
+	})
+	is.NoErr(err)
+
+	// all readers are in this process, so none can be stale.
+	dead, err := client.ReaderCheck()
+	is.NoErr(err)
+	is.Equal(dead, 0)
+
+	// give the periodic check a chance to run.
+	time.Sleep(50 * time.Millisecond)
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		return txn.Put(dbRef, []byte("key"), []byte("value"), 0)
+	})
+	is.NoErr(err)
+}
@@ -0,0 +1,98 @@
+package golmdb
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// ReaderSlotStats describes how Views (and Copies) are being admitted
+// to LMDB's reader table. See LMDBClient.ReaderSlotStats.
+type ReaderSlotStats struct {
+	// The number of slots: Options.NumReaders.
+	Capacity int
+	// The number of slots currently in use by this client.
+	InUse int
+	// The number of Views currently waiting for a slot: the queue
+	// depth.
+	Waiting int
+	// The total number of Views that have had to wait for a slot.
+	Waits uint64
+	// The total time spent by Views waiting for a slot.
+	WaitTime time.Duration
+	// The total number of Views that gave up waiting because their
+	// context was done.
+	Cancelled uint64
+}
+
+// LMDB's reader table has a fixed number of slots, and every read txn
+// needs one. If more read txns are started concurrently than there
+// are slots, mdb_txn_begin fails with ReadersFull. readerSlots is a
+// semaphore sized to the reader table so that instead, read txns
+// queue until a slot is free.
+//
+// A nil *readerSlots imposes no limit.
+type readerSlots struct {
+	// 64-bit atomics first for alignment on 32-bit platforms.
+	waitNanos int64
+	waits     uint64
+	cancelled uint64
+	waiting   int64
+	slots     chan struct{}
+}
+
+func newReaderSlots(numReaders uint) *readerSlots {
+	return &readerSlots{
+		slots: make(chan struct{}, numReaders),
+	}
+}
+
+// Blocks until a slot is free, or the ctx is done. If the error is
+// nil, release must be called once the read txn has finished.
+func (self *readerSlots) acquire(ctx context.Context) error {
+	if self == nil {
+		return nil
+	}
+	select {
+	case self.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	atomic.AddInt64(&self.waiting, 1)
+	start := time.Now()
+	defer func() {
+		atomic.AddInt64(&self.waitNanos, int64(time.Since(start)))
+		atomic.AddUint64(&self.waits, 1)
+		atomic.AddInt64(&self.waiting, -1)
+	}()
+
+	select {
+	case self.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		atomic.AddUint64(&self.cancelled, 1)
+		return ctx.Err()
+	}
+}
+
+func (self *readerSlots) release() {
+	if self == nil {
+		return
+	}
+	<-self.slots
+}
+
+func (self *readerSlots) stats() ReaderSlotStats {
+	if self == nil {
+		return ReaderSlotStats{}
+	}
+	return ReaderSlotStats{
+		Capacity:  cap(self.slots),
+		InUse:     len(self.slots),
+		Waiting:   int(atomic.LoadInt64(&self.waiting)),
+		Waits:     atomic.LoadUint64(&self.waits),
+		WaitTime:  time.Duration(atomic.LoadInt64(&self.waitNanos)),
+		Cancelled: atomic.LoadUint64(&self.cancelled),
+	}
+}
@@ -0,0 +1,86 @@
+package golmdb_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"wellquite.org/golmdb"
+)
+
+func TestReaderSlotAdmission(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	dir, err := os.MkdirTemp("", "golmdb")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	const numReaders = 2
+	client, err := golmdb.Open(dir, golmdb.Options{Log: log, NumReaders: numReaders})
+	is.NoErr(err)
+	defer client.TerminateSync()
+
+	// many more concurrent Views than reader slots: without admission
+	// control, some of these would fail with ReadersFull.
+	var wg sync.WaitGroup
+	errs := make(chan error, 8*numReaders)
+	for idx := 0; idx < 8*numReaders; idx++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- client.View(func(txn *golmdb.ReadOnlyTxn) error {
+				time.Sleep(5 * time.Millisecond)
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		is.NoErr(err)
+	}
+
+	stats := client.ReaderSlotStats()
+	is.Equal(stats.Capacity, numReaders)
+	is.Equal(stats.InUse, 0)
+	is.Equal(stats.Waiting, 0)
+	is.True(stats.Waits > 0)
+	is.True(stats.WaitTime > 0)
+
+	// occupy every slot, then check a View with a deadline gives up.
+	release := make(chan struct{})
+	for idx := 0; idx < numReaders; idx++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.View(func(txn *golmdb.ReadOnlyTxn) error {
+				<-release
+				return nil
+			})
+		}()
+	}
+	for client.ReaderSlotStats().InUse != numReaders {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	ran := false
+	err = client.ViewContext(ctx, func(txn *golmdb.ReadOnlyTxn) error {
+		ran = true
+		return nil
+	})
+	is.True(errors.Is(err, context.DeadlineExceeded))
+	is.True(!ran)
+	is.Equal(client.ReaderSlotStats().Cancelled, uint64(1))
+
+	close(release)
+	wg.Wait()
+}
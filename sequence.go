@@ -0,0 +1,196 @@
+package golmdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+)
+
+// The reserved database in which sequences are kept: one key per
+// sequence, with the last value allocated as an 8-byte big-endian
+// uint64. It uses one of the Options.NumDBs named databases.
+const sequencesDBName = "golmdb.sequences"
+
+// NextSequence increments the named sequence, and returns its new
+// value. The first value of a sequence is 1.
+//
+// The increment is part of the txn, so it only takes effect if the txn
+// commits. Update may run a txn fun more than once (see
+// LMDBClient.Update), but each time on a fresh txn: a run which is
+// aborted leaves the sequence untouched, and the next run sees the
+// same value as before. So the values returned to txns which commit
+// are unique, strictly increasing in commit order, and have no gaps.
+// The flip side is that a value is only allocated once Update has
+// returned nil: until then, do not use it outside the txn.
+func (self *ReadWriteTxn) NextSequence(name string) (uint64, error) {
+	return self.ReserveSequence(name, 1)
+}
+
+// ReserveSequence advances the named sequence by count, and returns
+// the first of the count values reserved. The same guarantees apply
+// as for NextSequence.
+func (self *ReadWriteTxn) ReserveSequence(name string, count uint64) (first uint64, err error) {
+	if name == "" {
+		return 0, errors.New("Cannot reserve sequence: name must not be empty")
+	}
+	if count == 0 {
+		return 0, errors.New("Cannot reserve sequence: count must be greater than 0")
+	}
+	db, err := self.sequencesDB()
+	if err != nil {
+		return 0, err
+	}
+	last, err := self.sequence(db, name)
+	if err != nil {
+		return 0, err
+	}
+	if last > math.MaxUint64-count {
+		return 0, fmt.Errorf("Cannot reserve sequence: %q would overflow", name)
+	}
+	if err = self.Put(db, []byte(name), binary.BigEndian.AppendUint64(nil, last+count), 0); err != nil {
+		return 0, err
+	}
+	return last + 1, nil
+}
+
+// Sequence returns the last value allocated from the named sequence,
+// or 0 if none has been.
+func (self *ReadOnlyTxn) Sequence(name string) (uint64, error) {
+	if name == "" {
+		return 0, errors.New("Cannot read sequence: name must not be empty")
+	}
+	db, found := self.sequences.get()
+	if !found {
+		var err error
+		db, err = self.DBRef(sequencesDBName, 0)
+		if errors.Is(err, NotFound) {
+			return 0, nil
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	return self.sequence(db, name)
+}
+
+// Opening a DBRef is not free (and within an Update, it is recorded
+// until the txn commits), so once a txn which opened the sequences
+// database has committed, its DBRef is reused.
+func (self *ReadWriteTxn) sequencesDB() (DBRef, error) {
+	db, found := self.sequences.get()
+	// it may have been opened (or dropped) earlier in this txn.
+	for _, op := range self.dbRefOps {
+		if op.dropped && found && op.dbRef == db {
+			found = false
+		} else if !op.dropped && op.name == sequencesDBName {
+			db, found = op.dbRef, true
+		}
+	}
+	if found {
+		return db, nil
+	}
+	return self.DBRef(sequencesDBName, Create)
+}
+
+// The DBRef of the sequences database, once a txn which opened it has
+// committed.
+type sequencesRef struct {
+	lock  sync.RWMutex
+	db    DBRef
+	found bool
+}
+
+func (self *sequencesRef) get() (DBRef, bool) {
+	if self == nil {
+		return 0, false
+	}
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.db, self.found
+}
+
+// Called with each dbRefOp once its txn has committed.
+func (self *sequencesRef) apply(op dbRefOp) {
+	if self == nil {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !op.dropped && op.name == sequencesDBName {
+		self.db, self.found = op.dbRef, true
+	} else if op.dropped && self.found && op.dbRef == self.db {
+		self.found = false
+	}
+}
+
+func (self *ReadOnlyTxn) sequence(db DBRef, name string) (uint64, error) {
+	val, err := self.Get(db, []byte(name))
+	if errors.Is(err, NotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if len(val) != 8 {
+		return 0, fmt.Errorf("Sequence %q has a value of %d bytes: %w", name, len(val), Corrupted)
+	}
+	return binary.BigEndian.Uint64(val), nil
+}
+
+// A SequenceAllocator hands out values of a named sequence without an
+// Update for every value: it leases a range of values at a time (with
+// ReserveSequence) and hands them out from memory.
+//
+// Each lease is committed before any of its values are handed out, so
+// every value Next returns is unique, across all allocators and
+// NextSequence calls on the same sequence, in this and other
+// processes. Values from one allocator are strictly increasing. But
+// values from different allocators interleave, so they are not
+// ordered overall; and the unused remainder of a lease is lost when
+// the allocator is discarded, leaving gaps. If you need gap-free
+// values in commit order, use NextSequence.
+//
+// A SequenceAllocator is safe for concurrent use.
+type SequenceAllocator struct {
+	client    *LMDBClient
+	name      string
+	leaseSize uint64
+
+	lock  sync.Mutex
+	next  uint64
+	limit uint64 // exclusive
+}
+
+// NewSequenceAllocator creates an allocator for the named sequence
+// which leases leaseSize values at a time. If leaseSize is 0, it
+// leases 1000 at a time.
+func (self *LMDBClient) NewSequenceAllocator(name string, leaseSize uint64) *SequenceAllocator {
+	if leaseSize == 0 {
+		leaseSize = 1000
+	}
+	return &SequenceAllocator{client: self, name: name, leaseSize: leaseSize}
+}
+
+// Next returns the next value. When the current lease is used up, this
+// runs an Update to take a new lease, so Next must not be called from
+// within an Update's txn fun: that would deadlock. Within an Update,
+// use NextSequence instead.
+func (self *SequenceAllocator) Next() (uint64, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.next == self.limit {
+		var first uint64
+		err := self.client.Update(func(txn *ReadWriteTxn) (err error) {
+			first, err = txn.ReserveSequence(self.name, self.leaseSize)
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+		self.next, self.limit = first, first+self.leaseSize
+	}
+	value := self.next
+	self.next++
+	return value, nil
+}
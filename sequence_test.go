@@ -0,0 +1,131 @@
+package golmdb_test
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/matryer/is"
+
+	"wellquite.org/golmdb"
+)
+
+func TestNextSequence(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	defer client.TerminateSync()
+
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		last, err := txn.Sequence("orders")
+		is.NoErr(err)
+		is.Equal(last, uint64(0))
+		return nil
+	})
+	is.NoErr(err)
+
+	for expected := uint64(1); expected <= 3; expected++ {
+		var id uint64
+		err = client.Update(func(txn *golmdb.ReadWriteTxn) (err error) {
+			id, err = txn.NextSequence("orders")
+			return err
+		})
+		is.NoErr(err)
+		is.Equal(id, expected)
+	}
+
+	// an aborted txn doesn't advance the sequence.
+	abort := errors.New("abort")
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		id, err := txn.NextSequence("orders")
+		is.NoErr(err)
+		is.Equal(id, uint64(4))
+		return abort
+	})
+	is.True(errors.Is(err, abort))
+
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		first, err := txn.ReserveSequence("orders", 10)
+		is.NoErr(err)
+		is.Equal(first, uint64(4))
+		id, err := txn.NextSequence("orders")
+		is.NoErr(err)
+		is.Equal(id, uint64(14))
+		// sequences are independent.
+		id, err = txn.NextSequence("invoices")
+		is.NoErr(err)
+		is.Equal(id, uint64(1))
+		return nil
+	})
+	is.NoErr(err)
+
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		last, err := txn.Sequence("orders")
+		is.NoErr(err)
+		is.Equal(last, uint64(14))
+		return nil
+	})
+	is.NoErr(err)
+}
+
+func TestSequenceAllocator(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	defer client.TerminateSync()
+
+	allocators := []*golmdb.SequenceAllocator{
+		client.NewSequenceAllocator("ids", 10),
+		client.NewSequenceAllocator("ids", 7),
+	}
+
+	const perGoroutine = 50
+	var lock sync.Mutex
+	seen := make(map[uint64]bool)
+	var wg sync.WaitGroup
+	for idx := 0; idx < 8; idx++ {
+		allocator := allocators[idx%len(allocators)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			previous := uint64(0)
+			for n := 0; n < perGoroutine; n++ {
+				id, err := allocator.Next()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if id <= previous {
+					t.Errorf("id %d not greater than %d", id, previous)
+				}
+				previous = id
+				lock.Lock()
+				if seen[id] {
+					t.Errorf("id %d allocated twice", id)
+				}
+				seen[id] = true
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	is.Equal(len(seen), 8*perGoroutine)
+
+	// NextSequence on the same sequence never collides with leases.
+	var id uint64
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) (err error) {
+		id, err = txn.NextSequence("ids")
+		return err
+	})
+	is.NoErr(err)
+	is.True(!seen[id])
+}
@@ -0,0 +1,154 @@
+package golmdb
+
+import (
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Callers captured for slow txn logging. Only captured if
+// Options.SlowTxnStacks is set.
+type callers []uintptr
+
+const maxCallers = 32
+
+// Capture the stack of whoever called the method which calls this.
+func captureCallers(enabled bool) callers {
+	if !enabled {
+		return nil
+	}
+	pcs := make([]uintptr, maxCallers)
+	// skip runtime.Callers, captureCallers, and our own method.
+	return callers(pcs[:runtime.Callers(3, pcs)])
+}
+
+func (self callers) String() string {
+	var builder strings.Builder
+	frames := runtime.CallersFrames(self)
+	for {
+		frame, more := frames.Next()
+		builder.WriteString(frame.Function)
+		builder.WriteString("\n\t")
+		builder.WriteString(frame.File)
+		builder.WriteByte(':')
+		builder.WriteString(strconv.Itoa(frame.Line))
+		builder.WriteByte('\n')
+		if !more {
+			break
+		}
+	}
+	return builder.String()
+}
+
+func (self callers) addTo(event *zerolog.Event) *zerolog.Event {
+	if len(self) == 0 {
+		return event
+	}
+	return event.Str("stack", self.String())
+}
+
+// --- Client side ---
+
+// Settings for slow txn logging on the client side.
+type slowTxns struct {
+	log           zerolog.Logger
+	viewThreshold time.Duration
+	stacks        bool
+}
+
+func newSlowTxns(log zerolog.Logger, options *Options) slowTxns {
+	return slowTxns{
+		log:           log,
+		viewThreshold: options.SlowViewThreshold,
+		stacks:        options.SlowTxnStacks,
+	}
+}
+
+func (self *slowTxns) logIfSlowView(id uint64, duration time.Duration, stack callers) {
+	if self.viewThreshold <= 0 || duration < self.viewThreshold {
+		return
+	}
+	stack.addTo(self.log.Warn().Uint64("view id", id).Dur("duration", duration)).Msg("slow View")
+}
+
+// --- Server side ---
+
+// The watchdog warns whilst an Update's txn fun is running for longer
+// than the slow Update threshold. A single timer is used: it is armed
+// before each txn fun is run, and stopped afterwards. If it fires, the
+// fun that's running is still recorded in running, and the timer
+// re-arms itself to warn again.
+type watchdog struct {
+	threshold time.Duration
+	timer     *time.Timer
+	// The update id of the txn fun that's running (0 if none), and
+	// when it started (in UnixNano).
+	running      uint64
+	runningStart int64
+	log          zerolog.Logger
+}
+
+func newWatchdog(log zerolog.Logger, threshold time.Duration) *watchdog {
+	if threshold <= 0 {
+		return nil
+	}
+	self := &watchdog{
+		threshold: threshold,
+		log:       log,
+	}
+	self.timer = time.AfterFunc(threshold, self.fired)
+	self.timer.Stop()
+	return self
+}
+
+func (self *watchdog) start(updateID uint64, now time.Time) {
+	if self == nil {
+		return
+	}
+	atomic.StoreInt64(&self.runningStart, now.UnixNano())
+	atomic.StoreUint64(&self.running, updateID)
+	self.timer.Reset(self.threshold)
+}
+
+func (self *watchdog) finish() {
+	if self == nil {
+		return
+	}
+	atomic.StoreUint64(&self.running, 0)
+	self.timer.Stop()
+}
+
+func (self *watchdog) fired() {
+	updateID := atomic.LoadUint64(&self.running)
+	if updateID == 0 {
+		return
+	}
+	elapsed := time.Since(time.Unix(0, atomic.LoadInt64(&self.runningStart)))
+	if elapsed < self.threshold {
+		// a different fun started since the timer was armed.
+		self.timer.Reset(self.threshold - elapsed)
+		return
+	}
+	self.log.Warn().Uint64("update id", updateID).Dur("running for", elapsed).Msg("Update txn fun still running; all other Updates are blocked")
+	self.timer.Reset(self.threshold)
+}
+
+func (self *server) logIfSlowUpdate(msg *readWriteTxnMsg, duration time.Duration) {
+	if self.slowUpdateThreshold <= 0 || duration < self.slowUpdateThreshold {
+		return
+	}
+	msg.callers.addTo(self.Log.Warn().Uint64("update id", msg.id).Uint64("batch id", self.batchID).Dur("duration", duration)).Msg("slow Update txn fun")
+}
+
+// Called once the actor has had to wait for Views to finish so that
+// it can take the resizingLock.
+func (self *server) logIfSlowViews(waited time.Duration) {
+	if self.slowViewThreshold <= 0 || waited < self.slowViewThreshold {
+		return
+	}
+	self.Log.Warn().Dur("waited", waited).Msg("slow Views delayed resizing; Updates were blocked")
+}
@@ -0,0 +1,74 @@
+package golmdb_test
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/rs/zerolog"
+
+	"wellquite.org/golmdb"
+)
+
+// The watchdog logs from its own go-routine.
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (self *lockedBuffer) Write(p []byte) (int, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.buf.Write(p)
+}
+
+func (self *lockedBuffer) String() string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.buf.String()
+}
+
+func TestSlowTxnLogging(t *testing.T) {
+	is := is.New(t)
+
+	// we need the warnings to actually be written, regardless of -v.
+	defer zerolog.SetGlobalLevel(zerolog.GlobalLevel())
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+
+	dir, err := os.MkdirTemp("", "golmdb")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	logs := new(lockedBuffer)
+	client, err := golmdb.Open(dir, golmdb.Options{
+		Log:                 zerolog.New(logs),
+		SlowViewThreshold:   5 * time.Millisecond,
+		SlowUpdateThreshold: 10 * time.Millisecond,
+		SlowTxnStacks:       true,
+	})
+	is.NoErr(err)
+	defer client.TerminateSync()
+
+	// fast txns are not logged.
+	is.NoErr(client.View(func(txn *golmdb.ReadOnlyTxn) error { return nil }))
+	is.NoErr(client.Update(func(txn *golmdb.ReadWriteTxn) error { return nil }))
+	is.Equal(logs.String(), "")
+
+	is.NoErr(client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	}))
+	is.True(strings.Contains(logs.String(), "slow View"))
+	is.True(strings.Contains(logs.String(), "TestSlowTxnLogging")) // the stack
+
+	is.NoErr(client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		time.Sleep(35 * time.Millisecond)
+		return nil
+	}))
+	is.True(strings.Contains(logs.String(), "slow Update txn fun"))
+	is.True(strings.Contains(logs.String(), "Update txn fun still running"))
+}
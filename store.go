@@ -0,0 +1,436 @@
+package golmdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"wellquite.org/golmdb/tuple"
+)
+
+// A Store keeps values of the struct type T in a named database,
+// keyed by the field of T tagged `golmdb:"pk"`. Fields tagged
+// `golmdb:"index"` or `golmdb:"unique"` are indexed (see Index), and
+// values can be found by them with FindBy and RangeBy. For example:
+//
+//	type User struct {
+//		ID    uint64   `golmdb:"pk"`
+//		Email string   `golmdb:"unique"`
+//		City  string   `golmdb:"index"`
+//		Tags  []string `golmdb:"index"`
+//	}
+//
+// The primary key and indexed fields must be exported, and of a
+// boolean, integer, float, string or []byte kind. An indexed field may
+// also be a slice of those, in which case each element is indexed.
+// Field values are encoded with the tuple package, so that ranges of
+// them are in their natural order.
+//
+// The values themselves are encoded with the Store's Codec. A stored
+// value which cannot be decoded is not indexed (see Index.Verify).
+//
+// Each index is kept in its own named database, called
+// "<name>.<field>", so Options.NumDBs must allow for them.
+type Store[T any] struct {
+	name   string
+	table  *Table[[]byte, T]
+	pk     storeField
+	fields map[string]*storeField
+	// the indexed fields, in the order of T's fields
+	indexed []*storeField
+}
+
+type storeField struct {
+	name  string
+	index []int
+	// the type of the field, or of its elements if multi.
+	fieldType reflect.Type
+	unique    bool
+	multi     bool
+	// nil for the primary key.
+	dbIndex *Index
+}
+
+// NewStore opens (creating if necessary) the named database, and the
+// databases for the indexes of T, and declares those indexes. If codec
+// is nil, JSONCodec[T] is used.
+//
+// As with DeclareIndex, a Store must be created every time the
+// database is opened, before it is written to, and requires a
+// read-write client.
+func NewStore[T any](client *LMDBClient, name string, codec Codec[T]) (*Store[T], error) {
+	if codec == nil {
+		codec = JSONCodec[T]{}
+	}
+	self := &Store[T]{name: name, fields: make(map[string]*storeField)}
+
+	structType := reflect.TypeOf((*T)(nil)).Elem()
+	if structType.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("Cannot create Store: %v is not a struct", structType)
+	}
+	foundPK := false
+	for _, field := range reflect.VisibleFields(structType) {
+		tag, found := field.Tag.Lookup("golmdb")
+		if !found {
+			continue
+		}
+		if !field.IsExported() {
+			return nil, fmt.Errorf("Cannot create Store: field %s is tagged but not exported", field.Name)
+		}
+		storeField := storeField{name: field.Name, index: field.Index}
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Slice && fieldType.Elem().Kind() != reflect.Uint8 {
+			storeField.multi = true
+			fieldType = fieldType.Elem()
+		}
+		storeField.fieldType = fieldType
+		if !isStoreKeyKind(fieldType) {
+			return nil, fmt.Errorf("Cannot create Store: field %s is of unsupported type %v", field.Name, field.Type)
+		}
+		switch tag {
+		case "pk":
+			if foundPK {
+				return nil, fmt.Errorf("Cannot create Store: %v has more than one pk field", structType)
+			}
+			if storeField.multi {
+				return nil, fmt.Errorf("Cannot create Store: pk field %s must not be a slice", field.Name)
+			}
+			foundPK = true
+			self.pk = storeField
+		case "index", "unique":
+			storeField.unique = tag == "unique"
+			self.fields[field.Name] = &storeField
+			self.indexed = append(self.indexed, &storeField)
+		default:
+			return nil, fmt.Errorf("Cannot create Store: field %s has unknown tag %q", field.Name, tag)
+		}
+	}
+	if !foundPK {
+		return nil, fmt.Errorf("Cannot create Store: %v has no pk field", structType)
+	}
+
+	var db DBRef
+	err := client.Update(func(txn *ReadWriteTxn) (err error) {
+		db, err = txn.DBRef(name, Create)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	self.table = NewTable[[]byte, T](db, RawCodec{}, codec)
+
+	for _, field := range self.indexed {
+		field := field
+		flags := IndexFlag(0)
+		if field.unique {
+			flags = UniqueIndex
+		}
+		field.dbIndex, err = client.DeclareIndex(db, name+"."+field.name, flags, func(key, val []byte) [][]byte {
+			value, err := codec.Decode(val)
+			if err != nil {
+				return nil // Index.Verify will report the missing entries.
+			}
+			indexKeys, _ := field.keys(reflect.ValueOf(&value).Elem())
+			return indexKeys
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return self, nil
+}
+
+func isStoreKeyKind(fieldType reflect.Type) bool {
+	switch fieldType.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	case reflect.Slice:
+		return fieldType.Elem().Kind() == reflect.Uint8
+	default:
+		return false
+	}
+}
+
+// Encodes a field value (or a value given for a field) with the tuple
+// package. Named types are encoded as their underlying kind.
+func encodeStoreKey(value reflect.Value) ([]byte, error) {
+	if !value.IsValid() {
+		return nil, errors.New("Keys must not be nil")
+	}
+	var elem any
+	switch value.Kind() {
+	case reflect.Bool:
+		elem = value.Bool()
+	case reflect.String:
+		elem = value.String()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		elem = value.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		elem = value.Uint()
+	case reflect.Float32:
+		elem = float32(value.Float())
+	case reflect.Float64:
+		elem = value.Float()
+	case reflect.Slice:
+		if value.Type().Elem().Kind() != reflect.Uint8 {
+			return nil, fmt.Errorf("Unsupported key type %v", value.Type())
+		}
+		elem = value.Bytes()
+	default:
+		return nil, fmt.Errorf("Unsupported key type %v", value.Type())
+	}
+	return tuple.Tuple{elem}.Pack()
+}
+
+// The classes of kinds of key between which values given for a field
+// are never converted.
+const (
+	boolKey = iota + 1
+	numberKey
+	bytesKey
+)
+
+func storeKeyClass(keyType reflect.Type) int {
+	switch keyType.Kind() {
+	case reflect.Bool:
+		return boolKey
+	case reflect.String, reflect.Slice:
+		return bytesKey
+	default:
+		return numberKey
+	}
+}
+
+// Encodes a value given for this field (e.g. to FindBy) as the
+// field's own values are encoded, converting it to the field's type
+// first: for example, an int given for a uint64 field, or a float64
+// for a float32 field. It is an error if it can't be converted, or if
+// converting it would change it (other than by rounding between
+// floats): a value which cannot be a value of the field would never
+// match anything.
+func (self *storeField) encodeGiven(given any) ([]byte, error) {
+	value := reflect.ValueOf(given)
+	if !value.IsValid() {
+		return nil, errors.New("Keys must not be nil")
+	}
+	givenType := value.Type()
+	if givenType == self.fieldType {
+		return encodeStoreKey(value)
+	}
+	if !isStoreKeyKind(givenType) || storeKeyClass(givenType) != storeKeyClass(self.fieldType) || !value.CanConvert(self.fieldType) {
+		return nil, fmt.Errorf("Cannot use %v as field %s, of type %v", givenType, self.name, self.fieldType)
+	}
+	converted := value.Convert(self.fieldType)
+	if storeKeyClass(givenType) == numberKey && !(isFloatKind(givenType) && isFloatKind(self.fieldType)) {
+		if isNegative(value) != isNegative(converted) || converted.Convert(givenType).Interface() != value.Interface() {
+			return nil, fmt.Errorf("Cannot use %v as field %s, of type %v: it is out of range", given, self.name, self.fieldType)
+		}
+	}
+	return encodeStoreKey(converted)
+}
+
+func isFloatKind(numberType reflect.Type) bool {
+	return numberType.Kind() == reflect.Float32 || numberType.Kind() == reflect.Float64
+}
+
+func isNegative(number reflect.Value) bool {
+	switch number.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return number.Int() < 0
+	case reflect.Float32, reflect.Float64:
+		return number.Float() < 0
+	default:
+		return false
+	}
+}
+
+// The keys of this field within the struct value.
+func (self *storeField) keys(structValue reflect.Value) ([][]byte, error) {
+	value := structValue.FieldByIndex(self.index)
+	if !self.multi {
+		key, err := encodeStoreKey(value)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{key}, nil
+	}
+	keys := make([][]byte, 0, value.Len())
+	for idx := 0; idx < value.Len(); idx++ {
+		key, err := encodeStoreKey(value.Index(idx))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (self *Store[T]) pkOf(value *T) ([]byte, error) {
+	return encodeStoreKey(reflect.ValueOf(value).Elem().FieldByIndex(self.pk.index))
+}
+
+// The DBRef of the database holding the values.
+func (self *Store[T]) DBRef() DBRef {
+	return self.table.DBRef()
+}
+
+// The Index of the named field, for use with Index.Verify and
+// Index.Rebuild.
+func (self *Store[T]) Index(field string) (*Index, error) {
+	storeField, found := self.fields[field]
+	if !found {
+		return nil, fmt.Errorf("Store %q: no indexed field %q", self.name, field)
+	}
+	return storeField.dbIndex, nil
+}
+
+// Insert the value. If a value with the same primary key already
+// exists, the error matches KeyExist. If the value would break a
+// unique index, the error is a *UniqueIndexError (which also matches
+// KeyExist).
+func (self *Store[T]) Insert(txn *ReadWriteTxn, value T) error {
+	return self.put(txn, &value, NoOverwrite)
+}
+
+// Upsert inserts the value, or replaces the existing value with the
+// same primary key.
+func (self *Store[T]) Upsert(txn *ReadWriteTxn, value T) error {
+	return self.put(txn, &value, 0)
+}
+
+func (self *Store[T]) put(txn *ReadWriteTxn, value *T, flags PutFlag) error {
+	pk, err := self.pkOf(value)
+	if err != nil {
+		return err
+	}
+	return self.table.Put(txn, pk, *value, flags)
+}
+
+// Get the value with the given primary key, which is converted to the
+// type of the primary key field, as for FindBy. If there is none, the
+// error matches NotFound.
+func (self *Store[T]) Get(txn Txn, pk any) (value T, err error) {
+	pkBytes, err := self.pk.encodeGiven(pk)
+	if err != nil {
+		return value, err
+	}
+	return self.table.Get(txn, pkBytes)
+}
+
+// Delete the value with the given primary key, which is converted to
+// the type of the primary key field, as for FindBy. If there is none,
+// the error matches NotFound.
+func (self *Store[T]) Delete(txn *ReadWriteTxn, pk any) error {
+	pkBytes, err := self.pk.encodeGiven(pk)
+	if err != nil {
+		return err
+	}
+	return self.table.Delete(txn, pkBytes)
+}
+
+// FindBy returns the values whose field equals the given value (or,
+// for a slice field, contains it), in primary key order. field is the
+// name of the Go struct field, and may be the primary key.
+//
+// The given value is converted to the type of the field (or of its
+// elements), so, for example, an untyped constant such as 1.5 can be
+// given for a float32 field. It is an error if the value can't be
+// converted exactly: say, a string for an int field, or -1 for a
+// uint64 field.
+func (self *Store[T]) FindBy(txn Txn, field string, fieldValue any) ([]T, error) {
+	var values []T
+	err := self.RangeBy(txn, field, fieldValue, fieldValue, func(value T) error {
+		values = append(values, value)
+		return nil
+	})
+	return values, err
+}
+
+// RangeBy calls fun with each value whose field is greater than or
+// equal to from, and less than to, in order of the field and then the
+// primary key. A nil from means from the first value, and a nil to
+// means to the last. If to is equal to from, only values whose field
+// equals from are included. field is the name of the Go struct field,
+// and may be the primary key. If fun returns an error, the range stops
+// and that error is returned.
+//
+// As for FindBy, from and to are converted to the type of the field.
+// For a slice field, a value is included once for each of its
+// elements within the range.
+//
+// fun must not modify the Store.
+func (self *Store[T]) RangeBy(txn Txn, field string, from, to any, fun func(value T) error) error {
+	if field == self.pk.name {
+		start, end, err := self.pk.rangeKeys(from, to)
+		if err != nil {
+			return err
+		}
+		return self.rangeByPK(txn, start, end, fun)
+	}
+	storeField, found := self.fields[field]
+	if !found {
+		return fmt.Errorf("Store %q: no indexed field %q", self.name, field)
+	}
+	start, end, err := storeField.rangeKeys(from, to)
+	if err != nil {
+		return err
+	}
+	roTxn := txn.readOnly()
+	return storeField.dbIndex.Scan(roTxn, start, end, func(indexKey, primaryKey, val []byte) error {
+		value, err := self.table.vals.Decode(val)
+		if err != nil {
+			return roTxn.opError("Store.RangeBy", self.table.db, primaryKey, err)
+		}
+		return fun(value)
+	})
+}
+
+func (self *storeField) rangeKeys(from, to any) (start, end []byte, err error) {
+	if from != nil {
+		if start, err = self.encodeGiven(from); err != nil {
+			return nil, nil, err
+		}
+	}
+	if to != nil {
+		if end, err = self.encodeGiven(to); err != nil {
+			return nil, nil, err
+		}
+		if start != nil && bytes.Equal(start, end) {
+			// start+0x00 is the least key greater than start.
+			end = append(end, 0x00)
+		}
+	}
+	return start, end, nil
+}
+
+func (self *Store[T]) rangeByPK(txn Txn, start, end []byte, fun func(value T) error) error {
+	cursor, err := self.table.NewCursor(txn)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+
+	var key []byte
+	var value T
+	if start == nil {
+		key, value, err = cursor.First()
+	} else {
+		key, value, err = cursor.Seek(start)
+	}
+	for ; err == nil; key, value, err = cursor.Next() {
+		if end != nil && bytes.Compare(key, end) >= 0 {
+			return nil
+		}
+		if err = fun(value); err != nil {
+			return err
+		}
+	}
+	if errors.Is(err, NotFound) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,234 @@
+package golmdb_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/matryer/is"
+
+	"wellquite.org/golmdb"
+)
+
+type storeTestUser struct {
+	ID    uint64   `golmdb:"pk"`
+	Email string   `golmdb:"unique"`
+	City  string   `golmdb:"index"`
+	Tags  []string `golmdb:"index"`
+	Notes string
+}
+
+func TestStore(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	defer client.TerminateSync()
+
+	users, err := golmdb.NewStore[storeTestUser](client, "users", nil)
+	is.NoErr(err)
+
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		for _, user := range []storeTestUser{
+			{ID: 3, Email: "cat@x", City: "leeds", Tags: []string{"admin"}},
+			{ID: 1, Email: "ann@x", City: "leeds", Tags: []string{"admin", "ops"}},
+			{ID: 2, Email: "bob@x", City: "york"},
+			{ID: 4, Email: "dan@x", City: "bath", Tags: []string{"ops"}},
+		} {
+			if err := users.Insert(txn, user); err != nil {
+				return err
+			}
+		}
+
+		err := users.Insert(txn, storeTestUser{ID: 1, Email: "new@x"})
+		is.True(errors.Is(err, golmdb.KeyExist))
+		var uniqueErr *golmdb.UniqueIndexError
+		err = users.Insert(txn, storeTestUser{ID: 5, Email: "ann@x"})
+		is.True(errors.As(err, &uniqueErr))
+		return nil
+	})
+	is.NoErr(err)
+
+	ids := func(users []storeTestUser) (ids []uint64) {
+		for _, user := range users {
+			ids = append(ids, user.ID)
+		}
+		return ids
+	}
+
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		user, err := users.Get(txn, 2)
+		is.NoErr(err)
+		is.Equal(user.Email, "bob@x")
+		_, err = users.Get(txn, 5)
+		is.True(errors.Is(err, golmdb.NotFound))
+
+		found, err := users.FindBy(txn, "City", "leeds")
+		is.NoErr(err)
+		is.Equal(ids(found), []uint64{1, 3})
+
+		found, err = users.FindBy(txn, "Tags", "ops")
+		is.NoErr(err)
+		is.Equal(ids(found), []uint64{1, 4})
+
+		found, err = users.FindBy(txn, "Email", "dan@x")
+		is.NoErr(err)
+		is.Equal(ids(found), []uint64{4})
+
+		found, err = users.FindBy(txn, "ID", 3)
+		is.NoErr(err)
+		is.Equal(ids(found), []uint64{3})
+
+		var ranged []storeTestUser
+		err = users.RangeBy(txn, "ID", 2, 4, func(user storeTestUser) error {
+			ranged = append(ranged, user)
+			return nil
+		})
+		is.NoErr(err)
+		is.Equal(ids(ranged), []uint64{2, 3})
+
+		ranged = nil
+		err = users.RangeBy(txn, "City", "c", nil, func(user storeTestUser) error {
+			ranged = append(ranged, user)
+			return nil
+		})
+		is.NoErr(err)
+		is.Equal(ids(ranged), []uint64{1, 3, 2})
+
+		_, err = users.FindBy(txn, "Notes", "")
+		is.True(err != nil)
+		return nil
+	})
+	is.NoErr(err)
+
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		if err := users.Upsert(txn, storeTestUser{ID: 3, Email: "cat@x", City: "york"}); err != nil {
+			return err
+		}
+		return users.Delete(txn, 4)
+	})
+	is.NoErr(err)
+
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		found, err := users.FindBy(txn, "City", "york")
+		is.NoErr(err)
+		is.Equal(ids(found), []uint64{2, 3})
+
+		found, err = users.FindBy(txn, "Tags", "ops")
+		is.NoErr(err)
+		is.Equal(ids(found), []uint64{1})
+
+		for _, field := range []string{"Email", "City", "Tags"} {
+			index, err := users.Index(field)
+			is.NoErr(err)
+			is.NoErr(index.Verify(txn))
+		}
+		return nil
+	})
+	is.NoErr(err)
+}
+
+func TestStoreInvalidTypes(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	defer client.TerminateSync()
+
+	type noPK struct {
+		Name string `golmdb:"index"`
+	}
+	_, err = golmdb.NewStore[noPK](client, "nopk", nil)
+	is.True(err != nil)
+
+	type badTag struct {
+		ID   int    `golmdb:"pk"`
+		Name string `golmdb:"primary"`
+	}
+	_, err = golmdb.NewStore[badTag](client, "badtag", nil)
+	is.True(err != nil)
+
+	type badType struct {
+		ID   int               `golmdb:"pk"`
+		Meta map[string]string `golmdb:"index"`
+	}
+	_, err = golmdb.NewStore[badType](client, "badtype", nil)
+	is.True(err != nil)
+}
+
+type storeTestScore struct {
+	ID    uint64  `golmdb:"pk"`
+	Score float32 `golmdb:"index"`
+	Level int8    `golmdb:"index"`
+}
+
+func TestStoreQueryConversion(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	defer client.TerminateSync()
+
+	scores, err := golmdb.NewStore[storeTestScore](client, "scores", nil)
+	is.NoErr(err)
+
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		for _, score := range []storeTestScore{
+			{ID: 1, Score: 1.5, Level: 3},
+			{ID: 2, Score: 2.25, Level: 3},
+			{ID: 3, Score: 1.5, Level: -1},
+		} {
+			if err := scores.Insert(txn, score); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	is.NoErr(err)
+
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		// an int for the uint64 pk.
+		score, err := scores.Get(txn, int(2))
+		is.NoErr(err)
+		is.Equal(score.Score, float32(2.25))
+
+		// a float64 for a float32 field, and an int for an int8 field.
+		found, err := scores.FindBy(txn, "Score", 1.5)
+		is.NoErr(err)
+		is.Equal(len(found), 2)
+		found, err = scores.FindBy(txn, "Level", 3)
+		is.NoErr(err)
+		is.Equal(len(found), 2)
+		var count int
+		err = scores.RangeBy(txn, "Level", -10, 0, func(score storeTestScore) error {
+			count++
+			return nil
+		})
+		is.NoErr(err)
+		is.Equal(count, 1)
+
+		// values which can't be values of the field are errors, not
+		// empty results.
+		_, err = scores.FindBy(txn, "Level", "3")
+		is.True(err != nil)
+		_, err = scores.FindBy(txn, "Level", 300)
+		is.True(err != nil)
+		_, err = scores.FindBy(txn, "Level", 2.5)
+		is.True(err != nil)
+		_, err = scores.Get(txn, -1)
+		is.True(err != nil)
+		_, err = scores.Get(txn, "1")
+		is.True(err != nil)
+		return nil
+	})
+	is.NoErr(err)
+}
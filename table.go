@@ -0,0 +1,207 @@
+package golmdb
+
+import (
+	"errors"
+)
+
+// Txn is implemented by both *ReadOnlyTxn and *ReadWriteTxn, so that
+// the read methods of Table can be used from both Views and Updates.
+type Txn interface {
+	readOnly() *ReadOnlyTxn
+}
+
+func (self *ReadOnlyTxn) readOnly() *ReadOnlyTxn { return self }
+
+// A Table is a named database whose keys and values are of the types
+// K and V, encoded and decoded with the given Codecs.
+//
+// Like a DBRef, a Table obtained from an Update can be used by other
+// transactions (both Updates and Views) once that Update has
+// committed. A Table holds no state of its own beyond its DBRef and
+// codecs, so it is safe for concurrent use.
+type Table[K, V any] struct {
+	db   DBRef
+	keys Codec[K]
+	vals Codec[V]
+}
+
+// OpenTable gets a Table for the named database, creating the
+// database if flags includes Create. This is txn.DBRef(name, flags)
+// with codecs attached.
+func OpenTable[K, V any](txn *ReadWriteTxn, name string, flags DatabaseFlag, keys Codec[K], vals Codec[V]) (*Table[K, V], error) {
+	db, err := txn.DBRef(name, flags)
+	if err != nil {
+		return nil, err
+	}
+	return NewTable(db, keys, vals), nil
+}
+
+// NewTable wraps an existing DBRef as a Table.
+func NewTable[K, V any](db DBRef, keys Codec[K], vals Codec[V]) *Table[K, V] {
+	return &Table[K, V]{db: db, keys: keys, vals: vals}
+}
+
+// The DBRef of the database underlying the Table, for use with the
+// untyped methods of ReadOnlyTxn and ReadWriteTxn.
+func (self *Table[K, V]) DBRef() DBRef {
+	return self.db
+}
+
+var errEmptyKey = errors.New("Keys must not be empty")
+
+func (self *Table[K, V]) encodeKey(txn *ReadOnlyTxn, op string, key K) ([]byte, error) {
+	keyBytes, err := self.keys.Encode(nil, key)
+	if err == nil && len(keyBytes) == 0 {
+		err = errEmptyKey
+	}
+	if err != nil {
+		return nil, txn.opError(op, self.db, nil, err)
+	}
+	return keyBytes, nil
+}
+
+func (self *Table[K, V]) decode(txn *ReadOnlyTxn, op string, keyBytes, valBytes []byte) (key K, val V, err error) {
+	key, err = self.keys.Decode(keyBytes)
+	if err == nil {
+		val, err = self.vals.Decode(valBytes)
+	}
+	if err != nil {
+		err = txn.opError(op, self.db, keyBytes, err)
+	}
+	return key, val, err
+}
+
+// Get the value corresponding to the key. If the key doesn't exist,
+// the error will match NotFound (see errors.Is).
+//
+// Whether or not the value is a copy depends on the value Codec:
+// with RawCodec, it is memory owned by the database, and the same
+// rules apply as for ReadOnlyTxn.Get.
+func (self *Table[K, V]) Get(txn Txn, key K) (val V, err error) {
+	roTxn := txn.readOnly()
+	keyBytes, err := self.encodeKey(roTxn, "Table.Get", key)
+	if err != nil {
+		return val, err
+	}
+	valBytes, err := roTxn.Get(self.db, keyBytes)
+	if err != nil {
+		return val, err
+	}
+	val, err = self.vals.Decode(valBytes)
+	if err != nil {
+		return val, roTxn.opError("Table.Get", self.db, keyBytes, err)
+	}
+	return val, nil
+}
+
+// Put a key-value pair into the Table. The flags are as for
+// ReadWriteTxn.Put.
+func (self *Table[K, V]) Put(txn *ReadWriteTxn, key K, val V, flags PutFlag) error {
+	keyBytes, err := self.encodeKey(&txn.ReadOnlyTxn, "Table.Put", key)
+	if err != nil {
+		return err
+	}
+	valBytes, err := self.vals.Encode(nil, val)
+	if err != nil {
+		return txn.opError("Table.Put", self.db, keyBytes, err)
+	}
+	return txn.Put(self.db, keyBytes, valBytes, flags)
+}
+
+// Delete the key, and its value, from the Table. If the key doesn't
+// exist, the error will match NotFound.
+func (self *Table[K, V]) Delete(txn *ReadWriteTxn, key K) error {
+	keyBytes, err := self.encodeKey(&txn.ReadOnlyTxn, "Table.Delete", key)
+	if err != nil {
+		return err
+	}
+	return txn.Delete(self.db, keyBytes, nil)
+}
+
+// ForEach calls fun with each key-value pair of the Table, in key
+// order, starting from the first. If fun returns an error, the
+// iteration stops and that error is returned.
+func (self *Table[K, V]) ForEach(txn Txn, fun func(key K, val V) error) error {
+	cursor, err := self.NewCursor(txn)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+
+	key, val, err := cursor.First()
+	for ; err == nil; key, val, err = cursor.Next() {
+		if err = fun(key, val); err != nil {
+			return err
+		}
+	}
+	if errors.Is(err, NotFound) {
+		return nil
+	}
+	return err
+}
+
+// A TableCursor is a typed ReadOnlyCursor over a Table.
+type TableCursor[K, V any] struct {
+	table  *Table[K, V]
+	txn    *ReadOnlyTxn
+	cursor *ReadOnlyCursor
+}
+
+// NewCursor creates a cursor over the Table. The same rules about
+// lifespans apply as for ReadOnlyTxn.NewCursor: Close the cursor
+// before the end of the transaction.
+func (self *Table[K, V]) NewCursor(txn Txn) (*TableCursor[K, V], error) {
+	roTxn := txn.readOnly()
+	cursor, err := roTxn.NewCursor(self.db)
+	if err != nil {
+		return nil, err
+	}
+	return &TableCursor[K, V]{table: self, txn: roTxn, cursor: cursor}, nil
+}
+
+// Close the cursor.
+func (self *TableCursor[K, V]) Close() {
+	self.cursor.Close()
+}
+
+func (self *TableCursor[K, V]) decode(op string, keyBytes, valBytes []byte, err error) (key K, val V, _ error) {
+	if err != nil {
+		return key, val, err
+	}
+	return self.table.decode(self.txn, op, keyBytes, valBytes)
+}
+
+// Move to the first key-value pair of the Table.
+func (self *TableCursor[K, V]) First() (key K, val V, err error) {
+	keyBytes, valBytes, err := self.cursor.First()
+	return self.decode("TableCursor.First", keyBytes, valBytes, err)
+}
+
+// Move to the last key-value pair of the Table.
+func (self *TableCursor[K, V]) Last() (key K, val V, err error) {
+	keyBytes, valBytes, err := self.cursor.Last()
+	return self.decode("TableCursor.Last", keyBytes, valBytes, err)
+}
+
+// Move to the next key-value pair.
+func (self *TableCursor[K, V]) Next() (key K, val V, err error) {
+	keyBytes, valBytes, err := self.cursor.Next()
+	return self.decode("TableCursor.Next", keyBytes, valBytes, err)
+}
+
+// Move to the previous key-value pair.
+func (self *TableCursor[K, V]) Prev() (key K, val V, err error) {
+	keyBytes, valBytes, err := self.cursor.Prev()
+	return self.decode("TableCursor.Prev", keyBytes, valBytes, err)
+}
+
+// Move to the given key if it exists, otherwise the nearest key
+// greater than it (in the byte order of the encoded keys).
+func (self *TableCursor[K, V]) Seek(key K) (keyOut K, val V, err error) {
+	keyBytes, err := self.table.encodeKey(self.txn, "TableCursor.Seek", key)
+	if err != nil {
+		return keyOut, val, err
+	}
+	keyBytes, valBytes, err := self.cursor.SeekGreaterThanOrEqualKey(keyBytes)
+	return self.decode("TableCursor.Seek", keyBytes, valBytes, err)
+}
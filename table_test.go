@@ -0,0 +1,179 @@
+package golmdb_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/matryer/is"
+
+	"wellquite.org/golmdb"
+)
+
+type tableTestValue struct {
+	Name  string
+	Count int
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	is := is.New(t)
+
+	raw := []byte("hello")
+	encoded, err := golmdb.RawCodec{}.Encode(nil, raw)
+	is.NoErr(err)
+	is.True(&encoded[0] == &raw[0]) // no copy
+	decoded, err := golmdb.RawCodec{}.Decode(encoded)
+	is.NoErr(err)
+	is.True(&decoded[0] == &raw[0])
+
+	encoded, err = golmdb.Uint64Codec{}.Encode(nil, 258)
+	is.NoErr(err)
+	is.Equal(encoded, []byte{0, 0, 0, 0, 0, 0, 1, 2})
+	num, err := golmdb.Uint64Codec{}.Decode(encoded)
+	is.NoErr(err)
+	is.Equal(num, uint64(258))
+	_, err = golmdb.Uint64Codec{}.Decode(encoded[1:])
+	is.True(err != nil)
+
+	encoded, err = golmdb.BinaryCodec[[2]uint16]{}.Encode([]byte{9}, [2]uint16{1, 2})
+	is.NoErr(err)
+	is.Equal(encoded, []byte{9, 0, 1, 0, 2})
+	pair, err := golmdb.BinaryCodec[[2]uint16]{}.Decode(encoded[1:])
+	is.NoErr(err)
+	is.Equal(pair, [2]uint16{1, 2})
+
+	value := tableTestValue{Name: "bob", Count: 3}
+	encoded, err = golmdb.JSONCodec[tableTestValue]{}.Encode(nil, value)
+	is.NoErr(err)
+	is.Equal(string(encoded), `{"Name":"bob","Count":3}`)
+	decodedValue, err := golmdb.JSONCodec[tableTestValue]{}.Decode(encoded)
+	is.NoErr(err)
+	is.Equal(decodedValue, value)
+
+	encoded, err = golmdb.GobCodec[tableTestValue]{}.Encode(nil, value)
+	is.NoErr(err)
+	decodedValue, err = golmdb.GobCodec[tableTestValue]{}.Decode(encoded)
+	is.NoErr(err)
+	is.Equal(decodedValue, value)
+}
+
+func TestTable(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	defer client.TerminateSync()
+
+	var table *golmdb.Table[uint64, tableTestValue]
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) (err error) {
+		table, err = golmdb.OpenTable[uint64, tableTestValue](txn, "table", golmdb.Create, golmdb.Uint64Codec{}, golmdb.JSONCodec[tableTestValue]{})
+		if err != nil {
+			return err
+		}
+		// put in reverse order: keys are ordered by their encoding.
+		for idx := uint64(300); idx > 0; idx-- {
+			if err = table.Put(txn, idx, tableTestValue{Name: "v", Count: int(idx)}, 0); err != nil {
+				return err
+			}
+		}
+		return table.Delete(txn, 150)
+	})
+	is.NoErr(err)
+
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		val, err := table.Get(txn, 7)
+		is.NoErr(err)
+		is.Equal(val, tableTestValue{Name: "v", Count: 7})
+
+		_, err = table.Get(txn, 150)
+		is.True(errors.Is(err, golmdb.NotFound))
+
+		expected := uint64(1)
+		err = table.ForEach(txn, func(key uint64, val tableTestValue) error {
+			if expected == 150 {
+				expected++
+			}
+			is.Equal(key, expected)
+			is.Equal(val.Count, int(expected))
+			expected++
+			return nil
+		})
+		is.NoErr(err)
+		is.Equal(expected, uint64(301))
+
+		cursor, err := table.NewCursor(txn)
+		is.NoErr(err)
+		defer cursor.Close()
+		key, val, err := cursor.Seek(150)
+		is.NoErr(err)
+		is.Equal(key, uint64(151))
+		is.Equal(val.Count, 151)
+		key, _, err = cursor.Prev()
+		is.NoErr(err)
+		is.Equal(key, uint64(149))
+		key, _, err = cursor.Last()
+		is.NoErr(err)
+		is.Equal(key, uint64(300))
+		_, _, err = cursor.Next()
+		is.True(errors.Is(err, golmdb.NotFound))
+		return nil
+	})
+	is.NoErr(err)
+
+	// Table reads work within Updates too, and ForEach stops on error.
+	stop := errors.New("stop")
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		val, err := table.Get(txn, 300)
+		is.NoErr(err)
+		is.Equal(val.Count, 300)
+		count := 0
+		err = table.ForEach(txn, func(key uint64, val tableTestValue) error {
+			count++
+			if count == 10 {
+				return stop
+			}
+			return nil
+		})
+		is.Equal(err, stop)
+		is.Equal(count, 10)
+		return nil
+	})
+	is.NoErr(err)
+}
+
+func TestTableRaw(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	defer client.TerminateSync()
+
+	var table *golmdb.Table[string, []byte]
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) (err error) {
+		table, err = golmdb.OpenTable[string, []byte](txn, "raw", golmdb.Create, golmdb.StringCodec{}, golmdb.RawCodec{})
+		if err != nil {
+			return err
+		}
+		if err = table.Put(txn, "hello", []byte("world"), 0); err != nil {
+			return err
+		}
+		err = table.Put(txn, "", []byte("empty"), 0)
+		is.True(err != nil) // empty keys are rejected, not a panic
+		return nil
+	})
+	is.NoErr(err)
+
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		val, err := table.Get(txn, "hello")
+		is.NoErr(err)
+		is.Equal(string(val), "world")
+		return nil
+	})
+	is.NoErr(err)
+}
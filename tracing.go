@@ -0,0 +1,67 @@
+package golmdb
+
+import (
+	"time"
+)
+
+// Tracer is called at each step of Views and Updates. Set
+// Options.Tracer to an implementation of this to feed your tracing
+// system (for example, to create OpenTelemetry spans).
+//
+// Every View and every Update is given an id, unique within the
+// client. Each time the actor runs a batch of Updates, the batch is
+// given an id too. So you can see which Updates were batched
+// together, and how long each step took.
+//
+// Methods are called synchronously from the View and Update paths,
+// and from within the actor, so they must be cheap, and safe for
+// concurrent use. Embed NopTracer in your own implementation so that
+// methods added to this interface in the future do not break it.
+type Tracer interface {
+	// Called once a View has begun its read txn, before the fun is
+	// run, with LMDB's id for the txn: the id of the last write txn
+	// committed before it (see Commit), whose snapshot the View reads.
+	ViewStart(viewID, txnID uint64)
+	// Called at the end of a View, with the error it returns. The
+	// duration includes any wait for a reader slot. The txnID is that
+	// of the read txn the fun last ran in (a View may restart in a
+	// new txn; see View), or 0 if the View failed before beginning
+	// one, in which case ViewStart was not called.
+	ViewEnd(viewID, txnID uint64, duration time.Duration, err error)
+	// Called when an Update has been submitted, before it is sent to
+	// the actor.
+	UpdateEnqueue(updateID uint64)
+	// Called when an Update returns, with the error it returns.
+	UpdateEnd(updateID uint64, duration time.Duration, err error)
+	// Called by the actor when it starts running a batch, with the ids
+	// of the Updates in the batch. The slice must not be retained.
+	BatchStart(batchID uint64, updateIDs []uint64)
+	// Called by the actor each time an Update's fun has been run (and,
+	// if it's not within a batch transaction, committed). An Update
+	// may be run several times within the same batch; see Update.
+	TxnRun(batchID, updateID uint64, duration time.Duration, err error)
+	// Called by the actor each time it commits a top-level write txn,
+	// with LMDB's id for the txn.
+	Commit(batchID, txnID uint64, duration time.Duration, err error)
+	// Called by the actor each time the map is resized. The batchID is
+	// 0 if the resize is not part of running a batch.
+	Resize(batchID, fromSize, toSize uint64, duration time.Duration)
+	// Called by the actor when it has finished running a batch. The
+	// error is non-nil only if the batch failed fatally.
+	BatchEnd(batchID uint64, duration time.Duration, err error)
+}
+
+// NopTracer is a Tracer which does nothing. It is the default.
+type NopTracer struct{}
+
+var _ Tracer = NopTracer{}
+
+func (NopTracer) ViewStart(viewID, txnID uint64)                                     {}
+func (NopTracer) ViewEnd(viewID, txnID uint64, duration time.Duration, err error)    {}
+func (NopTracer) UpdateEnqueue(updateID uint64)                                      {}
+func (NopTracer) UpdateEnd(updateID uint64, duration time.Duration, err error)       {}
+func (NopTracer) BatchStart(batchID uint64, updateIDs []uint64)                      {}
+func (NopTracer) TxnRun(batchID, updateID uint64, duration time.Duration, err error) {}
+func (NopTracer) Commit(batchID, txnID uint64, duration time.Duration, err error)    {}
+func (NopTracer) Resize(batchID, fromSize, toSize uint64, duration time.Duration)    {}
+func (NopTracer) BatchEnd(batchID uint64, duration time.Duration, err error)         {}
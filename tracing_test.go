@@ -0,0 +1,169 @@
+package golmdb_test
+
+import (
+	"encoding/binary"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"wellquite.org/golmdb"
+)
+
+// An in-memory Tracer, recording which Updates were run in which
+// batches.
+type recordingTracer struct {
+	golmdb.NopTracer
+	lock       sync.Mutex
+	enqueued   map[uint64]bool
+	ended      map[uint64]bool
+	batches    map[uint64][]uint64 // batch id -> update ids
+	runs       map[uint64]uint64   // update id -> batch id of last run
+	commits    map[uint64]uint64   // LMDB txn id -> batch id
+	views      map[uint64]uint64   // view id -> LMDB txn id
+	viewsEnd   map[uint64]uint64   // view id -> LMDB txn id
+	batchesEnd int
+}
+
+func newRecordingTracer() *recordingTracer {
+	return &recordingTracer{
+		enqueued: make(map[uint64]bool),
+		ended:    make(map[uint64]bool),
+		batches:  make(map[uint64][]uint64),
+		runs:     make(map[uint64]uint64),
+		commits:  make(map[uint64]uint64),
+		views:    make(map[uint64]uint64),
+		viewsEnd: make(map[uint64]uint64),
+	}
+}
+
+func (self *recordingTracer) ViewStart(viewID, txnID uint64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.views[viewID] = txnID
+}
+
+func (self *recordingTracer) ViewEnd(viewID, txnID uint64, duration time.Duration, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.viewsEnd[viewID] = txnID
+}
+
+func (self *recordingTracer) UpdateEnqueue(updateID uint64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.enqueued[updateID] = true
+}
+
+func (self *recordingTracer) UpdateEnd(updateID uint64, duration time.Duration, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.ended[updateID] = true
+}
+
+func (self *recordingTracer) BatchStart(batchID uint64, updateIDs []uint64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.batches[batchID] = append([]uint64(nil), updateIDs...)
+}
+
+func (self *recordingTracer) TxnRun(batchID, updateID uint64, duration time.Duration, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.runs[updateID] = batchID
+}
+
+func (self *recordingTracer) Commit(batchID, txnID uint64, duration time.Duration, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if err == nil {
+		self.commits[txnID] = batchID
+	}
+}
+
+func (self *recordingTracer) BatchEnd(batchID uint64, duration time.Duration, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.batchesEnd++
+}
+
+func TestTracer(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	dir, err := os.MkdirTemp("", "golmdb")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	tracer := newRecordingTracer()
+	client, err := golmdb.Open(dir, golmdb.Options{
+		Log:       log,
+		NumDBs:    4,
+		BatchSize: 8,
+		Tracer:    tracer,
+	})
+	is.NoErr(err)
+	defer client.TerminateSync()
+
+	dbRef, err := createDBRef(client, t.Name(), 0)
+	is.NoErr(err)
+
+	var wg sync.WaitGroup
+	const updates = 64
+	for idx := 0; idx < updates; idx++ {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			key := make([]byte, 8)
+			binary.BigEndian.PutUint64(key, uint64(idx))
+			err := client.Update(func(txn *golmdb.ReadWriteTxn) error {
+				return txn.Put(dbRef, key, key, 0)
+			})
+			is.NoErr(err)
+		}(idx)
+	}
+	wg.Wait()
+	is.NoErr(client.View(func(txn *golmdb.ReadOnlyTxn) error { return nil }))
+
+	tracer.lock.Lock()
+	defer tracer.lock.Unlock()
+
+	is.Equal(len(tracer.views), 1)
+	is.Equal(tracer.views, tracer.viewsEnd)
+	is.Equal(len(tracer.enqueued), updates+1) // +1 for createDBRef
+	is.Equal(len(tracer.ended), updates+1)
+	is.Equal(tracer.batchesEnd, len(tracer.batches))
+
+	// every Update appears in exactly one batch, and was run within it.
+	seen := make(map[uint64]bool)
+	for batchID, updateIDs := range tracer.batches {
+		is.True(len(updateIDs) <= 8)
+		for _, updateID := range updateIDs {
+			is.True(!seen[updateID])
+			seen[updateID] = true
+			is.Equal(tracer.runs[updateID], batchID)
+		}
+	}
+	is.Equal(len(seen), updates+1)
+
+	// every batch committed at least once.
+	committed := make(map[uint64]bool)
+	for _, batchID := range tracer.commits {
+		committed[batchID] = true
+	}
+	is.Equal(len(committed), len(tracer.batches))
+
+	// the View read the snapshot of the last commit.
+	var lastCommit uint64
+	for txnID := range tracer.commits {
+		if txnID > lastCommit {
+			lastCommit = txnID
+		}
+	}
+	for _, txnID := range tracer.views {
+		is.Equal(txnID, lastCommit)
+	}
+}
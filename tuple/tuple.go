@@ -0,0 +1,364 @@
+// Package tuple encodes tuples of values as keys whose byte order is
+// the same as the order of the tuples, in the spirit of FoundationDB's
+// tuple layer (and compatible with its encoding for the types
+// supported here).
+//
+// LMDB, by default, orders keys by comparing their bytes. Packing
+// composite keys such as (tenant, timestamp, id) with this package
+// means they sort correctly, and that all the keys starting with a
+// given prefix tuple, such as (tenant), are contiguous and can be
+// scanned with a cursor: see Tuple.Range.
+//
+// Tuples are ordered element by element. A tuple that is a prefix of
+// another sorts first. Elements of different types are ordered by
+// type: nil, []byte, string, nested Tuple, integers, float32, float64,
+// then bool. Integers of all Go integer types are ordered
+// numerically together. Floats are ordered numerically, except that
+// -0 sorts before +0, and NaNs sort at the ends.
+package tuple
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// A Tuple is a sequence of elements. Each element must be nil, a
+// []byte, a string, a Tuple, any Go integer type, a float32, a float64,
+// or a bool.
+//
+// Unpack returns integers as int64, unless they are too big for an
+// int64, in which case they are returned as uint64.
+type Tuple []any
+
+const (
+	nilCode     = 0x00
+	bytesCode   = 0x01
+	stringCode  = 0x02
+	nestedCode  = 0x05
+	intZeroCode = 0x14
+	float32Code = 0x20
+	float64Code = 0x21
+	falseCode   = 0x26
+	trueCode    = 0x27
+
+	escapeCode = 0xff
+)
+
+// Pack encodes the tuple.
+func (self Tuple) Pack() ([]byte, error) {
+	return self.Append(make([]byte, 0, 32))
+}
+
+// Append appends the encoding of the tuple to buf, and returns the
+// result.
+func (self Tuple) Append(buf []byte) ([]byte, error) {
+	return self.append(buf, false)
+}
+
+func (self Tuple) append(buf []byte, nested bool) ([]byte, error) {
+	var err error
+	for idx, elem := range self {
+		buf, err = appendElem(buf, elem, nested)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot pack tuple element %d: %w", idx, err)
+		}
+	}
+	return buf, nil
+}
+
+func appendElem(buf []byte, elem any, nested bool) ([]byte, error) {
+	switch elem := elem.(type) {
+	case nil:
+		if nested {
+			// a nested nil must not be mistaken for the terminator.
+			return append(buf, nilCode, escapeCode), nil
+		}
+		return append(buf, nilCode), nil
+	case []byte:
+		return appendEscaped(append(buf, bytesCode), elem), nil
+	case string:
+		return appendEscaped(append(buf, stringCode), []byte(elem)), nil
+	case Tuple:
+		buf, err := elem.append(append(buf, nestedCode), true)
+		if err != nil {
+			return nil, err
+		}
+		return append(buf, nilCode), nil
+	case int:
+		return appendInt(buf, int64(elem)), nil
+	case int8:
+		return appendInt(buf, int64(elem)), nil
+	case int16:
+		return appendInt(buf, int64(elem)), nil
+	case int32:
+		return appendInt(buf, int64(elem)), nil
+	case int64:
+		return appendInt(buf, elem), nil
+	case uint:
+		return appendUint(buf, uint64(elem)), nil
+	case uint8:
+		return appendUint(buf, uint64(elem)), nil
+	case uint16:
+		return appendUint(buf, uint64(elem)), nil
+	case uint32:
+		return appendUint(buf, uint64(elem)), nil
+	case uint64:
+		return appendUint(buf, elem), nil
+	case float32:
+		bits := math.Float32bits(elem)
+		if bits&(1<<31) != 0 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 31
+		}
+		return binary.BigEndian.AppendUint32(append(buf, float32Code), bits), nil
+	case float64:
+		bits := math.Float64bits(elem)
+		if bits&(1<<63) != 0 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+		return binary.BigEndian.AppendUint64(append(buf, float64Code), bits), nil
+	case bool:
+		if elem {
+			return append(buf, trueCode), nil
+		}
+		return append(buf, falseCode), nil
+	default:
+		return nil, fmt.Errorf("Unsupported type %T", elem)
+	}
+}
+
+// Zero bytes are escaped as 0x00 0xff, and the whole is terminated
+// with 0x00, so that shorter strings sort before longer strings they
+// are a prefix of.
+func appendEscaped(buf []byte, data []byte) []byte {
+	for {
+		idx := bytes.IndexByte(data, 0)
+		if idx < 0 {
+			break
+		}
+		buf = append(append(buf, data[:idx+1]...), escapeCode)
+		data = data[idx+1:]
+	}
+	return append(append(buf, data...), 0)
+}
+
+// Integers are encoded big-endian in as few bytes as possible. The
+// type code records the number of bytes: for positive integers, 0x14
+// plus the length; for negative integers, 0x14 minus the length, with
+// the bytes being the one's complement of the magnitude. So longer
+// (bigger) positive integers sort after shorter ones, and longer (more
+// negative) negative integers sort before shorter ones.
+func appendUint(buf []byte, value uint64) []byte {
+	length := (bits.Len64(value) + 7) / 8
+	buf = append(buf, byte(intZeroCode+length))
+	return appendBigEndian(buf, value, length)
+}
+
+func appendInt(buf []byte, value int64) []byte {
+	if value >= 0 {
+		return appendUint(buf, uint64(value))
+	}
+	magnitude := uint64(-value) // correct even for math.MinInt64
+	length := (bits.Len64(magnitude) + 7) / 8
+	buf = append(buf, byte(intZeroCode-length))
+	return appendBigEndian(buf, ^magnitude, length)
+}
+
+func appendBigEndian(buf []byte, value uint64, length int) []byte {
+	for shift := 8 * (length - 1); shift >= 0; shift -= 8 {
+		buf = append(buf, byte(value>>shift))
+	}
+	return buf
+}
+
+var errTruncated = errors.New("Truncated tuple")
+
+// Unpack decodes a tuple encoded by Pack.
+func Unpack(data []byte) (Tuple, error) {
+	tuple, _, err := unpack(data, false)
+	return tuple, err
+}
+
+// Decodes elements until the end of data, or, if nested, until the
+// terminator. Returns the remainder of data after the terminator.
+func unpack(data []byte, nested bool) (Tuple, []byte, error) {
+	tuple := Tuple{}
+	for len(data) > 0 {
+		if nested && data[0] == nilCode {
+			if len(data) > 1 && data[1] == escapeCode {
+				tuple = append(tuple, nil)
+				data = data[2:]
+				continue
+			}
+			return tuple, data[1:], nil
+		}
+		var elem any
+		var err error
+		elem, data, err = unpackElem(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		tuple = append(tuple, elem)
+	}
+	if nested {
+		return nil, nil, errTruncated
+	}
+	return tuple, nil, nil
+}
+
+func unpackElem(data []byte) (any, []byte, error) {
+	code := data[0]
+	data = data[1:]
+	switch {
+	case code == nilCode:
+		return nil, data, nil
+	case code == bytesCode:
+		elem, rest, err := unescape(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		return elem, rest, nil
+	case code == stringCode:
+		elem, rest, err := unescape(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		return string(elem), rest, nil
+	case code == nestedCode:
+		elem, rest, err := unpack(data, true)
+		if err != nil {
+			return nil, nil, err
+		}
+		return elem, rest, nil
+	case code >= intZeroCode-8 && code <= intZeroCode+8:
+		length := int(code) - intZeroCode
+		negative := length < 0
+		if negative {
+			length = -length
+		}
+		if len(data) < length {
+			return nil, nil, errTruncated
+		}
+		var value uint64
+		for _, b := range data[:length] {
+			value = value<<8 | uint64(b)
+		}
+		data = data[length:]
+		if !negative {
+			if value > math.MaxInt64 {
+				return value, data, nil
+			}
+			return int64(value), data, nil
+		}
+		magnitude := ^value
+		if length < 8 {
+			magnitude &= 1<<(8*length) - 1
+		}
+		if magnitude > 1<<63 {
+			return nil, nil, errors.New("Integer too small for an int64")
+		}
+		return -int64(magnitude), data, nil
+	case code == float32Code:
+		if len(data) < 4 {
+			return nil, nil, errTruncated
+		}
+		bits := binary.BigEndian.Uint32(data)
+		if bits&(1<<31) != 0 {
+			bits ^= 1 << 31
+		} else {
+			bits = ^bits
+		}
+		return math.Float32frombits(bits), data[4:], nil
+	case code == float64Code:
+		if len(data) < 8 {
+			return nil, nil, errTruncated
+		}
+		bits := binary.BigEndian.Uint64(data)
+		if bits&(1<<63) != 0 {
+			bits ^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		return math.Float64frombits(bits), data[8:], nil
+	case code == falseCode:
+		return false, data, nil
+	case code == trueCode:
+		return true, data, nil
+	default:
+		return nil, nil, fmt.Errorf("Unknown tuple type code 0x%02x", code)
+	}
+}
+
+func unescape(data []byte) ([]byte, []byte, error) {
+	var result []byte
+	for {
+		idx := bytes.IndexByte(data, 0)
+		if idx < 0 {
+			return nil, nil, errTruncated
+		}
+		result = append(result, data[:idx]...)
+		if idx+1 < len(data) && data[idx+1] == escapeCode {
+			result = append(result, 0)
+			data = data[idx+2:]
+			continue
+		}
+		if result == nil {
+			result = []byte{}
+		}
+		return result, data[idx+1:], nil
+	}
+}
+
+// Range returns the keys to scan in order to find every packed tuple
+// which has this tuple as a proper prefix: that is, every longer
+// tuple whose first elements are equal to this tuple. The tuple
+// itself is not within the range. start is inclusive, and end is
+// exclusive: position a cursor with SeekGreaterThanOrEqualKey(start)
+// and stop at the first key which is not less than end.
+func (self Tuple) Range() (start, end []byte, err error) {
+	packed, err := self.Pack()
+	if err != nil {
+		return nil, nil, err
+	}
+	start = append(append([]byte(nil), packed...), 0x00)
+	end = append(packed, 0xff)
+	return start, end, nil
+}
+
+// PrefixRange returns the keys to scan in order to find every key
+// which starts with prefix, including prefix itself. start is
+// inclusive, and end is exclusive. If every byte of prefix is 0xff,
+// there is no key greater than all such keys, and end is nil.
+//
+// Unlike Tuple.Range, this works on the bytes of the keys, so for
+// example a packed string prefix will also match longer strings.
+func PrefixRange(prefix []byte) (start, end []byte) {
+	start = append([]byte(nil), prefix...)
+	for idx := len(prefix) - 1; idx >= 0; idx-- {
+		if prefix[idx] != 0xff {
+			end = append([]byte(nil), prefix[:idx+1]...)
+			end[idx]++
+			return start, end
+		}
+	}
+	return start, nil
+}
+
+// Codec packs and unpacks Tuples. It satisfies golmdb.Codec[Tuple], so
+// that Tuples can be used as the keys of a golmdb.Table.
+type Codec struct{}
+
+func (Codec) Encode(buf []byte, tuple Tuple) ([]byte, error) {
+	return tuple.Append(buf)
+}
+
+func (Codec) Decode(data []byte) (Tuple, error) {
+	return Unpack(data)
+}
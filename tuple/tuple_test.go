@@ -0,0 +1,296 @@
+package tuple_test
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/matryer/is"
+
+	"wellquite.org/golmdb/tuple"
+)
+
+func TestPackKnownEncodings(t *testing.T) {
+	is := is.New(t)
+
+	for _, test := range []struct {
+		tuple   tuple.Tuple
+		encoded []byte
+	}{
+		{tuple.Tuple{}, []byte{}},
+		{tuple.Tuple{nil}, []byte{0x00}},
+		{tuple.Tuple{"a\x00b"}, []byte{0x02, 'a', 0x00, 0xff, 'b', 0x00}},
+		{tuple.Tuple{[]byte{0xff}}, []byte{0x01, 0xff, 0x00}},
+		{tuple.Tuple{0}, []byte{0x14}},
+		{tuple.Tuple{1}, []byte{0x15, 0x01}},
+		{tuple.Tuple{-1}, []byte{0x13, 0xfe}},
+		{tuple.Tuple{256}, []byte{0x16, 0x01, 0x00}},
+		{tuple.Tuple{uint64(math.MaxUint64)}, []byte{0x1c, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{tuple.Tuple{int64(math.MinInt64)}, []byte{0x0c, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{tuple.Tuple{true, false}, []byte{0x27, 0x26}},
+		{tuple.Tuple{tuple.Tuple{nil, "x"}, nil}, []byte{0x05, 0x00, 0xff, 0x02, 'x', 0x00, 0x00, 0x00}},
+	} {
+		encoded, err := test.tuple.Pack()
+		is.NoErr(err)
+		is.Equal(encoded, test.encoded)
+		decoded, err := tuple.Unpack(encoded)
+		is.NoErr(err)
+		is.Equal(len(decoded), len(test.tuple))
+	}
+
+	_, err := tuple.Tuple{struct{}{}}.Pack()
+	is.True(err != nil)
+	_, err = tuple.Unpack([]byte{0x02, 'a'})
+	is.True(err != nil)
+	_, err = tuple.Unpack([]byte{0x16, 0x01})
+	is.True(err != nil)
+	_, err = tuple.Unpack([]byte{0x05, 0x14})
+	is.True(err != nil)
+	_, err = tuple.Unpack([]byte{0x99})
+	is.True(err != nil)
+}
+
+func TestPackIntegerTypes(t *testing.T) {
+	is := is.New(t)
+
+	for _, elem := range []any{int(-5), int8(-5), int16(-5), int32(-5), int64(-5)} {
+		decoded, err := roundTrip(tuple.Tuple{elem})
+		is.NoErr(err)
+		is.Equal(decoded, tuple.Tuple{int64(-5)})
+	}
+	for _, elem := range []any{uint(5), uint8(5), uint16(5), uint32(5), uint64(5)} {
+		decoded, err := roundTrip(tuple.Tuple{elem})
+		is.NoErr(err)
+		is.Equal(decoded, tuple.Tuple{int64(5)})
+	}
+}
+
+func roundTrip(tup tuple.Tuple) (tuple.Tuple, error) {
+	encoded, err := tup.Pack()
+	if err != nil {
+		return nil, err
+	}
+	return tuple.Unpack(encoded)
+}
+
+// Property: for random tuples, Unpack(Pack(t)) == t, and the order of
+// the packed bytes is the same as the order of the tuples.
+func TestPackProperties(t *testing.T) {
+	is := is.New(t)
+	rng := rand.New(rand.NewSource(1))
+
+	tuples := make([]tuple.Tuple, 2000)
+	packed := make(map[*tuple.Tuple][]byte, len(tuples))
+	for idx := range tuples {
+		tuples[idx] = randomTuple(rng, 0)
+		encoded, err := tuples[idx].Pack()
+		is.NoErr(err)
+		packed[&tuples[idx]] = encoded
+
+		decoded, err := tuple.Unpack(encoded)
+		is.NoErr(err)
+		if !reflect.DeepEqual(decoded, tuples[idx]) {
+			t.Fatalf("%#v round-tripped to %#v", tuples[idx], decoded)
+		}
+	}
+
+	for idx := 0; idx < 100000; idx++ {
+		a, b := &tuples[rng.Intn(len(tuples))], &tuples[rng.Intn(len(tuples))]
+		expected := compareTuples(*a, *b)
+		actual := bytes.Compare(packed[a], packed[b])
+		if expected != actual {
+			t.Fatalf("%#v vs %#v: tuple order %d, byte order %d", *a, *b, expected, actual)
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+	is := is.New(t)
+	rng := rand.New(rand.NewSource(2))
+
+	prefix := tuple.Tuple{"tenant", int64(7)}
+	start, end, err := prefix.Range()
+	is.NoErr(err)
+
+	var keys [][]byte
+	for idx := 0; idx < 1000; idx++ {
+		tup := randomTuple(rng, 0)
+		if idx%2 == 0 {
+			tup = append(append(tuple.Tuple{}, prefix...), tup...)
+		}
+		encoded, err := tup.Pack()
+		is.NoErr(err)
+		keys = append(keys, encoded)
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+
+	for _, key := range keys {
+		tup, err := tuple.Unpack(key)
+		is.NoErr(err)
+		inRange := bytes.Compare(key, start) >= 0 && bytes.Compare(key, end) < 0
+		hasPrefix := len(tup) > len(prefix) && reflect.DeepEqual(tup[:len(prefix)], prefix)
+		is.Equal(inRange, hasPrefix)
+	}
+
+	start, end = tuple.PrefixRange([]byte{1, 2, 0xff})
+	is.Equal(start, []byte{1, 2, 0xff})
+	is.Equal(end, []byte{1, 3})
+	_, end = tuple.PrefixRange([]byte{0xff, 0xff})
+	is.Equal(end, []byte(nil))
+}
+
+// A small alphabet of edge cases, so that random tuples often share
+// prefixes and compare equal element-wise.
+var (
+	strings = []string{"", "a", "ab", "b", "\x00", "a\x00", "a\x00b", "a\x01", "\xff", "\x00\xff"}
+	ints    = []int64{0, 1, -1, 2, -2, 255, -255, 256, -256, 1 << 32, -(1 << 32), math.MaxInt64, math.MinInt64, math.MinInt64 + 1}
+	floats  = []float64{0, math.Copysign(0, -1), 1, -1, 0.5, -0.5, math.MaxFloat64, -math.MaxFloat64, math.Inf(1), math.Inf(-1), math.SmallestNonzeroFloat64}
+)
+
+func randomTuple(rng *rand.Rand, depth int) tuple.Tuple {
+	tup := tuple.Tuple{}
+	for length := rng.Intn(4); length > 0; length-- {
+		tup = append(tup, randomElem(rng, depth))
+	}
+	return tup
+}
+
+func randomElem(rng *rand.Rand, depth int) any {
+	switch rng.Intn(10) {
+	case 0:
+		return nil
+	case 1:
+		return []byte(strings[rng.Intn(len(strings))])
+	case 2:
+		return strings[rng.Intn(len(strings))]
+	case 3:
+		if depth < 2 {
+			return randomTuple(rng, depth+1)
+		}
+		return nil
+	case 4:
+		return ints[rng.Intn(len(ints))]
+	case 5:
+		return rng.Int63() - rng.Int63()
+	case 6:
+		if rng.Intn(2) == 0 {
+			return uint64(math.MaxUint64)
+		}
+		return uint64(math.MaxInt64) + 1 + uint64(rng.Int63())
+	case 7:
+		return float32(floats[rng.Intn(len(floats))])
+	case 8:
+		return floats[rng.Intn(len(floats))]
+	default:
+		return rng.Intn(2) == 0
+	}
+}
+
+// The reference ordering of tuples, independent of the encoding.
+func compareTuples(a, b tuple.Tuple) int {
+	for idx := 0; idx < len(a) && idx < len(b); idx++ {
+		if c := compareElems(a[idx], b[idx]); c != 0 {
+			return c
+		}
+	}
+	return compareInts(len(a), len(b))
+}
+
+func typeRank(elem any) int {
+	switch elem.(type) {
+	case nil:
+		return 0
+	case []byte:
+		return 1
+	case string:
+		return 2
+	case tuple.Tuple:
+		return 3
+	case int64, uint64:
+		return 4
+	case float32:
+		return 5
+	case float64:
+		return 6
+	default:
+		return 7
+	}
+}
+
+func compareElems(a, b any) int {
+	if c := compareInts(typeRank(a), typeRank(b)); c != 0 {
+		return c
+	}
+	switch a := a.(type) {
+	case nil:
+		return 0
+	case []byte:
+		return bytes.Compare(a, b.([]byte))
+	case string:
+		return bytes.Compare([]byte(a), []byte(b.(string)))
+	case tuple.Tuple:
+		return compareTuples(a, b.(tuple.Tuple))
+	case int64:
+		switch b := b.(type) {
+		case int64:
+			return compareOrdered(a, b)
+		default:
+			return -1 // every uint64 here is > MaxInt64
+		}
+	case uint64:
+		switch b := b.(type) {
+		case uint64:
+			return compareOrdered(a, b)
+		default:
+			return 1
+		}
+	case float32:
+		return compareFloats(float64(a), float64(b.(float32)))
+	case float64:
+		return compareFloats(a, b.(float64))
+	case bool:
+		bb := b.(bool)
+		switch {
+		case a == bb:
+			return 0
+		case bb:
+			return -1
+		default:
+			return 1
+		}
+	}
+	panic("unreachable")
+}
+
+func compareFloats(a, b float64) int {
+	// -0 sorts before +0.
+	if a == 0 && b == 0 {
+		return compareInts(boolInt(!math.Signbit(a)), boolInt(!math.Signbit(b)))
+	}
+	return compareOrdered(a, b)
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func compareInts(a, b int) int {
+	return compareOrdered(a, b)
+}
+
+func compareOrdered[T int | int64 | uint64 | float64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
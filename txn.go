@@ -8,6 +8,8 @@ package golmdb
 */
 import "C"
 import (
+	"errors"
+	"fmt"
 	"sync/atomic"
 	"unsafe"
 )
@@ -33,12 +35,32 @@ func (self *value) bytesNoCopy() []byte {
 type ReadOnlyTxn struct {
 	txn            *C.MDB_txn
 	resizeRequired *uint32
+	names          *dbNames
+	expiry         *expiryRegistry
+	versions       *versionRegistry
+	compression    *compressionRegistry
+	sequences      *sequencesRef
+	// nil for txns which cannot write.
+	merges *mergeBuffer
 }
 
 // A ReadWriteTxn extends ReadOnlyTxn with methods for mutating the
 // database.
 type ReadWriteTxn struct {
 	ReadOnlyTxn
+	dbRefOps []dbRefOp
+	indexes  *indexRegistry
+}
+
+// Records a DBRef being opened or dropped within a ReadWriteTxn. Once
+// the txn commits, the server keeps track of these so that it can
+// open the same DBRefs again should it ever have to reopen the
+// environment.
+type dbRefOp struct {
+	dbRef   DBRef
+	name    string
+	flags   DatabaseFlag
+	dropped bool
 }
 
 // DBRef gets a reference to a named database within the LMDB. If you
@@ -63,18 +85,73 @@ func (self *ReadOnlyTxn) DBRef(name string, flags DatabaseFlag) (DBRef, error) {
 	var dbRef C.MDB_dbi
 	err := asError(C.mdb_dbi_open(self.txn, cName, C.uint(flags), &dbRef))
 	if err != nil {
-		return 0, err
+		return 0, newOpError("DBRef", 0, name, nil, err)
 	}
+	self.names.set(DBRef(dbRef), name)
 	return DBRef(dbRef), nil
 }
 
+// Opens the named database of db again, within this txn. A DBRef
+// opened by a View (as it must be, when ReadOnly) is only valid
+// within that View, so this makes it valid within this txn too.
+func (self *ReadOnlyTxn) reopen(db DBRef) (name string, err error) {
+	name = self.names.get(db)
+	if name == "" {
+		return "", fmt.Errorf("DBRef %d is not a named database", db)
+	}
+	reopened, err := self.DBRef(name, 0)
+	if err != nil {
+		return "", err
+	} else if reopened != db {
+		return "", fmt.Errorf("DBRef %d is not database %q, which is DBRef %d", db, name, reopened)
+	}
+	return name, nil
+}
+
+// mdb_stat. http://www.lmdb.tech/doc/group__mdb.html#gae6c1069febe94299769dbdd032fadef6
+func (self *ReadOnlyTxn) isEmpty(db DBRef) (bool, error) {
+	var stat C.MDB_stat
+	if err := asError(C.mdb_stat(self.txn, C.MDB_dbi(db), &stat)); err != nil {
+		return false, err
+	}
+	return stat.ms_entries == 0, nil
+}
+
+// Wraps a non-nil err from LMDB in an OpError.
+func (self *ReadOnlyTxn) opError(op string, db DBRef, key []byte, err error) error {
+	if err == nil {
+		return nil
+	}
+	return newOpError(op, db, self.names.get(db), key, err)
+}
+
+// DBRef gets a reference to a named database within the LMDB, exactly
+// as ReadOnlyTxn.DBRef does. DBRefs obtained from Updates remain valid
+// even if the database is compacted with LMDBClient.Compact.
+func (self *ReadWriteTxn) DBRef(name string, flags DatabaseFlag) (DBRef, error) {
+	dbRef, err := self.ReadOnlyTxn.DBRef(name, flags)
+	if err != nil {
+		return 0, err
+	}
+	self.dbRefOps = append(self.dbRefOps, dbRefOp{dbRef: dbRef, name: name, flags: flags &^ Create})
+	return dbRef, nil
+}
+
 // Empty the database. All key-value pairs are removed from the
 // database.
 //
 // See
 // http://www.lmdb.tech/doc/group__mdb.html#gab966fab3840fc54a6571dfb32b00f2db
+//
+// If the database has indexes (see LMDBClient.DeclareIndex), they are
+// emptied too.
 func (self *ReadWriteTxn) Empty(db DBRef) error {
-	return self.emptyOrDrop(db, 0)
+	for _, index := range self.indexes.get(db) {
+		if err := self.Empty(index.db); err != nil {
+			return err
+		}
+	}
+	return self.opError("Empty", db, nil, self.emptyOrDrop(db, 0))
 }
 
 // Drop the database. Not only are all key-value pairs removed from
@@ -84,11 +161,27 @@ func (self *ReadWriteTxn) Empty(db DBRef) error {
 //
 // See
 // http://www.lmdb.tech/doc/group__mdb.html#gab966fab3840fc54a6571dfb32b00f2db
+//
+// If the database has indexes (see LMDBClient.DeclareIndex), they are
+// dropped too. Once the txn commits, the indexes are no longer
+// maintained.
 func (self *ReadWriteTxn) Drop(db DBRef) error {
-	return self.emptyOrDrop(db, 1)
+	for _, index := range self.indexes.get(db) {
+		if err := self.Drop(index.db); err != nil {
+			return err
+		}
+	}
+	if err := self.emptyOrDrop(db, 1); err != nil {
+		return self.opError("Drop", db, nil, err)
+	}
+	self.dbRefOps = append(self.dbRefOps, dbRefOp{dbRef: db, dropped: true})
+	return nil
 }
 
 func (self *ReadWriteTxn) emptyOrDrop(db DBRef, flag C.int) error {
+	if err := self.merges.flush(db); err != nil {
+		return err
+	}
 	return asError(C.mdb_drop(self.txn, C.MDB_dbi(db), flag))
 }
 
@@ -99,41 +192,152 @@ func (self *ReadWriteTxn) emptyOrDrop(db DBRef, flag C.int) error {
 // the end of the transaction. If you need the value around longer
 // than that, you must take a copy.
 //
+// If expiry is enabled for the database (see LMDBClient.EnableExpiry),
+// keys which have expired are NotFound, even before they are swept.
+//
 // See
 // http://www.lmdb.tech/doc/group__mdb.html#ga8bf10cd91d3f3a83a34d04ce6b07992d
 func (self *ReadOnlyTxn) Get(db DBRef, key []byte) ([]byte, error) {
+	val, err := self.get(db, key)
+	if err != nil {
+		return nil, err
+	}
+	if expired, err := self.expired(db, key); err != nil {
+		return nil, err
+	} else if expired {
+		return nil, self.opError("Get", db, key, NotFound)
+	}
+	return val, nil
+}
+
+// GetIfExists is the same as Get, except that if the key does not
+// exist (or has expired), found is false and err is nil. Unlike the
+// NotFound OpError from Get, this does not allocate, so use it where
+// misses are expected to be common, and the context of an OpError is
+// not needed.
+func (self *ReadOnlyTxn) GetIfExists(db DBRef, key []byte) (val []byte, found bool, err error) {
+	val, _, err = self.lookup(db, key)
+	if err == NotFound {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	if expired, err := self.expired(db, key); err != nil {
+		return nil, false, err
+	} else if expired {
+		return nil, false, nil
+	}
+	return val, true, nil
+}
+
+// Get, regardless of expiry.
+func (self *ReadOnlyTxn) get(db DBRef, key []byte) ([]byte, error) {
+	val, _, err := self.getWithVersion(db, key)
+	return val, err
+}
+
+// The version is 0 unless the database is versioned.
+func (self *ReadOnlyTxn) getWithVersion(db DBRef, key []byte) (val []byte, version uint64, err error) {
+	val, version, err = self.lookup(db, key)
+	if err == NotFound {
+		return nil, 0, self.opError("Get", db, key, err)
+	}
+	return val, version, err
+}
+
+// As getWithVersion, except that NotFound is returned as it is.
+func (self *ReadOnlyTxn) lookup(db DBRef, key []byte) (val []byte, version uint64, err error) {
 	if atomic.LoadUint32(self.resizeRequired) == 1 {
-		return nil, MapFull
+		return nil, 0, MapFull
+	}
+	if err := self.merges.flush(db); err != nil {
+		return nil, 0, err
 	}
 	var data value
-	err := asError(C.golmdb_mdb_get(
+	err = asError(C.golmdb_mdb_get(
 		self.txn, C.MDB_dbi(db),
 		(*C.char)(unsafe.Pointer(&key[0])), C.size_t(len(key)),
 		(*C.MDB_val)(&data)))
-	if err != nil {
-		return nil, err
+	if err == NotFound {
+		return nil, 0, err
+	} else if err != nil {
+		return nil, 0, self.opError("Get", db, key, err)
+	}
+	val = data.bytesNoCopy()
+	if self.versions.enabled(db) {
+		if val, version, err = splitVersion(val); err != nil {
+			return nil, 0, self.opError("Get", db, key, err)
+		}
 	}
-	return data.bytesNoCopy(), nil
+	if compression := self.compression.get(db); compression != nil {
+		if val, err = compression.decompress(val); err != nil {
+			return nil, 0, self.opError("Get", db, key, err)
+		}
+	}
+	return val, version, nil
 }
 
 // Put a key-value pair into the database.
 //
+// If the database has indexes (see LMDBClient.DeclareIndex), they are
+// updated too. If expiry is enabled for the database (see
+// LMDBClient.EnableExpiry), any expiry of the key is removed: use
+// PutWithTTL to replace it instead.
+//
 // See
 // http://www.lmdb.tech/doc/group__mdb.html#ga4fa8573d9236d54687c61827ebf8cac0
 func (self *ReadWriteTxn) Put(db DBRef, key, val []byte, flags PutFlag) error {
+	if flags&NoOverwrite != 0 {
+		// an expired key must not prevent the Put.
+		if expired, err := self.expired(db, key); err != nil {
+			return err
+		} else if expired {
+			if err = self.Delete(db, key, nil); err != nil && !errors.Is(err, NotFound) {
+				return err
+			}
+		}
+	}
+	var err error
+	if indexes := self.indexes.get(db); len(indexes) != 0 {
+		err = self.putIndexed(indexes, db, key, val, flags)
+	} else {
+		err = self.put(db, key, val, flags)
+	}
+	if err != nil {
+		return err
+	}
+	return self.clearExpiry(db, key)
+}
+
+func (self *ReadWriteTxn) put(db DBRef, key, val []byte, flags PutFlag) error {
+	if err := self.merges.flush(db); err != nil {
+		return err
+	}
+	var err error
+	if compression := self.compression.get(db); compression != nil {
+		if val, err = compression.compress(val); err != nil {
+			return self.opError("Put", db, key, err)
+		}
+	}
+	if self.versions.enabled(db) {
+		if val, err = self.withVersion(db, val); err != nil {
+			return err
+		}
+	}
 	if len(val) == 0 {
-		return asError(C.golmdb_mdb_put(
+		err = asError(C.golmdb_mdb_put(
 			self.txn, C.MDB_dbi(db),
 			(*C.char)(unsafe.Pointer(&key[0])), C.size_t(len(key)),
 			nil, C.size_t(0),
 			C.uint(flags)))
 	} else {
-		return asError(C.golmdb_mdb_put(
+		err = asError(C.golmdb_mdb_put(
 			self.txn, C.MDB_dbi(db),
 			(*C.char)(unsafe.Pointer(&key[0])), C.size_t(len(key)),
 			(*C.char)(unsafe.Pointer(&val[0])), C.size_t(len(val)),
 			C.uint(flags)))
 	}
+	return self.opError("Put", db, key, err)
 }
 
 // Delete a key-value pair from the database.
@@ -141,19 +345,50 @@ func (self *ReadWriteTxn) Put(db DBRef, key, val []byte, flags PutFlag) error {
 // The val is only necessary if you're using DupSort. If not, it's
 // fine to use nil as val.
 //
+// If the database has indexes (see LMDBClient.DeclareIndex), they are
+// updated too. If expiry is enabled for the database, the key's expiry
+// is removed, and deleting a key which has expired returns NotFound.
+//
 // See
 // http://www.lmdb.tech/doc/group__mdb.html#gab8182f9360ea69ac0afd4a4eaab1ddb0
 func (self *ReadWriteTxn) Delete(db DBRef, key, val []byte) error {
+	expired, err := self.expired(db, key)
+	if err != nil {
+		return err
+	}
+	if indexes := self.indexes.get(db); len(indexes) != 0 {
+		err = self.deleteIndexed(indexes, db, key)
+	} else {
+		err = self.delete(db, key, val)
+	}
+	if err != nil && !errors.Is(err, NotFound) {
+		return err
+	}
+	if clearErr := self.clearExpiry(db, key); clearErr != nil {
+		return clearErr
+	}
+	if err == nil && expired {
+		return self.opError("Delete", db, key, NotFound)
+	}
+	return err
+}
+
+func (self *ReadWriteTxn) delete(db DBRef, key, val []byte) error {
+	if err := self.merges.flush(db); err != nil {
+		return err
+	}
+	var err error
 	if len(val) == 0 {
-		return asError(C.golmdb_mdb_del(
+		err = asError(C.golmdb_mdb_del(
 			self.txn, C.MDB_dbi(db),
 			(*C.char)(unsafe.Pointer(&key[0])), C.size_t(len(key)),
 			nil, C.size_t(0)))
 
 	} else {
-		return asError(C.golmdb_mdb_del(
+		err = asError(C.golmdb_mdb_del(
 			self.txn, C.MDB_dbi(db),
 			(*C.char)(unsafe.Pointer(&key[0])), C.size_t(len(key)),
 			(*C.char)(unsafe.Pointer(&val[0])), C.size_t(len(val))))
 	}
+	return self.opError("Delete", db, key, err)
 }
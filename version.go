@@ -0,0 +1,212 @@
+package golmdb
+
+/*
+#include <lmdb.h>
+*/
+import "C"
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Each value of a versioned database is stored with a header: its
+// version, as an 8-byte big-endian uint64.
+const versionHeaderLen = 8
+
+// The versions of each versioned database are allocated from a
+// sequence (see NextSequence) with this prefix and the database name.
+const versionSequencePrefix = "golmdb.version."
+
+// EnableVersioning gives every value of the database a version,
+// managed by the library: each Put allocates the value a new version,
+// which is unique within the database and greater than every version
+// allocated before. A key which is deleted and then put again gets a
+// new version too. So a version is suitable as an ETag: if the
+// version of a key is unchanged, so is its value.
+//
+// Read versions with GetVersioned, and write conditionally on them
+// with PutIfVersion. Everything else (Get, Put, cursors, indexes and
+// so on) sees only the values themselves: the version is stored as a
+// header which is added and removed by the library, and the value
+// returned by Get is still owned by the database, without a copy.
+//
+// The database must be a named database, must not be DupSort, and
+// must be empty when versioning is first enabled for it. Versions are
+// allocated from the sequence "golmdb.version.<name>", so Options.NumDBs
+// must allow for the reserved database in which sequences are kept.
+//
+// Like DeclareIndex, this is not persistent: each program must enable
+// versioning every time it opens the database, before it reads or
+// writes the database. Without this, Get returns values with their
+// headers, and Put writes values without them. That includes programs
+// which open the database ReadOnly: for them, db may come from a
+// View.
+func (self *LMDBClient) EnableVersioning(db DBRef) error {
+	// checked in a View, so that ReadOnly clients can read versioned
+	// databases too.
+	err := self.View(func(txn *ReadOnlyTxn) error {
+		name, err := txn.reopen(db)
+		if err != nil {
+			return fmt.Errorf("Cannot enable versioning: %w", err)
+		}
+		var flags C.uint
+		if err := asError(C.mdb_dbi_flags(txn.txn, C.MDB_dbi(db), &flags)); err != nil {
+			return txn.opError("EnableVersioning", db, nil, err)
+		}
+		if strings.HasPrefix(name, "golmdb.") {
+			return fmt.Errorf("Cannot enable versioning for database %q: it is reserved", name)
+		}
+		if DatabaseFlag(flags)&DupSort != 0 {
+			return fmt.Errorf("Cannot enable versioning for database %q: it is DupSort", name)
+		}
+		// values written before versioning was first enabled have no
+		// headers.
+		if last, err := txn.Sequence(versionSequencePrefix + name); err != nil {
+			return err
+		} else if last == 0 {
+			if empty, err := txn.isEmpty(db); err != nil {
+				return txn.opError("EnableVersioning", db, nil, err)
+			} else if !empty {
+				return fmt.Errorf("Cannot enable versioning for database %q: it is not empty", name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !self.environment.readOnly {
+		// open the sequences database now, so that Puts can reuse its
+		// DBRef.
+		err = self.Update(func(txn *ReadWriteTxn) error {
+			_, err := txn.sequencesDB()
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	self.environment.versions.enable(db)
+	return nil
+}
+
+// GetVersioned gets the value corresponding to the key, exactly as
+// Get, along with its version. Versioning must be enabled for the
+// database (see LMDBClient.EnableVersioning).
+func (self *ReadOnlyTxn) GetVersioned(db DBRef, key []byte) (val []byte, version uint64, err error) {
+	if !self.versions.enabled(db) {
+		return nil, 0, fmt.Errorf("Cannot get version from database %q: versioning is not enabled", self.names.get(db))
+	}
+	val, version, err = self.getWithVersion(db, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if expired, err := self.expired(db, key); err != nil {
+		return nil, 0, err
+	} else if expired {
+		return nil, 0, self.opError("GetVersioned", db, key, NotFound)
+	}
+	return val, version, nil
+}
+
+// PutIfVersion puts the key-value pair, exactly as Put, provided the
+// key's current version is version; if version is 0, the key must not
+// exist. Otherwise, it returns a *ConflictError and writes nothing. It
+// returns the new version of the key.
+//
+// This is the write half of an HTTP PUT with If-Match: the version
+// from GetVersioned, in a View, serves as the ETag.
+func (self *ReadWriteTxn) PutIfVersion(db DBRef, key, val []byte, version uint64) (uint64, error) {
+	_, current, err := self.GetVersioned(db, key)
+	found := err == nil
+	if err != nil && !errors.Is(err, NotFound) {
+		return 0, err
+	}
+	var reason string
+	if version == 0 && found {
+		reason = "key exists"
+	} else if version != 0 && !found {
+		reason = "key does not exist"
+	} else if current != version {
+		reason = fmt.Sprintf("version is %d, not %d", current, version)
+	}
+	if reason != "" {
+		return 0, &ConflictError{
+			Op:     "PutIfVersion",
+			DB:     self.names.get(db),
+			Key:    append([]byte(nil), key...),
+			Reason: reason,
+		}
+	}
+	if err = self.Put(db, key, val, 0); err != nil {
+		return 0, err
+	}
+	_, current, err = self.getWithVersion(db, key)
+	return current, err
+}
+
+// Adds a header with a new version to the value of a versioned
+// database.
+func (self *ReadWriteTxn) withVersion(db DBRef, val []byte) ([]byte, error) {
+	version, err := self.NextSequence(versionSequencePrefix + self.names.get(db))
+	if err != nil {
+		return nil, err
+	}
+	versioned := make([]byte, versionHeaderLen, versionHeaderLen+len(val))
+	binary.BigEndian.PutUint64(versioned, version)
+	return append(versioned, val...), nil
+}
+
+// Removes the header from a value of a versioned database. The value
+// returned aliases data.
+func splitVersion(data []byte) (val []byte, version uint64, err error) {
+	if len(data) < versionHeaderLen {
+		return nil, 0, fmt.Errorf("Versioned value has only %d bytes: %w", len(data), Corrupted)
+	}
+	return data[versionHeaderLen:], binary.BigEndian.Uint64(data), nil
+}
+
+// The databases for which versioning is enabled.
+type versionRegistry struct {
+	// non-zero once any database is enabled, so that checks are cheap
+	// until then.
+	inUse uint32
+	lock  sync.RWMutex
+	dbs   map[DBRef]struct{}
+}
+
+func newVersionRegistry() *versionRegistry {
+	return &versionRegistry{dbs: make(map[DBRef]struct{})}
+}
+
+func (self *versionRegistry) enable(db DBRef) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.dbs[db] = struct{}{}
+	atomic.StoreUint32(&self.inUse, 1)
+}
+
+func (self *versionRegistry) enabled(db DBRef) bool {
+	if self == nil || atomic.LoadUint32(&self.inUse) == 0 {
+		return false
+	}
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	_, found := self.dbs[db]
+	return found
+}
+
+// Once a Drop has committed, the dropped database is no longer
+// versioned.
+func (self *versionRegistry) dropped(db DBRef) {
+	if self == nil {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.dbs, db)
+}
@@ -0,0 +1,161 @@
+package golmdb_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/matryer/is"
+
+	"wellquite.org/golmdb"
+)
+
+func TestVersioning(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	defer client.TerminateSync()
+
+	docs, err := createDBRef(client, "docs", 0)
+	is.NoErr(err)
+	is.NoErr(client.EnableVersioning(docs))
+
+	var v1 uint64
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) (err error) {
+		if v1, err = txn.PutIfVersion(docs, []byte("a"), []byte("one"), 0); err != nil {
+			return err
+		}
+		is.True(v1 > 0)
+		_, err = txn.PutIfVersion(docs, []byte("a"), []byte("two"), 0)
+		is.True(errors.Is(err, golmdb.ErrConflict))
+		return txn.Put(docs, []byte("b"), []byte("bee"), 0)
+	})
+	is.NoErr(err)
+
+	var etag uint64
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		val, version, err := txn.GetVersioned(docs, []byte("a"))
+		is.NoErr(err)
+		is.Equal(string(val), "one")
+		is.Equal(version, v1)
+		etag = version
+
+		// everything else sees just the values.
+		val, err = txn.Get(docs, []byte("a"))
+		is.NoErr(err)
+		is.Equal(string(val), "one")
+		cursor, err := txn.NewCursor(docs)
+		is.NoErr(err)
+		defer cursor.Close()
+		var values []string
+		_, val, err = cursor.First()
+		for ; err == nil; _, val, err = cursor.Next() {
+			values = append(values, string(val))
+		}
+		is.True(errors.Is(err, golmdb.NotFound))
+		is.Equal(values, []string{"one", "bee"})
+		return nil
+	})
+	is.NoErr(err)
+
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		v2, err := txn.PutIfVersion(docs, []byte("a"), []byte("two"), etag)
+		is.NoErr(err)
+		is.True(v2 > etag)
+		// the ETag is now stale.
+		_, err = txn.PutIfVersion(docs, []byte("a"), []byte("three"), etag)
+		var conflict *golmdb.ConflictError
+		is.True(errors.As(err, &conflict))
+		is.Equal(conflict.Op, "PutIfVersion")
+
+		// deleting and putting again gives a new version.
+		is.NoErr(txn.Delete(docs, []byte("a"), nil))
+		is.NoErr(txn.Put(docs, []byte("a"), []byte("two"), 0))
+		_, v3, err := txn.GetVersioned(docs, []byte("a"))
+		is.NoErr(err)
+		is.True(v3 > v2)
+		return nil
+	})
+	is.NoErr(err)
+}
+
+func TestVersioningInvalid(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	defer client.TerminateSync()
+
+	dupSort, err := createDBRef(client, "dupsort", golmdb.DupSort)
+	is.NoErr(err)
+	is.True(client.EnableVersioning(dupSort) != nil)
+
+	plain, err := createDBRef(client, "plain", 0)
+	is.NoErr(err)
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) error {
+		return txn.Put(plain, []byte("k"), []byte("v"), 0)
+	})
+	is.NoErr(err)
+	// plain already has unversioned values.
+	is.True(client.EnableVersioning(plain) != nil)
+
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		_, _, err := txn.GetVersioned(plain, []byte("k"))
+		is.True(err != nil)
+		return nil
+	})
+	is.NoErr(err)
+}
+
+func TestVersioningReadOnly(t *testing.T) {
+	SetGlobalLogLevelDebug()
+	log := NewTestLogger(t)
+	is := is.New(t)
+
+	client, dir, err := createDatabase(log, 16)
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	docs, err := createDBRef(client, "docs", 0)
+	is.NoErr(err)
+	is.NoErr(client.EnableVersioning(docs))
+	var version uint64
+	err = client.Update(func(txn *golmdb.ReadWriteTxn) (err error) {
+		version, err = txn.PutIfVersion(docs, []byte("a"), []byte("one"), 0)
+		return err
+	})
+	is.NoErr(err)
+	client.TerminateSync()
+
+	client, err = golmdb.Open(dir, golmdb.Options{Log: log, NumDBs: 4, Flags: golmdb.ReadOnly})
+	is.NoErr(err)
+	defer client.TerminateSync()
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) (err error) {
+		docs, err = txn.DBRef("docs", 0)
+		return err
+	})
+	is.NoErr(err)
+	is.NoErr(client.EnableVersioning(docs))
+
+	err = client.View(func(txn *golmdb.ReadOnlyTxn) error {
+		docs, err := txn.DBRef("docs", 0)
+		if err != nil {
+			return err
+		}
+		val, err := txn.Get(docs, []byte("a"))
+		is.NoErr(err)
+		is.Equal(string(val), "one")
+		_, got, err := txn.GetVersioned(docs, []byte("a"))
+		is.NoErr(err)
+		is.Equal(got, version)
+		return nil
+	})
+	is.NoErr(err)
+}